@@ -8,6 +8,7 @@ workdir=$3
 pushd $workdir
 go test ./... -v -cover
 go build -o $outfile -ldflags "-X main.version=$verflag -extldflags '-static'"
+go build -o $(dirname $outfile)/fhidctl -ldflags "-X main.version=$verflag -extldflags '-static'" ./fhidctl
 # now set build dir to 777 so jenkins user can delete stuff in the volume
 chmod -R 777 ./build
 ls -al ./build/
@@ -0,0 +1,299 @@
+// Package client is a Go client for the fhid API.
+//
+//	c := client.New("https://images.company.com/v1.0")
+//	c.Token = os.Getenv("FHID_TOKEN")
+//	id, err := c.CreateImage(ctx, &fhidTypes.ImageEntry{Version: "1.2.4", BaseOS: "Arch"})
+//
+// Failed requests return an *Error carrying the code fhid responded
+// with. Requests that fail because fhid is busy or briefly unavailable
+// are retried with backoff.
+package client
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GESkunkworks/fhid/fhidTypes"
+)
+
+// Defaults used by New
+const (
+	DefaultAuthHeader = "x-api-key"
+	DefaultRetries    = 3
+	DefaultBackoff    = 500 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+	DefaultTimeout    = 30 * time.Second
+)
+
+// idempotencyHeader carries the key that lets fhid recognise a retried
+// create.
+const idempotencyHeader = "Idempotency-Key"
+
+// Client talks to one fhid endpoint. Its fields can be changed after
+// New but not while requests are in flight.
+type Client struct {
+	// Endpoint is the versioned API root, e.g.
+	// https://images.company.com/v1.0
+	Endpoint string
+	// Token is sent in AuthHeader on every request, or as a bearer
+	// token if Bearer is set.
+	Token      string
+	AuthHeader string
+	Bearer     bool
+	HTTPClient *http.Client
+	// Retries is how many times a request is retried after the first
+	// attempt. Backoff doubles after each retry up to MaxBackoff, a
+	// Retry-After from fhid is used instead when it's longer.
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	UserAgent  string
+}
+
+// Health is the status reported by the healthcheck.
+type Health struct {
+	State   string
+	Version string
+}
+
+// envelope is how fhid wraps every response.
+type envelope struct {
+	Success   string
+	Data      json.RawMessage
+	Error     *Error
+	RequestID string
+}
+
+// New returns a Client for endpoint with the defaults filled in.
+func New(endpoint string) *Client {
+	return &Client{
+		Endpoint:   strings.TrimSuffix(endpoint, "/"),
+		AuthHeader: DefaultAuthHeader,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		Retries:    DefaultRetries,
+		Backoff:    DefaultBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		UserAgent:  "fhid-client",
+	}
+}
+
+// CreateImage posts a new entry and returns its ImageID. Entries with
+// release notes need the image:release entitlement as well as
+// image:create.
+func (c *Client) CreateImage(ctx context.Context, entry *fhidTypes.ImageEntry) (id string, err error) {
+	// every attempt carries the same key so a retry of a create
+	// that was written returns the first entry rather than a copy
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return "", err
+	}
+	header := http.Header{idempotencyHeader: {key}}
+	err = c.doWithHeader(ctx, "POST", "/images", header, entry, true, &id)
+	return id, err
+}
+
+// newIdempotencyKey returns a random Idempotency-Key.
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	_, err := crand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GetImage returns the entry with the given ImageID.
+func (c *Client) GetImage(ctx context.Context, id string) (*fhidTypes.ImageEntry, error) {
+	var results fhidTypes.ImageQueryResults
+	err := c.do(ctx, "GET", "/images/"+url.PathEscape(id), nil, true, &results)
+	if err != nil {
+		return nil, err
+	}
+	if len(results.Results) != 1 {
+		return nil, fmt.Errorf("fhid: expected one entry for '%s', got %d", id, len(results.Results))
+	}
+	return &results.Results[0], nil
+}
+
+// PatchRelease replaces the release notes of an entry.
+func (c *Client) PatchRelease(ctx context.Context, id string, notes *fhidTypes.ReleaseNotes) error {
+	body := struct{ ReleaseNotes *fhidTypes.ReleaseNotes }{notes}
+	return c.do(ctx, "PATCH", "/images/"+url.PathEscape(id)+"/release", body, true, nil)
+}
+
+// Query returns the entries matching q. Only the first field of q that
+// is set is searched on, see the README for the supported queries.
+func (c *Client) Query(ctx context.Context, q *fhidTypes.ImageQuery) ([]fhidTypes.ImageEntry, error) {
+	var results fhidTypes.ImageQueryResults
+	err := c.do(ctx, "POST", "/query", q, true, &results)
+	return results.Results, err
+}
+
+// FindByArtifact returns the entries that built or released an
+// artifact, given its identifier: an AMI ID, Glance image ID, Azure
+// resource ID, GCE image self-link or name, Docker digest or
+// repository@digest, or vSphere template path.
+func (c *Client) FindByArtifact(ctx context.Context, id string) ([]fhidTypes.ImageEntry, error) {
+	return c.Query(ctx, &fhidTypes.ImageQuery{
+		Artifact: &fhidTypes.ImageQuerySub{StringMatch: "^" + regexp.QuoteMeta(id) + "$"},
+	})
+}
+
+// FindByAMI returns the entries that built or released the AMI.
+func (c *Client) FindByAMI(ctx context.Context, amiID string) ([]fhidTypes.ImageEntry, error) {
+	return c.FindByArtifact(ctx, amiID)
+}
+
+// Healthcheck returns the service's health.
+func (c *Client) Healthcheck(ctx context.Context) (*Health, error) {
+	health := &Health{}
+	err := c.do(ctx, "GET", "/healthcheck", nil, true, health)
+	return health, err
+}
+
+// do sends the request, retrying as allowed, and decodes the Data of
+// the response into out. Requests that aren't idempotent are only
+// retried when fhid turned them away before acting on them.
+func (c *Client) do(ctx context.Context, method, path string, in interface{}, idempotent bool, out interface{}) error {
+	return c.doWithHeader(ctx, method, path, nil, in, idempotent, out)
+}
+
+// doWithHeader is do, sending header on every attempt.
+func (c *Client) doWithHeader(ctx context.Context, method, path string, header http.Header, in interface{}, idempotent bool, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		wait, err := c.attempt(ctx, method, path, header, body, out)
+		retryable := wait >= 0 && (idempotent || isTurnedAway(err))
+		if err == nil || !retryable || attempt >= c.Retries {
+			return err
+		}
+		if wait < backoff {
+			wait = backoff
+		}
+		if c.MaxBackoff > 0 && wait > c.MaxBackoff {
+			wait = c.MaxBackoff
+		}
+		// jitter so clients that failed together don't retry together
+		if wait > 0 {
+			wait += time.Duration(rand.Int63n(int64(wait)/4 + 1))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// isTurnedAway returns true for failures fhid sends before it's done
+// anything with the request.
+func isTurnedAway(err error) bool {
+	return IsCode(err, CodeRateLimited) || IsCode(err, CodeAuthUnavailable)
+}
+
+// attempt makes one request. wait is how long fhid asked the client to
+// wait before retrying, or -1 if the request shouldn't be retried.
+func (c *Client) attempt(ctx context.Context, method, path string, header http.Header, body []byte, out interface{}) (wait time.Duration, err error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.Endpoint+path, reader)
+	if err != nil {
+		return -1, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	if c.Token != "" {
+		if c.Bearer {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		} else {
+			req.Header.Set(c.AuthHeader, c.Token)
+		}
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		// network errors are worth another go
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	var env envelope
+	if jerr := json.Unmarshal(data, &env); jerr != nil || (env.Error == nil && resp.StatusCode != http.StatusOK) {
+		// not from fhid, most likely a proxy in front of it
+		err = &Error{
+			StatusCode: resp.StatusCode,
+			Code:       CodeInternal,
+			Message:    fmt.Sprintf("Unexpected response: %s", truncate(string(data), 200)),
+		}
+		return retryWait(resp), err
+	}
+	if env.Error != nil {
+		env.Error.StatusCode = resp.StatusCode
+		env.Error.RequestID = env.RequestID
+		return retryWait(resp), env.Error
+	}
+	if out != nil && len(env.Data) > 0 {
+		err = json.Unmarshal(env.Data, out)
+	}
+	return -1, err
+}
+
+// retryWait returns how long to wait before retrying a failed
+// response, or -1 if retrying won't help.
+func retryWait(resp *http.Response) time.Duration {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return -1
+	}
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
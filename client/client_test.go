@@ -0,0 +1,267 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	log "github.com/inconshreveable/log15"
+
+	"github.com/GESkunkworks/fhid/fhid"
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+	"github.com/GESkunkworks/fhid/fhidTypes"
+)
+
+const testKey = "fhid-client-test-key"
+
+// runServer starts the real fhid handlers against a fake Redis with a
+// single API key that can create, release and read entries.
+func runServer(t *testing.T) (*httptest.Server, func()) {
+	fhidLogger.Loggo = log.New()
+	fhidLogger.Loggo.SetHandler(log.DiscardHandler())
+	redis, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Unable to start fake Redis for testing: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "fhid-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(testKey))
+	keys := `[{"Name": "ci-bot", "KeyHash": "` + hex.EncodeToString(sum[:]) + `", "Groups": ["builders"]}]`
+	keysFile := filepath.Join(dir, "keys.json")
+	err = ioutil.WriteFile(keysFile, []byte(keys), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fhidConfig.Config = &fhidConfig.Configuration{
+		RedisEndpoint:      redis.Addr(),
+		RedisImageIndexSet: "IMAGE_INDEX",
+		Authentication: &fhidConfig.Authentication{
+			AuthEnabled:   true,
+			Provider:      fhidConfig.ProviderAPIKeys,
+			APIKeys:       &fhidConfig.APIKeysProvider{File: keysFile},
+			AuthHeaderKey: DefaultAuthHeader,
+			AuthorizedGroups: []*fhidConfig.AuthGroup{{
+				GroupID: "builders",
+				Entitlements: []*fhidConfig.Entitlement{
+					{Type: fhidConfig.EntitlementImageCreate},
+					{Type: fhidConfig.EntitlementImageRelease},
+				},
+			}},
+		},
+	}
+	err = fhid.SetupAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fhid.SetupConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.StripPrefix("/v1.0", fhid.NewRouter()))
+	return server, func() {
+		server.Close()
+		fhid.TeardownConnection()
+		redis.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func testClient(server *httptest.Server) *Client {
+	c := New(server.URL + "/v1.0/")
+	c.Token = testKey
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func newEntry() *fhidTypes.ImageEntry {
+	return &fhidTypes.ImageEntry{
+		Version: "1.2.4",
+		BaseOS:  "Arch",
+		BuildNotes: &fhidTypes.BuildNotes{
+			BuildLog: []string{"line one"},
+			OutputAmis: []*fhidTypes.AmiEntry{
+				{AmiID: "ami-54321", AmiRegion: "us-west-1"},
+			},
+		},
+	}
+}
+
+// TestClient runs an entry through the client from creation to
+// release and looks it up again.
+func TestClient(t *testing.T) {
+	server, stop := runServer(t)
+	defer stop()
+	c := testClient(server)
+	ctx := context.Background()
+
+	health, err := c.Healthcheck(ctx)
+	if err != nil || health.State != "Healthy" {
+		t.Fatalf("healthcheck: got %+v, %v", health, err)
+	}
+	id, err := c.CreateImage(ctx, newEntry())
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	entry, err := c.GetImage(ctx, id)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if entry.ImageID != id || entry.BaseOS != "Arch" || entry.CreatedBy != "ci-bot" {
+		t.Errorf("get: unexpected entry %+v", entry)
+	}
+	err = c.PatchRelease(ctx, id, &fhidTypes.ReleaseNotes{
+		ReleaseNote: "GA",
+		Amis:        []*fhidTypes.AmiEntry{{AmiID: "ami-0abc1", AmiRegion: "us-east-1"}},
+		ReleaseDate: "2018-01-30 04:36:25",
+	})
+	if err != nil {
+		t.Fatalf("release: %s", err)
+	}
+	entry, err = c.GetImage(ctx, id)
+	if err != nil || entry.ReleaseNotes == nil || entry.ReleaseNotes.ReleaseNote != "GA" {
+		t.Errorf("get after release: got %+v, %v", entry, err)
+	}
+
+	other := newEntry()
+	other.BaseOS = "Ubuntu16.04"
+	other.BuildNotes.OutputAmis[0].AmiID = "ami-543210"
+	_, err = c.CreateImage(ctx, other)
+	if err != nil {
+		t.Fatalf("create second entry: %s", err)
+	}
+	results, err := c.Query(ctx, &fhidTypes.ImageQuery{BaseOS: &fhidTypes.ImageQuerySub{StringMatch: "Ubuntu.*"}})
+	if err != nil || len(results) != 1 || results[0].BaseOS != "Ubuntu16.04" {
+		t.Errorf("query: got %+v, %v", results, err)
+	}
+	for ami, want := range map[string]int{"ami-54321": 1, "ami-0abc1": 1, "ami-99999": 0} {
+		results, err := c.FindByAMI(ctx, ami)
+		if err != nil || len(results) != want {
+			t.Errorf("find %s: got %d results, want %d: %v", ami, len(results), want, err)
+		}
+		if want == 1 && err == nil && len(results) == 1 && results[0].ImageID != id {
+			t.Errorf("find %s: found the wrong entry %s", ami, results[0].ImageID)
+		}
+	}
+}
+
+// TestClientErrors makes sure failures come back as typed errors.
+func TestClientErrors(t *testing.T) {
+	server, stop := runServer(t)
+	defer stop()
+	c := testClient(server)
+	ctx := context.Background()
+
+	_, err := c.GetImage(ctx, "nope")
+	if !IsNotFound(err) {
+		t.Errorf("missing entry: got %v", err)
+	}
+	_, err = c.CreateImage(ctx, &fhidTypes.ImageEntry{})
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusBadRequest || e.Code != CodeInvalidRequest || len(e.Fields) != 2 || e.RequestID == "" {
+		t.Errorf("invalid entry: got %#v", err)
+	}
+	c.Token = ""
+	_, err = c.CreateImage(ctx, newEntry())
+	e, ok = err.(*Error)
+	if !ok || e.Code != CodeMissingCredentials || e.Entitlement != fhidConfig.EntitlementImageCreate {
+		t.Errorf("no token: got %v", err)
+	}
+	c.Token = "wrong"
+	_, err = c.CreateImage(ctx, newEntry())
+	if !IsCode(err, CodeInvalidCredentials) && !IsCode(err, CodeInsufficientEntitlement) {
+		t.Errorf("wrong token: got %v", err)
+	}
+}
+
+// TestClientRetries makes sure busy responses are retried, creates are
+// retried under the same Idempotency-Key so they're only written once,
+// and contexts are honoured.
+func TestClientRetries(t *testing.T) {
+	server, stop := runServer(t)
+	defer stop()
+	var calls, failures, lost int32
+	var keys []string
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Method == "POST" {
+			keys = append(keys, r.Header.Get("Idempotency-Key"))
+		}
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html>bad gateway</html>"))
+			return
+		}
+		if atomic.AddInt32(&lost, -1) >= 0 {
+			// fhid handles it but the response never arrives
+			http.StripPrefix("/v1.0", fhid.NewRouter()).ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		http.StripPrefix("/v1.0", fhid.NewRouter()).ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+	c := testClient(server)
+	c.Endpoint = flaky.URL + "/v1.0"
+	ctx := context.Background()
+
+	failures = 2
+	if _, err := c.Healthcheck(ctx); err != nil {
+		t.Errorf("read after two failures: %s", err)
+	}
+	if calls != 3 {
+		t.Errorf("read: got %d calls, want 3", calls)
+	}
+
+	calls, failures = 0, 10
+	_, err := c.Healthcheck(ctx)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusBadGateway {
+		t.Errorf("read out of retries: got %v", err)
+	}
+	if calls != int32(c.Retries+1) {
+		t.Errorf("read out of retries: got %d calls, want %d", calls, c.Retries+1)
+	}
+
+	count := func() int {
+		entries, err := c.Query(ctx, &fhidTypes.ImageQuery{Version: &fhidTypes.ImageQuerySub{StringMatch: "^1\\.2\\.4$"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	failures = 0
+	before := count()
+	calls, lost, keys = 0, 1, nil
+	if _, err := c.CreateImage(ctx, newEntry()); err != nil {
+		t.Fatalf("create with a lost response: %s", err)
+	}
+	if calls != 2 || keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("create: got %d calls with keys %v, want 2 with the same key", calls, keys)
+	}
+	if got := count(); got != before+1 {
+		t.Errorf("retried create wrote %d entries, want 1", got-before)
+	}
+	if _, err := c.CreateImage(ctx, newEntry()); err != nil || keys[2] == keys[0] {
+		t.Errorf("a new create should get a new key: %v %v", keys, err)
+	}
+
+	calls, failures = 0, 10
+	c.Backoff = time.Hour
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Healthcheck(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("cancelled during backoff: got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Codes fhid returns in the Error.Code field of a failed response
+const (
+	CodeInvalidRequest          = "InvalidRequest"
+	CodeNotFound                = "NotFound"
+	CodeMethodNotAllowed        = "MethodNotAllowed"
+	CodeConflict                = "Conflict"
+	CodeTenantForbidden         = "TenantForbidden"
+	CodeQueryFailed             = "QueryFailed"
+	CodeInternal                = "InternalError"
+	CodeRateLimited             = "RateLimited"
+	CodeTooLarge                = "RequestTooLarge"
+	CodeMissingCredentials      = "MissingCredentials"
+	CodeInvalidCredentials      = "InvalidCredentials"
+	CodeInsufficientEntitlement = "InsufficientEntitlement"
+	CodeAuthUnavailable         = "AuthUnavailable"
+)
+
+// FieldError describes a problem with one field of a request body.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// Error is returned for requests fhid answered with a failure.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// Entitlement is set on auth failures to the entitlement
+	// the request needed.
+	Entitlement string
+	Fields      []*FieldError
+	RequestID   string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("fhid: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	if len(e.Fields) > 0 {
+		fields := make([]string, 0, len(e.Fields))
+		for _, f := range e.Fields {
+			fields = append(fields, f.Field+" "+f.Message)
+		}
+		msg += " (" + strings.Join(fields, "; ") + ")"
+	}
+	if e.RequestID != "" {
+		msg += " [request " + e.RequestID + "]"
+	}
+	return msg
+}
+
+// IsCode returns true if err is an Error with the given code.
+func IsCode(err error, code string) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == code
+}
+
+// IsNotFound returns true if err means the image doesn't exist, or
+// isn't visible to the caller.
+func IsNotFound(err error) bool {
+	return IsCode(err, CodeNotFound)
+}
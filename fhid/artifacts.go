@@ -0,0 +1,86 @@
+package fhid
+
+import (
+	"path"
+	"regexp"
+
+	"github.com/GESkunkworks/fhid/fhidTypes"
+)
+
+// Artifact providers
+const (
+	ArtifactAWS       = fhidTypes.ArtifactAWS
+	ArtifactOpenStack = fhidTypes.ArtifactOpenStack
+	ArtifactAzure     = fhidTypes.ArtifactAzure
+	ArtifactGCE       = fhidTypes.ArtifactGCE
+	ArtifactDocker    = fhidTypes.ArtifactDocker
+	ArtifactVMware    = fhidTypes.ArtifactVMware
+)
+
+// KnownArtifactProviders lists every valid Artifact Provider.
+var KnownArtifactProviders = fhidTypes.KnownArtifactProviders
+
+// Artifact is an image built for, or released to, any of the supported
+// providers, see fhidTypes.Artifact.
+type Artifact = fhidTypes.Artifact
+
+// Patterns for provider specific identifiers
+var (
+	uuidPattern           = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	azureIDPattern        = regexp.MustCompile(`^/subscriptions/[^/]+/[Rr]esource[Gg]roups/[^/]+/providers/[Mm]icrosoft\.[Cc]ompute/.+$`)
+	galleryVersionPattern = regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+$`)
+	selfLinkPattern       = regexp.MustCompile(`^https://(www|compute)\.googleapis\.com/compute/(v1|beta)/projects/[^/]+/global/images/[^/]+$`)
+	digestPattern         = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+)
+
+// artifactIDs returns the identifiers the artifact can be looked up by.
+func artifactIDs(a *Artifact) []string {
+	switch a.Provider {
+	case ArtifactAWS:
+		return []string{a.AmiID}
+	case ArtifactOpenStack:
+		return []string{a.GlanceImageID}
+	case ArtifactAzure:
+		return []string{a.ResourceID}
+	case ArtifactGCE:
+		// Packer and gcloud refer to images by name
+		return []string{a.SelfLink, path.Base(a.SelfLink)}
+	case ArtifactDocker:
+		return []string{a.Repository + "@" + a.Digest, a.Digest}
+	case ArtifactVMware:
+		return []string{a.TemplatePath}
+	}
+	return nil
+}
+
+// amiArtifacts returns AMI entries as aws Artifacts.
+func amiArtifacts(amis []*AmiEntry) []*Artifact {
+	var artifacts []*Artifact
+	for _, ami := range amis {
+		if ami != nil {
+			artifacts = append(artifacts, &Artifact{
+				Provider:    ArtifactAWS,
+				AmiID:       ami.AmiID,
+				AmiRegion:   ami.AmiRegion,
+				AmiSharedTo: ami.AmiSharedTo,
+				Tags:        ami.AmiTags,
+			})
+		}
+	}
+	return artifacts
+}
+
+// artifacts returns every artifact built or released for the entry,
+// AMIs included.
+func (i *buildEntry) artifacts() []*Artifact {
+	var artifacts []*Artifact
+	if i.BuildNotes != nil {
+		artifacts = append(artifacts, amiArtifacts(i.BuildNotes.OutputAmis)...)
+		artifacts = append(artifacts, i.BuildNotes.Artifacts...)
+	}
+	if i.ReleaseNotes != nil {
+		artifacts = append(artifacts, amiArtifacts(i.ReleaseNotes.Amis)...)
+		artifacts = append(artifacts, i.ReleaseNotes.Artifacts...)
+	}
+	return artifacts
+}
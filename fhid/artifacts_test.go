@@ -0,0 +1,141 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const imageWithArtifacts = `
+{
+    "Version": "4.0.0",
+    "BaseOS": "Ubuntu18.04",
+    "BuildNotes": {
+        "OutputAmis": [{"AmiID": "ami-0abc1", "AmiRegion": "us-east-1"}],
+        "Artifacts": [
+            {"Provider": "openstack", "GlanceImageID": "0d8c4a0e-5f4b-4c53-9a4e-3b1d2f6a7c81", "Project": "platform"},
+            {"Provider": "gce", "SelfLink": "https://www.googleapis.com/compute/v1/projects/skunk/global/images/base-4-0-0"},
+            {"Provider": "docker", "Repository": "registry.example.com/base",
+             "Digest": "sha256:4e9f2cdf438714c2c4533e28c6c41a89cc6c1b46cf77e54c488db30ca4f5b6bf"}
+        ]
+    },
+    "ReleaseNotes": {
+        "ReleaseDate": "2018-01-30 04:36:25",
+        "Artifacts": [
+            {"Provider": "azure",
+             "ResourceID": "/subscriptions/1234/resourceGroups/images/providers/Microsoft.Compute/galleries/skunk/images/base/versions/4.0.0",
+             "GalleryVersion": "4.0.0"},
+            {"Provider": "vmware", "TemplatePath": "/dc1/vm/templates/base-4.0.0"}
+        ]
+    }
+}
+`
+
+func queryArtifact(t *testing.T, pattern string) []ImageEntry {
+	body, _ := json.Marshal(map[string]interface{}{"Artifact": map[string]string{"StringMatch": pattern}})
+	req, err := http.NewRequest("POST", "/query", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("query '%s': got status %d: %s", pattern, rr.Code, rr.Body.String())
+	}
+	var resp imageQueryResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Data.Results
+}
+
+// TestArtifacts makes sure entries with artifacts of every provider can
+// be stored and found by any of their identifiers.
+func TestArtifacts(t *testing.T) {
+	setupValidation(t)
+	rr := postImage(t, imageWithArtifacts)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = postImage(t, imageGood)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	cases := []struct {
+		name    string
+		pattern string
+		want    int
+	}{
+		{"glance id", "^0d8c4a0e-5f4b-4c53-9a4e-3b1d2f6a7c81$", 1},
+		{"gce image name", "^base-4-0-0$", 1},
+		{"docker digest", "^sha256:4e9f2cdf4387", 1},
+		{"docker reference", "^registry.example.com/base@sha256:", 1},
+		{"azure gallery", "/galleries/skunk/", 1},
+		{"vmware template", "^/dc1/vm/templates/", 1},
+		{"ami", "^ami-0abc1$", 1},
+		{"no match", "^ami-00000$", 0},
+	}
+	for _, c := range cases {
+		results := queryArtifact(t, c.pattern)
+		if len(results) != c.want {
+			t.Errorf("%s: got %d results, want %d", c.name, len(results), c.want)
+			continue
+		}
+		if c.want > 0 && results[0].Version != "4.0.0" {
+			t.Errorf("%s: matched entry version %s", c.name, results[0].Version)
+		}
+	}
+
+	// entries without artifacts read back without them
+	results := queryArtifact(t, ".")
+	for _, r := range results {
+		data, _ := json.Marshal(r)
+		if r.Version != "4.0.0" && strings.Contains(string(data), "Artifacts") {
+			t.Errorf("entry without artifacts has them in its JSON: %s", data)
+		}
+	}
+}
+
+// TestArtifactsInvalid makes sure artifacts are checked against the
+// rules for their provider.
+func TestArtifactsInvalid(t *testing.T) {
+	setupValidation(t)
+	cases := []struct {
+		name     string
+		artifact string
+		fields   []string
+	}{
+		{"no provider", `{"AmiID": "ami-0abc1"}`, []string{"Provider"}},
+		{"unknown provider", `{"Provider": "mainframe"}`, []string{"Provider"}},
+		{"missing openstack fields", `{"Provider": "openstack"}`, []string{"GlanceImageID", "Project"}},
+		{"bad glance id", `{"Provider": "openstack", "GlanceImageID": "12345", "Project": "p"}`, []string{"GlanceImageID"}},
+		{"bad digest", `{"Provider": "docker", "Repository": "base", "Digest": "latest"}`, []string{"Digest"}},
+		{"bad azure id", `{"Provider": "azure", "ResourceID": "base", "GalleryVersion": "4"}`, []string{"ResourceID", "GalleryVersion"}},
+		{"bad self link", `{"Provider": "gce", "SelfLink": "base-4-0-0"}`, []string{"SelfLink"}},
+		{"other provider's field", `{"Provider": "vmware", "TemplatePath": "/t", "Digest": "sha256:0"}`, []string{"Digest"}},
+		{"aws", `{"Provider": "aws", "AmiID": "ami-0abc1"}`, []string{"AmiRegion"}},
+	}
+	for _, c := range cases {
+		rr := postImage(t, `{"Version":"1","BaseOS":"x","BuildNotes":{"Artifacts":[`+c.artifact+`]}}`)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d: %s", c.name, rr.Code, rr.Body.String())
+			continue
+		}
+		var want []string
+		for _, f := range c.fields {
+			want = append(want, "BuildNotes.Artifacts[0]."+f)
+		}
+		if got := strings.Join(fieldsOf(t, rr), ","); got != strings.Join(want, ",") {
+			t.Errorf("%s: got field errors for %s, want %s", c.name, got, strings.Join(want, ","))
+		}
+	}
+	rr := postImage(t, `{"Version":"1","BaseOS":"x","BuildNotes":{"Artifacts":[{"Provider":"vmware","TemplatePath":"/t","Digest":"x"}]}}`)
+	if !strings.Contains(rr.Body.String(), "only used for docker artifacts") {
+		t.Errorf("error doesn't say which provider the field is for: %s", rr.Body.String())
+	}
+}
@@ -1,44 +1,146 @@
 package fhid
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/GESkunkworks/fhid/fhidLogger"
 
 	"github.com/GESkunkworks/fhid/fhidConfig"
 )
 
+// defaultAuthTimeout is used when Authentication.AuthTimeout isn't set.
+const defaultAuthTimeout = 10 * time.Second
+
+// authClient is shared by all calls to the auth URL so connections
+// can be reused.
+var authClient = &http.Client{}
+
+// authResponse is the body returned by the auth URL.
+type authResponse struct {
+	Success bool
+	UserID  string
+}
+
 // callAuth calls out to the auth URL and checks to see if the provided
-// authKey is a member of the provided groupID.
-func callAuth(authKey string, groupID string) (member bool, err error) {
+// authKey is a member of the provided groupID. The user ID the token
+// belongs to is returned when the auth URL reports it.
+func callAuth(ctx context.Context, authKey string, groupID string) (member bool, userID string, err error) {
 	member = false
 	url := fhidConfig.Config.Authentication.AuthURL + fhidConfig.Config.Authentication.AuthMemberCheckMethod
 	fhidLogger.Loggo.Debug("Build auth url.", "URL", url)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return member, err
+		return member, userID, err
 	}
+	req = req.WithContext(ctx)
 	// set authkey in request header
 	req.Header.Set(fhidConfig.Config.Authentication.AuthHeaderKey, authKey)
 	// set groupid in request header
 	req.Header.Set(fhidConfig.Config.Authentication.AuthHeaderGroup, groupID)
 	fhidLogger.Loggo.Info("Calling auth url", "URL", url)
-	client := http.Client{}
-	resp, err := client.Do(req)
+	resp, err := authClient.Do(req)
 	if err != nil {
 		fhidLogger.Loggo.Error("Got error from auth url", "Error", err)
-		return member, err
+		return member, userID, err
 	}
+	defer resp.Body.Close()
 	fhidLogger.Loggo.Info("Got response from auth url", "Response", resp)
-	if resp.StatusCode == http.StatusOK {
+	// a 401 just means the key isn't in this group, the caller
+	// may still be a member of another one. Anything else means
+	// the auth service couldn't answer.
+	switch resp.StatusCode {
+	case http.StatusOK:
 		member = true
-	} else if resp.StatusCode == http.StatusUnauthorized {
-		member = false
-		err = errors.New("Unauthorized")
+	case http.StatusUnauthorized:
+	default:
+		return member, userID, fmt.Errorf("Auth url returned status %d", resp.StatusCode)
+	}
+	var ar authResponse
+	if json.NewDecoder(resp.Body).Decode(&ar) == nil {
+		userID = ar.UserID
+	}
+	return member, userID, err
+}
+
+// cachedCallAuth wraps callAuth with the membership cache.
+func cachedCallAuth(ctx context.Context, authKey string, groupID string) (member bool, userID string, err error) {
+	key := authCacheKey(authKey, groupID)
+	member, userID, ok := membershipCache.get(key)
+	if ok {
+		fhidLogger.Loggo.Debug("Membership cache hit", "GroupID", groupID, "Member", member)
+		return member, userID, nil
+	}
+	member, userID, err = callAuth(ctx, authKey, groupID)
+	if err != nil {
+		return member, userID, err
+	}
+	ttl := fhidConfig.Config.Authentication.AuthNegativeCacheTTL
+	if member {
+		ttl = fhidConfig.Config.Authentication.AuthCacheTTL
 	}
-	return member, err
+	membershipCache.set(key, member, userID, time.Duration(ttl)*time.Second)
+	return member, userID, err
+}
+
+// membershipResult is the outcome of checking one group.
+type membershipResult struct {
+	member bool
+	userID string
+	err    error
+}
+
+// checkMemberships checks the authKey against all of the groups at once
+// and returns the membership of each group in the same order. If the
+// checks don't all finish within the configured timeout an error is
+// returned. The user ID is taken from the first group that reports one.
+func checkMemberships(authKey string, groups []*fhidConfig.AuthGroup) (members []bool, userID string, err error) {
+	timeout := defaultAuthTimeout
+	if fhidConfig.Config.Authentication.AuthTimeout > 0 {
+		timeout = time.Duration(fhidConfig.Config.Authentication.AuthTimeout) * time.Second
+	}
+	// on an early return the outstanding checks are cancelled and
+	// waited for so none of them outlive the request
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	results := make([]chan membershipResult, len(groups))
+	for i, group := range groups {
+		results[i] = make(chan membershipResult, 1)
+		wg.Add(1)
+		go func(groupID string, out chan membershipResult) {
+			defer wg.Done()
+			member, userID, err := cachedCallAuth(ctx, authKey, groupID)
+			out <- membershipResult{member, userID, err}
+		}(group.GroupID, results[i])
+	}
+	members = make([]bool, len(groups))
+	for i := range groups {
+		select {
+		case res := <-results[i]:
+			if res.err != nil {
+				fhidLogger.Loggo.Error("Error from callAuth", "GroupID", groups[i].GroupID, "Error", res.err)
+				return members, userID, res.err
+			}
+			members[i] = res.member
+			if userID == "" {
+				userID = res.userID
+			}
+		case <-ctx.Done():
+			fhidLogger.Loggo.Error("Timed out checking group membership", "Timeout", timeout)
+			return members, userID, errors.New("Timed out checking group membership")
+		}
+	}
+	return members, userID, nil
 }
 
 // redacter just trims out chars from a sensitive input
@@ -49,48 +151,109 @@ func redacter(pure string) (redacted string) {
 	return redacted
 }
 
+// tokenIdentity identifies a caller by a hash of their whole token,
+// for auth providers that don't report a user ID. redacter's output
+// is only fit for logs since tokens sharing a prefix redact the same.
+func tokenIdentity(authKey string) string {
+	sum := sha256.Sum256([]byte(authKey))
+	return "token:" + hex.EncodeToString(sum[:])
+}
+
 // requiresAuth takes a request and a desired entitlement and parses
 // the config and then calls the auth url to see if the token belongs
-// to an authorized user. Returns true if the user is entitled and an
-// error.
-func requiresAuth(r *http.Request, needs string) (err error) {
+// to an authorized user. Returns the tenants the user is entitled to
+// act on and an *authError if the user has no entitlement at all.
+func requiresAuth(r *http.Request, needs string) (access *tenantAccess, err error) {
 	fhidLogger.Loggo.Info("Entering requiresAuth")
+	access = &tenantAccess{}
 	authKey := r.Header.Get(fhidConfig.Config.Authentication.AuthHeaderKey)
+	if authKey == "" {
+		authKey = bearerToken(r)
+	}
 	authKeyRedacted := redacter(authKey)
 	fhidLogger.Loggo.Debug("debug authkey", "authkeyRedacted", authKeyRedacted)
+	if !hasCredentials(r, authKey) {
+		return access, errMissingCredentials(needs)
+	}
+	if strings.HasPrefix(authKey, serviceKeyPrefix) {
+		return serviceAccountAccess(r, authKey, needs)
+	}
+	access.principal = &principal{
+		Method:     methodFor(authProvider, r),
+		Token:      authKeyRedacted,
+		Credential: credentialHash(r, authKey),
+	}
 	hasEntitlement := false
+	// no point asking about membership in groups that can't grant
+	// what we need
+	var groups []*fhidConfig.AuthGroup
 	for _, group := range fhidConfig.Config.Authentication.AuthorizedGroups {
-		fhidLogger.Loggo.Debug("working on group", "Group", group.GroupID)
-		fhidLogger.Loggo.Debug("value of hasentitlement", "hasEntitlement", hasEntitlement)
-		if !hasEntitlement {
-			member, err := callAuth(authKey, group.GroupID)
-			if err != nil {
-				fhidLogger.Loggo.Error("Error from callAuth", "Error", err)
-				return err
-			}
-			if member {
-				for _, entitlement := range group.Entitlements {
-					fhidLogger.Loggo.Info("comparing entitlements for group", "GroupID", group.GroupID, "Entitlement", entitlement.Type)
-
-					if needs == entitlement.Type {
-						fhidLogger.Loggo.Info("Match!")
-						hasEntitlement = true
-					}
-				}
+		if groupHasEntitlement(group, needs) {
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == 0 {
+		return access, errInsufficientEntitlement(needs)
+	}
+	members, userID, err := authProvider.Memberships(r, groups)
+	if err != nil {
+		return access, errAuthUnavailable(err)
+	}
+	access.principal.UserID = userID
+	if userID == "" && authKey != "" {
+		access.principal.UserID = tokenIdentity(authKey)
+	}
+	for i, group := range groups {
+		if members[i] {
+			fhidLogger.Loggo.Info("Match!", "GroupID", group.GroupID, "Entitlement", needs, "Principal", access.principal.UserID)
+			hasEntitlement = true
+			access.grant(group)
+			if access.principal.Group == "" {
+				access.principal.Group = group.GroupID
 			}
 		}
 	}
 	if !hasEntitlement {
-		err = errors.New(messageUnauthorized())
-		return err
+		// providers only report a user ID for credentials they recognize
+		if userID == "" {
+			return access, errInvalidCredentials(needs)
+		}
+		return access, errInsufficientEntitlement(needs)
 	}
 
-	return err
+	return access, err
+}
+
+// hasCredentials returns true if the request carries any kind of
+// credentials one of the providers could check.
+func hasCredentials(r *http.Request, authKey string) bool {
+	if authKey != "" {
+		return true
+	}
+	if _, _, ok := r.BasicAuth(); ok {
+		return true
+	}
+	return r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+}
+
+// groupHasEntitlement returns true if the group grants the
+// entitlement needed.
+func groupHasEntitlement(group *fhidConfig.AuthGroup, needs string) bool {
+	for _, entitlement := range group.Entitlements {
+		fhidLogger.Loggo.Debug("comparing entitlements for group", "GroupID", group.GroupID, "Entitlement", entitlement.Type)
+		if entitlement.Grants(needs) {
+			return true
+		}
+	}
+	return false
 }
 
 // messageUnauthorized generates a user friendly unauthorized
 // return string.
 func messageUnauthorized() string {
+	if authProvider.Name() != fhidConfig.ProviderGaudi {
+		return "Unauthorized. Please make sure your credentials are valid and belong to a member of an authorized group."
+	}
 	msg := fmt.Sprintf("Unauthorized. Please make sure you have generated a token here '%s' and that the user who generated the token is a member of an authorized group. For help email cloudpod@ge.com.", fhidConfig.Config.Authentication.AuthURL)
 	return msg
 }
@@ -2,13 +2,19 @@ package fhid
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/GESkunkworks/fhid/fhidConfig"
 	"github.com/GESkunkworks/fhid/fhidLogger"
+	"github.com/inconshreveable/log15"
 	"github.com/jarcoal/httpmock"
 )
 
@@ -41,7 +47,10 @@ func TestAuthGoodRead(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 	httpmock.RegisterResponder("GET", "https://auth.me.com/v1.0/validmember",
-		httpmock.NewStringResponder(200, `{"Success":true,"Message":"User is currently valid and is member of group","UserID":"212601587","GroupID":"g00919618"}`))
+		func(req *http.Request) (*http.Response, error) {
+			// a new body each call, groups are checked concurrently
+			return httpmock.NewStringResponse(200, `{"Success":true,"Message":"User is currently valid and is member of group","UserID":"212601587","GroupID":"g00919618"}`), nil
+		})
 	// now we build a request
 	req, err := http.NewRequest("GET", "/images?ImageID=123-456", nil)
 
@@ -51,7 +60,7 @@ func TestAuthGoodRead(t *testing.T) {
 	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
 	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderGroup, "g00919618")
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImages)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
 	fhidLogger.Loggo.Debug("Got response", "Response", rr.Body)
 	if status := rr.Code; status != http.StatusNotFound {
@@ -84,7 +93,10 @@ func TestAuthBad(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 	httpmock.RegisterResponder("GET", "https://auth.me.com/v1.0/validmember",
-		httpmock.NewStringResponder(401, `{"Success":false,"Message":"User not found in group","UserID":"212601587","GroupID":"g00919618"}`))
+		func(req *http.Request) (*http.Response, error) {
+			// a new body each call, groups are checked concurrently
+			return httpmock.NewStringResponse(401, `{"Success":false,"Message":"User not found in group","UserID":"212601587","GroupID":"g00919618"}`), nil
+		})
 	// now we build a request
 	postBody := bytes.NewBufferString(imageGood)
 	req, err := http.NewRequest("POST", "/images/?Score=0", postBody)
@@ -94,13 +106,13 @@ func TestAuthBad(t *testing.T) {
 	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
 	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderGroup, "g1234566")
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImages)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
-	if status := rr.Code; status != http.StatusUnauthorized {
-		msg := fmt.Sprintf("handler returned wrong status code. Got %d, Want %d", status, http.StatusUnauthorized)
+	if status := rr.Code; status != http.StatusForbidden {
+		msg := fmt.Sprintf("handler returned wrong status code. Got %d, Want %d", status, http.StatusForbidden)
 		t.Fatal(msg)
 		fhidLogger.Loggo.Error("handler returned wrong status code",
-			"Got", status, "Want", http.StatusUnauthorized)
+			"Got", status, "Want", http.StatusForbidden)
 	}
 	httpmock.DeactivateAndReset()
 }
@@ -141,13 +153,577 @@ func TestAuthWrongGroup(t *testing.T) {
 	}
 	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImages)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
-	if status := rr.Code; status != http.StatusUnauthorized {
-		msg := fmt.Sprintf("handler returned wrong status code. Got %d, Want %d", status, http.StatusUnauthorized)
+	if status := rr.Code; status != http.StatusForbidden {
+		msg := fmt.Sprintf("handler returned wrong status code. Got %d, Want %d", status, http.StatusForbidden)
 		t.Fatal(msg)
 		fhidLogger.Loggo.Error("handler returned wrong status code",
-			"Got", status, "Want", http.StatusUnauthorized)
+			"Got", status, "Want", http.StatusForbidden)
 	}
 	httpmock.DeactivateAndReset()
 }
+
+// TestAuthReadEnforced makes sure reads require the read entitlement
+// when anonymous reads are turned off and that endpoints can be opened
+// back up individually.
+func TestAuthReadEnforced(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	fhidConfig.Config.Authentication.AuthEnabled = true
+	fhidConfig.Config.Authentication.ReadAccess = fhidConfig.ReadAuthenticated
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "https://auth.me.com/v1.0/validmember",
+		func(req *http.Request) (*http.Response, error) {
+			// a new body each call, groups are checked concurrently
+			return httpmock.NewStringResponse(401, `{"Success":false,"Message":"User not found in group","UserID":"212601587","GroupID":"g00919618"}`), nil
+		})
+
+	req, err := http.NewRequest("GET", "/images?ImageID=123-456", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code. Got %d, Want %d", status, http.StatusForbidden)
+	}
+
+	req, err = http.NewRequest("POST", "/query", bytes.NewBufferString(ImageQueryBaseOS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
+	rr = httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code. Got %d, Want %d", status, http.StatusForbidden)
+	}
+
+	// now open up just the query endpoint
+	fhidConfig.Config.Authentication.EndpointReadAccess = map[string]string{"query": fhidConfig.ReadAnonymous}
+	req, err = http.NewRequest("POST", "/query", bytes.NewBufferString(ImageQueryBaseOS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code. Got %d, Want %d", status, http.StatusOK)
+	}
+}
+
+// TestAuthCache makes sure membership decisions are cached, negative
+// decisions use their own TTL and the counters are kept up to date.
+func TestAuthCache(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	membershipCache.reset()
+	defer membershipCache.reset()
+	fhidConfig.Config.Authentication.AuthEnabled = true
+	fhidConfig.Config.Authentication.AuthCacheTTL = 60
+	fhidConfig.Config.Authentication.AuthNegativeCacheTTL = 0
+	var calls int32
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "https://auth.me.com/v1.0/validmember",
+		func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			if req.Header.Get(fhidConfig.Config.Authentication.AuthHeaderGroup) == "g01236390" {
+				return httpmock.NewStringResponse(200, `{"Success":true}`), nil
+			}
+			return httpmock.NewStringResponse(401, `{"Success":false}`), nil
+		})
+	post := func() int {
+		req, err := http.NewRequest("POST", "/images", bytes.NewBufferString(imageGood))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
+		rr := httptest.NewRecorder()
+		NewRouter().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	// only the write group should be asked about a write
+	if code := post(); code != http.StatusOK || atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("first write: got status %d and %d auth calls, want 200 and 1", code, atomic.LoadInt32(&calls))
+	}
+	if code := post(); code != http.StatusOK || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("cached write: got status %d and %d auth calls, want 200 and 1", code, atomic.LoadInt32(&calls))
+	}
+	stats := membershipCache.stats()
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("unexpected cache counters: %+v", stats)
+	}
+
+	// negative results aren't cached without a negative TTL
+	fhidConfig.Config.Authentication.ReadAccess = fhidConfig.ReadAuthenticated
+	read := func() int {
+		req, err := http.NewRequest("GET", "/images?ImageID=123-456", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
+		rr := httptest.NewRecorder()
+		NewRouter().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	atomic.StoreInt32(&calls, 0)
+	read()
+	read()
+	// both groups have read, the write group is cached and the
+	// other is asked each time
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("uncached negative reads: got %d auth calls, want 2", atomic.LoadInt32(&calls))
+	}
+	fhidConfig.Config.Authentication.AuthNegativeCacheTTL = 60
+	atomic.StoreInt32(&calls, 0)
+	read()
+	read()
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("cached negative reads: got %d auth calls, want 1", atomic.LoadInt32(&calls))
+	}
+	// a different token shouldn't share cached decisions
+	req, err := http.NewRequest("POST", "/images", bytes.NewBufferString(imageGood))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "54321")
+	NewRouter().ServeHTTP(httptest.NewRecorder(), req)
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("new token: got %d auth calls, want 2", atomic.LoadInt32(&calls))
+	}
+}
+
+// TestAuthCacheEviction makes sure the cache stays within its size by
+// evicting the least recently used decisions.
+func TestAuthCacheEviction(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	fhidConfig.Config.Authentication.AuthCacheSize = 2
+	c := newAuthCache()
+	c.set("a", true, "1", time.Minute)
+	c.set("b", true, "2", time.Minute)
+	// reading a makes b the least recently used
+	if _, _, ok := c.get("a"); !ok {
+		t.Fatal("a wasn't cached")
+	}
+	c.set("c", true, "3", time.Minute)
+	if _, _, ok := c.get("b"); ok {
+		t.Error("least recently used decision wasn't evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, _, ok := c.get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+	if stats := c.stats(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("unexpected cache counters: %+v", stats)
+	}
+	for i := 0; i < 100; i++ {
+		c.set(fmt.Sprintf("token-%d", i), false, "", time.Minute)
+	}
+	if stats := c.stats(); stats.Entries != 2 {
+		t.Errorf("cache grew to %d entries", stats.Entries)
+	}
+}
+
+// TestEntitlements makes sure creating an image and releasing one
+// are checked separately, including release notes on a new entry.
+func TestEntitlements(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	fhidConfig.Config.Authentication.AuthEnabled = true
+	fhidConfig.Config.Authentication.AuthorizedGroups[0].Entitlements = []*fhidConfig.Entitlement{
+		{Type: fhidConfig.EntitlementImageCreate},
+	}
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockMemberOf("g01236390")
+
+	rr := postImage(t, `{"Version":"1.0.0","BaseOS":"Ubuntu16.04","ReleaseNotes":{}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("create without release notes: got %d, want %d", rr.Code, http.StatusOK)
+	}
+	var j imagePostResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = postImage(t, `{"Version":"1.0.0","BaseOS":"Ubuntu16.04","ReleaseNotes":{"ReleaseNote":"GA"}}`)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("create with release notes: got %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	req, err := http.NewRequest("PATCH", "/images?ImageID="+j.Data, bytes.NewBufferString(`{"ReleaseNotes":{"ReleaseNote":"GA"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
+	rr = httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("release without image:release: got %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	// admin implies every entitlement
+	fhidConfig.Config.Authentication.AuthorizedGroups[0].Entitlements = []*fhidConfig.Entitlement{
+		{Type: fhidConfig.EntitlementAdmin},
+	}
+	membershipCache.reset()
+	req, err = http.NewRequest("PATCH", "/images?ImageID="+j.Data, bytes.NewBufferString(`{"ReleaseNotes":{"ReleaseNote":"GA"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
+	rr = httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("release as admin: got %d, want %d", rr.Code, http.StatusOK)
+	}
+}
+
+// TestValidateEntitlements makes sure unknown entitlement names
+// are rejected when the config is loaded.
+func TestValidateEntitlements(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("default test config should be valid: %s", err)
+	}
+	fhidConfig.Config.Authentication.AuthorizedGroups[1].Entitlements = []*fhidConfig.Entitlement{
+		{Type: "image:publish"},
+	}
+	if err = fhidConfig.Config.Validate(); err == nil {
+		t.Error("expected an error for an unknown entitlement")
+	}
+	// not enforced yet, but configs granting them are valid
+	fhidConfig.Config.Authentication.AuthorizedGroups[1].Entitlements = []*fhidConfig.Entitlement{
+		{Type: fhidConfig.EntitlementImageDeprecate},
+		{Type: fhidConfig.EntitlementImageDelete},
+		{Type: fhidConfig.EntitlementChannelPromote},
+	}
+	if err = fhidConfig.Config.Validate(); err != nil {
+		t.Errorf("unexpected error for known entitlements: %s", err)
+	}
+}
+
+// TestValidateReadAccess makes sure unknown read access modes and
+// endpoints are rejected rather than silently requiring auth.
+func TestValidateReadAccess(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("default test config should be valid: %s", err)
+	}
+	auth := fhidConfig.Config.Authentication
+	cases := []struct {
+		name      string
+		access    string
+		endpoints map[string]string
+		valid     bool
+	}{
+		{"defaults", "", nil, true},
+		{"known modes", fhidConfig.ReadAuthenticated, map[string]string{"query": fhidConfig.ReadAnonymous}, true},
+		{"unknown mode", "public", nil, false},
+		{"unknown endpoint mode", "", map[string]string{"images": "Anonymous"}, false},
+		{"unknown endpoint", "", map[string]string{"serach": fhidConfig.ReadAnonymous}, false},
+	}
+	for _, c := range cases {
+		auth.ReadAccess = c.access
+		auth.EndpointReadAccess = c.endpoints
+		err = fhidConfig.Config.Validate()
+		if (err == nil) != c.valid {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+}
+
+// TestCallerIdentity makes sure entries are stamped with the user
+// that created and last updated them.
+func TestCallerIdentity(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	membershipCache.reset()
+	defer membershipCache.reset()
+	fhidConfig.Config.Authentication.AuthEnabled = true
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "https://auth.me.com/v1.0/validmember",
+		func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get(fhidConfig.Config.Authentication.AuthHeaderGroup) == "g01236390" {
+				return httpmock.NewStringResponse(200, `{"Success":true,"UserID":"212601587","GroupID":"g01236390"}`), nil
+			}
+			return httpmock.NewStringResponse(401, `{"Success":false}`), nil
+		})
+
+	rr := postImage(t, imageGood)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("post: got %d, want %d", rr.Code, http.StatusOK)
+	}
+	var j imagePostResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() buildEntry {
+		data, err := Rget(j.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ie buildEntry
+		_, err = decodeEntry([]byte(data), &ie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ie
+	}
+	if ie := get(); ie.CreatedBy != "212601587" || ie.UpdatedBy != "" {
+		t.Errorf("unexpected stamps after create: CreatedBy '%s', UpdatedBy '%s'", ie.CreatedBy, ie.UpdatedBy)
+	}
+
+	key, err := CreateServiceAccount(&serviceAccount{Name: "release-bot", Entitlements: []string{fhidConfig.EntitlementImageRelease}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("PATCH", "/images?ImageID="+j.Data, bytes.NewBufferString(`{"ReleaseNotes":{"ReleaseNote":"GA"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, key)
+	rr = httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("patch: got %d, want %d", rr.Code, http.StatusOK)
+	}
+	if ie := get(); ie.CreatedBy != "212601587" || ie.UpdatedBy != "release-bot" {
+		t.Errorf("unexpected stamps after patch: CreatedBy '%s', UpdatedBy '%s'", ie.CreatedBy, ie.UpdatedBy)
+	}
+}
+
+// TestTokenIdentity makes sure tokens that redact the same still get
+// different identities, and that the identity doesn't leak the token.
+func TestTokenIdentity(t *testing.T) {
+	a, b := "abcde-first-token", "abcde-second-token"
+	if redacter(a) != redacter(b) {
+		t.Fatal("expected the tokens to redact the same")
+	}
+	if tokenIdentity(a) == tokenIdentity(b) {
+		t.Error("tokens sharing a prefix got the same identity")
+	}
+	if strings.Contains(tokenIdentity(a), "abcde") {
+		t.Errorf("identity leaks the token: %s", tokenIdentity(a))
+	}
+}
+
+// TestRequestLogging makes sure lines logged while storing, reading
+// and querying entries carry the request ID and principal.
+func TestRequestLogging(t *testing.T) {
+	setupValidation(t)
+	defer initLog()
+	var mu sync.Mutex
+	tagged := make(map[string]bool)
+	fhidLogger.Loggo.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for n := 0; n+1 < len(r.Ctx); n += 2 {
+			if r.Ctx[n] == "RequestID" && r.Ctx[n+1] != "" {
+				tagged[r.Msg] = true
+			}
+		}
+		return nil
+	}))
+
+	rr := postImage(t, imageGood)
+	var j imagePostResponse
+	json.Unmarshal(rr.Body.Bytes(), &j)
+	req, _ := http.NewRequest("GET", "/images/"+j.Data, nil)
+	NewRouter().ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = http.NewRequest("POST", "/query", bytes.NewBufferString(ImageQueryBaseOS))
+	NewRouter().ServeHTTP(httptest.NewRecorder(), req)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, msg := range []string{
+		"Processing image body request",
+		"Wrote entry successfully",
+		"Retrieved entry successfully",
+		"Executing query...",
+	} {
+		if !tagged[msg] {
+			t.Errorf("'%s' wasn't logged with the request ID", msg)
+		}
+	}
+}
+
+// TestAuthErrors makes sure each kind of auth failure gets its own
+// status and a structured body.
+func TestAuthErrors(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	membershipCache.reset()
+	defer membershipCache.reset()
+	fhidConfig.Config.Authentication.AuthEnabled = true
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	gaudiStatus := http.StatusUnauthorized
+	httpmock.RegisterResponder("GET", "https://auth.me.com/v1.0/validmember",
+		func(req *http.Request) (*http.Response, error) {
+			return httpmock.NewStringResponse(gaudiStatus, `{"Success":false,"UserID":"212601587"}`), nil
+		})
+
+	post := func(key string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/images", bytes.NewBufferString(imageGood))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, key)
+		}
+		rr := httptest.NewRecorder()
+		NewRouter().ServeHTTP(rr, req)
+		return rr
+	}
+	cases := []struct {
+		name   string
+		key    string
+		gaudi  int
+		status int
+		code   string
+	}{
+		{"missing credentials", "", http.StatusOK, http.StatusUnauthorized, authErrMissingCredentials},
+		{"unknown service key", "fhid_nope", http.StatusOK, http.StatusUnauthorized, authErrInvalidCredentials},
+		{"not a member", "12345", http.StatusUnauthorized, http.StatusForbidden, authErrInsufficientEntitlement},
+		{"backend error", "12345", http.StatusInternalServerError, http.StatusServiceUnavailable, authErrUnavailable},
+	}
+	for _, c := range cases {
+		gaudiStatus = c.gaudi
+		rr := post(c.key)
+		if rr.Code != c.status {
+			t.Errorf("%s: got status %d, want %d", c.name, rr.Code, c.status)
+		}
+		var body envelope
+		err = json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil || body.Error == nil {
+			t.Fatalf("%s: body isn't an error envelope: %s", c.name, rr.Body.String())
+		}
+		if body.Error.Code != c.code {
+			t.Errorf("%s: got error code '%s', want '%s'", c.name, body.Error.Code, c.code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: got content type '%s'", c.name, ct)
+		}
+		retry := rr.Header().Get("Retry-After")
+		if (c.status == http.StatusServiceUnavailable) != (retry != "") {
+			t.Errorf("%s: unexpected Retry-After '%s'", c.name, retry)
+		}
+	}
+
+	// a timeout from the auth service is also unavailable
+	fhidConfig.Config.Authentication.AuthTimeout = 1
+	httpmock.RegisterResponder("GET", "https://auth.me.com/v1.0/validmember",
+		func(req *http.Request) (*http.Response, error) {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		})
+	if rr := post("12345"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("timeout: got status %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// TestHealthCheckAuthCache makes sure the auth cache stats are only
+// shown to callers with read access.
+func TestHealthCheckAuthCache(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	membershipCache.reset()
+	defer membershipCache.reset()
+	fhidConfig.Config.Authentication.AuthEnabled = true
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockMemberOf("g01236390")
+	check := func(key string) bool {
+		req, err := http.NewRequest("GET", "/healthcheck", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, key)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(HealthCheck).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("healthcheck got status %d", rr.Code)
+		}
+		return strings.Contains(rr.Body.String(), "AuthCache")
+	}
+	if check("") {
+		t.Error("anonymous healthcheck got the auth cache stats")
+	}
+	if !check("12345") {
+		t.Error("authenticated healthcheck didn't get the auth cache stats")
+	}
+}
@@ -0,0 +1,129 @@
+package fhid
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+)
+
+// defaultAuthCacheSize is the most decisions cached when
+// AuthCacheSize isn't set.
+const defaultAuthCacheSize = 10000
+
+// authCacheStats holds counters for tuning the membership cache.
+type authCacheStats struct {
+	Hits      uint64 `json:"Hits"`
+	Misses    uint64 `json:"Misses"`
+	Evictions uint64 `json:"Evictions"`
+	Entries   int    `json:"Entries"`
+}
+
+// authCacheEntry is a cached membership decision.
+type authCacheEntry struct {
+	key     string
+	member  bool
+	userID  string
+	expires time.Time
+}
+
+// authCache caches membership decisions from the auth service keyed by
+// a hash of the token and the group ID so raw tokens are never held in
+// memory longer than the request. When it's full the least recently
+// used decision is evicted, so a flood of distinct tokens can't grow
+// it without bound.
+type authCache struct {
+	sync.Mutex
+	entries   map[string]*list.Element
+	order     *list.List
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// membershipCache is the package level membership cache.
+var membershipCache = newAuthCache()
+
+func newAuthCache() *authCache {
+	return &authCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// authCacheSize returns the most decisions the cache holds.
+func authCacheSize() int {
+	if size := fhidConfig.Config.Authentication.AuthCacheSize; size > 0 {
+		return size
+	}
+	return defaultAuthCacheSize
+}
+
+// authCacheKey builds the cache key for a token and group.
+func authCacheKey(authKey, groupID string) string {
+	sum := sha256.Sum256([]byte(authKey))
+	return hex.EncodeToString(sum[:]) + ":" + groupID
+}
+
+// get returns the cached decision and user ID for key and whether
+// one was found.
+func (c *authCache) get(key string) (member bool, userID string, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[key]
+	if ok && time.Now().After(el.Value.(*authCacheEntry).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return false, "", false
+	}
+	c.hits++
+	c.order.MoveToFront(el)
+	e := el.Value.(*authCacheEntry)
+	return e.member, e.userID, true
+}
+
+// set caches a decision for ttl. Nothing is cached for a zero ttl.
+func (c *authCache) set(key string, member bool, userID string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	e := &authCacheEntry{key: key, member: member, userID: userID, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(e)
+	for max := authCacheSize(); c.order.Len() > max; c.evictions++ {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops a cached decision, the caller holds the lock.
+func (c *authCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*authCacheEntry).key)
+}
+
+// stats returns a snapshot of the cache counters.
+func (c *authCache) stats() *authCacheStats {
+	c.Lock()
+	defer c.Unlock()
+	return &authCacheStats{Hits: c.hits, Misses: c.misses, Evictions: c.evictions, Entries: len(c.entries)}
+}
+
+// reset empties the cache and zeroes the counters.
+func (c *authCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order = list.New()
+	c.hits = 0
+	c.misses = 0
+	c.evictions = 0
+}
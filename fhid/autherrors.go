@@ -0,0 +1,84 @@
+package fhid
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Codes returned in the Error.Code field of auth failures
+const (
+	authErrMissingCredentials      = "MissingCredentials"
+	authErrInvalidCredentials      = "InvalidCredentials"
+	authErrInsufficientEntitlement = "InsufficientEntitlement"
+	authErrUnavailable             = "AuthUnavailable"
+)
+
+// authRetryAfter is the number of seconds clients are told to wait
+// before retrying when the auth backend is unavailable.
+const authRetryAfter = 30
+
+// authError is returned by requiresAuth when a request can't be
+// authorized. The code decides the status the caller gets back.
+type authError struct {
+	Code        string
+	Msg         string
+	Entitlement string
+	status      int
+}
+
+func (e *authError) Error() string {
+	return e.Msg
+}
+
+func errMissingCredentials(needs string) *authError {
+	return &authError{
+		Code:        authErrMissingCredentials,
+		Msg:         "No credentials were supplied with the request.",
+		Entitlement: needs,
+		status:      http.StatusUnauthorized,
+	}
+}
+
+func errInvalidCredentials(needs string) *authError {
+	return &authError{
+		Code:        authErrInvalidCredentials,
+		Msg:         "The credentials supplied with the request are not valid.",
+		Entitlement: needs,
+		status:      http.StatusUnauthorized,
+	}
+}
+
+func errInsufficientEntitlement(needs string) *authError {
+	return &authError{
+		Code:        authErrInsufficientEntitlement,
+		Msg:         messageUnauthorized(),
+		Entitlement: needs,
+		status:      http.StatusForbidden,
+	}
+}
+
+func errAuthUnavailable(err error) *authError {
+	return &authError{
+		Code:   authErrUnavailable,
+		Msg:    fmt.Sprintf("The authentication service is unavailable: %s", err),
+		status: http.StatusServiceUnavailable,
+	}
+}
+
+// writeAuthError sends an auth failure to the client. Errors that
+// aren't an authError came from the auth backend.
+func writeAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	ae, ok := err.(*authError)
+	if !ok {
+		ae = errAuthUnavailable(err)
+	}
+	if ae.status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(authRetryAfter))
+	}
+	writeAPIError(w, r, ae.status, &apiError{
+		Code:        ae.Code,
+		Message:     ae.Msg,
+		Entitlement: ae.Entitlement,
+	})
+}
@@ -0,0 +1,453 @@
+package fhid
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// defaultGroupsClaim is used when JWTProvider.GroupsClaim isn't set.
+const defaultGroupsClaim = "groups"
+
+// defaultJWKSTimeout is used when JWTProvider.JWKSTimeout isn't set.
+const defaultJWKSTimeout = 10 * time.Second
+
+// jwtAlgs maps the supported JWS algorithms to their hash.
+var jwtAlgs = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// jwtCurves maps the ECDSA algorithms to the curve their keys must be
+// on, RFC 7518 section 3.4.
+var jwtCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// jwk is a single key from a JSON Web Key Set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtHeader is the decoded JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims holds the registered claims fhid checks. The rest of the
+// claims are kept raw so the groups claim can be configured.
+type jwtClaims struct {
+	Sub string          `json:"sub"`
+	Iss string          `json:"iss"`
+	Aud json.RawMessage `json:"aud"`
+	Exp *float64        `json:"exp"`
+	Nbf *float64        `json:"nbf"`
+	raw map[string]json.RawMessage
+}
+
+// stringOrList decodes a claim that can be a string or a list of
+// strings.
+func stringOrList(raw json.RawMessage) []string {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return []string{one}
+	}
+	var many []string
+	json.Unmarshal(raw, &many)
+	return many
+}
+
+// jwtAuthenticator validates OIDC/JWT bearer tokens from the
+// Authorization header locally against the configured keys.
+type jwtAuthenticator struct {
+	sync.RWMutex
+	// keys by key ID, keys from PEM files have no ID
+	keys     map[string]crypto.PublicKey
+	pemKeys  []crypto.PublicKey
+	settings *fhidConfig.JWTProvider
+	// client fetches JWKSURL
+	client *http.Client
+	// stop ends refreshJWKS
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newJWTAuthenticator(c *fhidConfig.JWTProvider) (*jwtAuthenticator, error) {
+	timeout := defaultJWKSTimeout
+	if c.JWKSTimeout > 0 {
+		timeout = time.Duration(c.JWKSTimeout) * time.Second
+	}
+	j := &jwtAuthenticator{
+		settings: c,
+		keys:     make(map[string]crypto.PublicKey),
+		client:   &http.Client{Timeout: timeout},
+		stop:     make(chan struct{}),
+	}
+	for _, filename := range c.PublicKeyFiles {
+		key, err := readPEMPublicKey(filename)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading public key file '%s': %s", filename, err)
+		}
+		j.pemKeys = append(j.pemKeys, key)
+	}
+	if c.JWKSFile != "" {
+		b, err := ioutil.ReadFile(c.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseJWKS(b)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing JWKS file '%s': %s", c.JWKSFile, err)
+		}
+		j.keys = keys
+	}
+	if c.JWKSURL != "" {
+		err := j.fetchJWKS()
+		if err != nil {
+			return nil, err
+		}
+		if c.JWKSRefresh > 0 {
+			go j.refreshJWKS(time.Duration(c.JWKSRefresh) * time.Second)
+		}
+	}
+	if len(j.keys) == 0 && len(j.pemKeys) == 0 {
+		return nil, errors.New("No keys configured to validate JWTs")
+	}
+	fhidLogger.Loggo.Info("Loaded JWT keys", "JWKS", len(j.keys), "PEM", len(j.pemKeys))
+	return j, nil
+}
+
+// fetchJWKS replaces the key set with the one served at JWKSURL.
+func (j *jwtAuthenticator) fetchJWKS() error {
+	resp, err := j.client.Get(j.settings.JWKSURL)
+	if err != nil {
+		return fmt.Errorf("Error fetching JWKS '%s': %s", j.settings.JWKSURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error fetching JWKS '%s': status %d", j.settings.JWKSURL, resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return fmt.Errorf("Error parsing JWKS '%s': %s", j.settings.JWKSURL, err)
+	}
+	j.Lock()
+	j.keys = keys
+	j.Unlock()
+	return nil
+}
+
+// refreshJWKS periodically refetches the key set so rotated keys are
+// picked up, until Close is called. The old keys are kept if a fetch
+// fails.
+func (j *jwtAuthenticator) refreshJWKS(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := j.fetchJWKS()
+			if err != nil {
+				fhidLogger.Loggo.Error("Error refreshing JWKS, keeping existing keys", "Error", err)
+			}
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+// Close stops refreshing the key set. It's a no-op on the nil
+// authenticator a failed SetupAuth leaves behind.
+func (j *jwtAuthenticator) Close() {
+	if j == nil {
+		return
+	}
+	j.stopOnce.Do(func() { close(j.stop) })
+}
+
+// readPEMPublicKey reads a PKIX public key from a PEM file.
+func readPEMPublicKey(filename string) (crypto.PublicKey, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// parseJWKS reads the RSA and EC keys out of a JSON Web Key Set.
+func parseJWKS(b []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := json.Unmarshal(b, &set)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %s", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys found")
+	}
+	return keys, nil
+}
+
+// publicKey decodes the JWK, unsupported key types return nil.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := num(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := num(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func (j *jwtAuthenticator) Name() string {
+	return fhidConfig.ProviderJWT
+}
+
+// hasCredentials returns true if the request carries a bearer token.
+func (j *jwtAuthenticator) hasCredentials(r *http.Request) bool {
+	return bearerToken(r) != ""
+}
+
+func (j *jwtAuthenticator) Memberships(r *http.Request, groups []*fhidConfig.AuthGroup) ([]bool, string, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return make([]bool, len(groups)), "", nil
+	}
+	claims, err := j.validate(token, time.Now())
+	if err != nil {
+		fhidLogger.Loggo.Info("Rejected bearer token", "Token", redacter(token), "Reason", err)
+		return make([]bool, len(groups)), "", nil
+	}
+	id := &identity{Prefix: fhidConfig.MemberJWT, Name: claims.Sub, Groups: j.groups(claims)}
+	return id.memberships(groups)
+}
+
+// groups reads the configured groups claim and maps its values to
+// GroupIDs.
+func (j *jwtAuthenticator) groups(claims *jwtClaims) []string {
+	name := j.settings.GroupsClaim
+	if name == "" {
+		name = defaultGroupsClaim
+	}
+	values := stringOrList(claims.raw[name])
+	for i, v := range values {
+		if mapped, ok := j.settings.GroupMap[v]; ok {
+			values[i] = mapped
+		}
+	}
+	return values
+}
+
+// bearerToken returns the token from an 'Authorization: Bearer' header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// candidateKeys returns the keys a token with the given key ID could
+// have been signed with.
+func (j *jwtAuthenticator) candidateKeys(kid string) []crypto.PublicKey {
+	j.RLock()
+	defer j.RUnlock()
+	if key, ok := j.keys[kid]; ok {
+		return []crypto.PublicKey{key}
+	}
+	if kid != "" && len(j.pemKeys) == 0 {
+		return nil
+	}
+	keys := append([]crypto.PublicKey{}, j.pemKeys...)
+	if kid == "" {
+		for _, key := range j.keys {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// validate checks the token's signature and registered claims as of now
+// and returns its claims.
+func (j *jwtAuthenticator) validate(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header jwtHeader
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+	hash, ok := jwtAlgs[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported alg '%s'", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	verified := false
+	for _, key := range j.candidateKeys(header.Kid) {
+		if verifyJWTSignature(header.Alg, key, hash, digest, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+	claims := &jwtClaims{}
+	err = decodeJWTPart(parts[1], claims)
+	if err != nil {
+		return nil, err
+	}
+	err = decodeJWTPart(parts[1], &claims.raw)
+	if err != nil {
+		return nil, err
+	}
+	skew := int64(j.settings.ClockSkew)
+	if claims.Exp == nil || now.Unix() >= int64(*claims.Exp)+skew {
+		return nil, errors.New("token expired")
+	}
+	if claims.Nbf != nil && now.Unix() < int64(*claims.Nbf)-skew {
+		return nil, errors.New("token not valid yet")
+	}
+	if j.settings.Issuer != "" && claims.Iss != j.settings.Issuer {
+		return nil, fmt.Errorf("unexpected issuer '%s'", claims.Iss)
+	}
+	if j.settings.Audience != "" {
+		found := false
+		for _, aud := range stringOrList(claims.Aud) {
+			if aud == j.settings.Audience {
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New("token not issued for this audience")
+		}
+	}
+	return claims, nil
+}
+
+// verifyJWTSignature checks sig over digest with key, making sure the
+// key type, curve and hash all match the alg so an RSA key can't be used
+// to check an ECDSA signature, or a P-256 key an ES512 one.
+func verifyJWTSignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest, sig []byte) bool {
+	if want, ok := jwtAlgs[alg]; !ok || want != hash {
+		return false
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		if jwtCurves[alg] != k.Curve.Params().Name {
+			return false
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// decodeJWTPart base64url decodes and unmarshals a token segment.
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,192 @@
+package fhid
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// Authenticator works out which of the configured authorization groups
+// the caller of a request belongs to.
+type Authenticator interface {
+	// Name identifies the provider in logs.
+	Name() string
+	// Memberships returns whether the caller is a member of each of
+	// the groups, in the same order as groups, along with the caller's
+	// user ID if it's known.
+	Memberships(r *http.Request, groups []*fhidConfig.AuthGroup) ([]bool, string, error)
+}
+
+// authProvider is the package level Authenticator used by requiresAuth.
+var authProvider Authenticator = &gaudiAuthenticator{}
+
+// authCloser is an Authenticator with background work to stop once
+// it's been replaced.
+type authCloser interface {
+	Close()
+}
+
+// closeAuthProvider stops the background work of a and anything it
+// chains to.
+func closeAuthProvider(a Authenticator) {
+	switch a := a.(type) {
+	case *chainAuthenticator:
+		for _, l := range a.local {
+			closeAuthProvider(l)
+		}
+		closeAuthProvider(a.fallback)
+	case authCloser:
+		a.Close()
+	}
+}
+
+// SetupAuth builds the Authenticator selected in the config, loading
+// any key or password files it needs. The Authenticator it replaces is
+// closed.
+func SetupAuth() (err error) {
+	defer closeAuthProvider(authProvider)
+	a := fhidConfig.Config.Authentication
+	switch a.Provider {
+	case "", fhidConfig.ProviderGaudi:
+		authProvider = &gaudiAuthenticator{}
+	case fhidConfig.ProviderAPIKeys:
+		if a.APIKeys == nil {
+			return fmt.Errorf("No APIKeys settings for provider '%s'", a.Provider)
+		}
+		authProvider, err = newAPIKeyAuthenticator(a.APIKeys.File)
+	case fhidConfig.ProviderHtpasswd:
+		if a.Htpasswd == nil {
+			return fmt.Errorf("No Htpasswd settings for provider '%s'", a.Provider)
+		}
+		authProvider, err = newHtpasswdAuthenticator(a.Htpasswd.File)
+	case fhidConfig.ProviderJWT:
+		if a.JWT == nil {
+			return fmt.Errorf("No JWT settings for provider '%s'", a.Provider)
+		}
+		authProvider, err = newJWTAuthenticator(a.JWT)
+	case fhidConfig.ProviderClientCert:
+		if !fhidConfig.Config.ClientCertsEnabled() {
+			return fmt.Errorf("Provider '%s' needs TLS with a ClientCAFile", a.Provider)
+		}
+		authProvider = &clientCertAuthenticator{}
+	default:
+		return fmt.Errorf("Unknown authentication provider '%s'", a.Provider)
+	}
+	if err != nil {
+		return err
+	}
+	// bearer tokens and client certificates can be validated locally
+	// alongside any of the other providers
+	chain := &chainAuthenticator{fallback: authProvider}
+	if a.JWT != nil && authProvider.Name() != fhidConfig.ProviderJWT {
+		jwt, err := newJWTAuthenticator(a.JWT)
+		if err != nil {
+			return err
+		}
+		chain.local = append(chain.local, jwt)
+		fhidLogger.Loggo.Info("Validating bearer tokens locally")
+	}
+	if fhidConfig.Config.ClientCertsEnabled() && authProvider.Name() != fhidConfig.ProviderClientCert {
+		chain.local = append(chain.local, &clientCertAuthenticator{})
+		fhidLogger.Loggo.Info("Validating client certificates")
+	}
+	if len(chain.local) > 0 {
+		authProvider = chain
+	}
+	fhidLogger.Loggo.Info("Set up authentication provider", "Provider", authProvider.Name())
+	return err
+}
+
+// gaudiAuthenticator asks the Gaudi validmember endpoint about each
+// group using the token in AuthHeaderKey.
+type gaudiAuthenticator struct{}
+
+func (g *gaudiAuthenticator) Name() string {
+	return fhidConfig.ProviderGaudi
+}
+
+func (g *gaudiAuthenticator) Memberships(r *http.Request, groups []*fhidConfig.AuthGroup) ([]bool, string, error) {
+	authKey := r.Header.Get(fhidConfig.Config.Authentication.AuthHeaderKey)
+	return checkMemberships(authKey, groups)
+}
+
+// localAuthenticator is an Authenticator that can tell whether a
+// request carries the kind of credentials it checks.
+type localAuthenticator interface {
+	Authenticator
+	hasCredentials(r *http.Request) bool
+}
+
+// chainAuthenticator hands a request to the first local authenticator
+// whose credentials it carries and everything else to the fallback.
+type chainAuthenticator struct {
+	local    []localAuthenticator
+	fallback Authenticator
+}
+
+func (c *chainAuthenticator) Name() string {
+	return c.fallback.Name()
+}
+
+func (c *chainAuthenticator) Memberships(r *http.Request, groups []*fhidConfig.AuthGroup) ([]bool, string, error) {
+	return c.handler(r).Memberships(r, groups)
+}
+
+// handler picks the authenticator that handles r.
+func (c *chainAuthenticator) handler(r *http.Request) Authenticator {
+	for _, a := range c.local {
+		if a.hasCredentials(r) {
+			return a
+		}
+	}
+	return c.fallback
+}
+
+// methodFor returns the name of the provider that authenticates r.
+func methodFor(a Authenticator, r *http.Request) string {
+	if c, ok := a.(*chainAuthenticator); ok {
+		return c.handler(r).Name()
+	}
+	return a.Name()
+}
+
+// identity is a caller that's been authenticated locally by one of the
+// non Gaudi providers.
+type identity struct {
+	// Prefix is the fhidConfig Member prefix of the provider that
+	// authenticated the identity.
+	Prefix string
+	Name   string
+	// Aliases are other names the identity can be listed under
+	// in a group's Members, such as certificate SANs.
+	Aliases []string
+	Groups  []string
+}
+
+// memberships maps an identity onto the groups. The identity is a member
+// of a group if the group's ID is one of its groups or the identity is
+// listed in the group's Members qualified with its Prefix. The
+// identity's name is returned as the user ID.
+func (id *identity) memberships(groups []*fhidConfig.AuthGroup) ([]bool, string, error) {
+	members := make([]bool, len(groups))
+	for i, group := range groups {
+		for _, g := range id.Groups {
+			if g == group.GroupID {
+				members[i] = true
+			}
+		}
+		for _, m := range group.Members {
+			if m == id.Prefix+id.Name {
+				members[i] = true
+			}
+			for _, alias := range id.Aliases {
+				if m == id.Prefix+alias {
+					members[i] = true
+				}
+			}
+		}
+	}
+	return members, id.Name, nil
+}
@@ -0,0 +1,465 @@
+package fhid
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// setupProvider points the config at a provider and loads it. The write
+// group is g01236390 and the read only group is g00919618.
+func setupProvider(t *testing.T, provider string, configure func(a *fhidConfig.Authentication)) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	a := fhidConfig.Config.Authentication
+	a.AuthEnabled = true
+	a.Provider = provider
+	configure(a)
+	err = SetupAuth()
+	if err != nil {
+		t.Fatalf("Error setting up %s provider: %s", provider, err)
+	}
+}
+
+// writeTempFile writes content to a temp file and returns its name.
+func writeTempFile(t *testing.T, content []byte) string {
+	f, err := ioutil.TempFile("", "fhid_auth_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Write(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// postWith posts a good image after letting decorate add credentials
+// and returns the status code.
+func postWith(t *testing.T, decorate func(req *http.Request)) int {
+	req, err := http.NewRequest("POST", "/images", bytes.NewBufferString(imageGood))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decorate(req)
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestAuthProviderAPIKeys(t *testing.T) {
+	writer := sha256.Sum256([]byte("writer-key"))
+	reader := sha256.Sum256([]byte("reader-key"))
+	keys := fmt.Sprintf(`[
+		{"Name": "ci-bot", "KeyHash": "%s", "Groups": ["g01236390"]},
+		{"Name": "dashboard", "KeyHash": "%s"}
+	]`, hex.EncodeToString(writer[:]), hex.EncodeToString(reader[:]))
+	filename := writeTempFile(t, []byte(keys))
+	defer os.Remove(filename)
+	setupProvider(t, fhidConfig.ProviderAPIKeys, func(a *fhidConfig.Authentication) {
+		a.APIKeys = &fhidConfig.APIKeysProvider{File: filename}
+		a.AuthorizedGroups[1].Members = []string{"apikey:dashboard"}
+	})
+	withKey := func(key string) func(req *http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set(fhidConfig.Config.Authentication.AuthHeaderKey, key)
+		}
+	}
+	if code := postWith(t, withKey("writer-key")); code != http.StatusOK {
+		t.Errorf("writer key: got status %d want %d", code, http.StatusOK)
+	}
+	if code := postWith(t, withKey("reader-key")); code != http.StatusForbidden {
+		t.Errorf("reader key: got status %d want %d", code, http.StatusForbidden)
+	}
+	if code := postWith(t, withKey("bogus")); code != http.StatusUnauthorized {
+		t.Errorf("unknown key: got status %d want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthProviderHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := writeTempFile(t, []byte("# builders\nbuilder:"+string(hash)+"\n"))
+	defer os.Remove(filename)
+	setupProvider(t, fhidConfig.ProviderHtpasswd, func(a *fhidConfig.Authentication) {
+		a.Htpasswd = &fhidConfig.HtpasswdProvider{File: filename}
+		a.AuthorizedGroups[0].Members = []string{"htpasswd:builder"}
+	})
+	if code := postWith(t, func(req *http.Request) { req.SetBasicAuth("builder", "s3cret") }); code != http.StatusOK {
+		t.Errorf("good password: got status %d want %d", code, http.StatusOK)
+	}
+	if code := postWith(t, func(req *http.Request) { req.SetBasicAuth("builder", "wrong") }); code != http.StatusUnauthorized {
+		t.Errorf("bad password: got status %d want %d", code, http.StatusUnauthorized)
+	}
+}
+
+// TestMembersQualifiedByProvider makes sure a member listed for one
+// provider doesn't match the same name authenticated by another.
+func TestMembersQualifiedByProvider(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwords := writeTempFile(t, []byte("builder:"+string(hash)+"\n"))
+	defer os.Remove(passwords)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := writeJWKS(t, key, "test-key")
+	defer os.Remove(jwks)
+	setupProvider(t, fhidConfig.ProviderHtpasswd, func(a *fhidConfig.Authentication) {
+		a.Htpasswd = &fhidConfig.HtpasswdProvider{File: passwords}
+		a.JWT = &fhidConfig.JWTProvider{JWKSFile: jwks}
+		a.AuthorizedGroups[0].Members = []string{"htpasswd:builder"}
+	})
+	if code := postWith(t, func(req *http.Request) { req.SetBasicAuth("builder", "s3cret") }); code != http.StatusOK {
+		t.Errorf("htpasswd builder: got status %d want %d", code, http.StatusOK)
+	}
+	token := signJWT(t, key, "test-key", map[string]interface{}{
+		"sub": "builder",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if code := postWith(t, func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }); code != http.StatusForbidden {
+		t.Errorf("JWT subject builder: got status %d want %d", code, http.StatusForbidden)
+	}
+}
+
+// signJWT builds an RS256 token for claims.
+func signJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid}) + "." + enc(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// writeJWKS writes the public half of key to a JWKS file.
+func writeJWKS(t *testing.T, key *rsa.PrivateKey, kid string) string {
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	}
+	b, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTempFile(t, b)
+}
+
+func TestAuthProviderJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := writeJWKS(t, key, "test-key")
+	defer os.Remove(filename)
+	setupProvider(t, fhidConfig.ProviderJWT, func(a *fhidConfig.Authentication) {
+		a.JWT = &fhidConfig.JWTProvider{JWKSFile: filename, Issuer: "https://idp.me.com", Audience: "fhid"}
+	})
+	claims := func(mod func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":    "builder",
+			"iss":    "https://idp.me.com",
+			"aud":    []string{"fhid", "other"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"g01236390"},
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+	bearer := func(token string) func(req *http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	if code := postWith(t, bearer(signJWT(t, key, "test-key", claims(nil)))); code != http.StatusOK {
+		t.Errorf("good token: got status %d want %d", code, http.StatusOK)
+	}
+	expired := claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() })
+	if code := postWith(t, bearer(signJWT(t, key, "test-key", expired))); code != http.StatusUnauthorized {
+		t.Errorf("expired token: got status %d want %d", code, http.StatusUnauthorized)
+	}
+	wrongAud := claims(func(c map[string]interface{}) { c["aud"] = "someone-else" })
+	if code := postWith(t, bearer(signJWT(t, key, "test-key", wrongAud))); code != http.StatusUnauthorized {
+		t.Errorf("wrong audience: got status %d want %d", code, http.StatusUnauthorized)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := postWith(t, bearer(signJWT(t, other, "test-key", claims(nil)))); code != http.StatusUnauthorized {
+		t.Errorf("forged token: got status %d want %d", code, http.StatusUnauthorized)
+	}
+}
+
+// signES256 builds an ES256 token with no key ID for claims.
+func signES256(t *testing.T, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": "ES256", "typ": "JWT"}) + "." + enc(claims)
+	sum := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// TestJWTAlgCurve makes sure an ES alg is only verified with a key on
+// its own curve and with its own hash.
+func TestJWTAlgCurve(t *testing.T) {
+	sign := func(key *ecdsa.PrivateKey, digest []byte) []byte {
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[size-len(rb):size], rb)
+		copy(sig[2*size-len(sb):], sb)
+		return sig
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum384 := sha512.Sum384([]byte("signed"))
+	sig := sign(p384, sum384[:])
+	if !verifyJWTSignature("ES384", &p384.PublicKey, crypto.SHA384, sum384[:], sig) {
+		t.Error("ES384 with a P-384 key didn't verify")
+	}
+	if verifyJWTSignature("ES512", &p384.PublicKey, crypto.SHA384, sum384[:], sig) {
+		t.Error("ES512 verified with a P-384 key")
+	}
+	if verifyJWTSignature("ES384", &p384.PublicKey, crypto.SHA256, sum384[:], sig) {
+		t.Error("ES384 verified with a SHA-256 hash")
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a P-256 signature over a truncated SHA-384 digest
+	sig = sign(p256, sum384[:])
+	if verifyJWTSignature("ES384", &p256.PublicKey, crypto.SHA384, sum384[:], sig) {
+		t.Error("ES384 verified with a P-256 key")
+	}
+}
+
+// TestJWTClaimMapping validates tokens signed by a PEM key alongside the
+// Gaudi provider, checks nbf with clock skew and maps a custom groups
+// claim onto GroupIDs.
+func TestJWTClaimMapping(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := writeTempFile(t, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	defer os.Remove(filename)
+	setupProvider(t, fhidConfig.ProviderGaudi, func(a *fhidConfig.Authentication) {
+		a.JWT = &fhidConfig.JWTProvider{
+			PublicKeyFiles: []string{filename},
+			Issuer:         "https://idp.me.com",
+			ClockSkew:      30,
+			GroupsClaim:    "roles",
+			GroupMap:       map[string]string{"image-builders": "g01236390"},
+		}
+	})
+	now := time.Now()
+	claims := func(mod func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":   "builder",
+			"iss":   "https://idp.me.com",
+			"exp":   now.Add(time.Hour).Unix(),
+			"nbf":   now.Add(10 * time.Second).Unix(),
+			"roles": "image-builders",
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+	bearer := func(token string) func(req *http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	// Gaudi isn't mocked so these only pass if validated locally
+	if code := postWith(t, bearer(signES256(t, key, claims(nil)))); code != http.StatusOK {
+		t.Errorf("mapped group within skew: got status %d want %d", code, http.StatusOK)
+	}
+	notYet := claims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() })
+	if code := postWith(t, bearer(signES256(t, key, notYet))); code != http.StatusUnauthorized {
+		t.Errorf("token not valid yet: got status %d want %d", code, http.StatusUnauthorized)
+	}
+	unmapped := claims(func(c map[string]interface{}) { c["roles"] = []string{"readers"} })
+	if code := postWith(t, bearer(signES256(t, key, unmapped))); code != http.StatusForbidden {
+		t.Errorf("unmapped group: got status %d want %d", code, http.StatusForbidden)
+	}
+	wrongIss := claims(func(c map[string]interface{}) { c["iss"] = "https://evil.me.com" })
+	if code := postWith(t, bearer(signES256(t, key, wrongIss))); code != http.StatusUnauthorized {
+		t.Errorf("wrong issuer: got status %d want %d", code, http.StatusUnauthorized)
+	}
+}
+
+// TestJWTJWKSURL makes sure keys can be loaded from a JWKS URL at
+// startup.
+func TestJWTJWKSURL(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := writeJWKS(t, key, "url-key")
+	defer os.Remove(filename)
+	jwks, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(jwks)
+	}))
+	defer srv.Close()
+	setupProvider(t, fhidConfig.ProviderJWT, func(a *fhidConfig.Authentication) {
+		a.JWT = &fhidConfig.JWTProvider{JWKSURL: srv.URL}
+	})
+	token := signJWT(t, key, "url-key", map[string]interface{}{
+		"sub":    "builder",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"groups": []string{"g01236390"},
+	})
+	for i := 0; i < 2; i++ {
+		code := postWith(t, func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) })
+		if code != http.StatusOK {
+			t.Errorf("token signed by JWKS URL key: got status %d want %d", code, http.StatusOK)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("JWKS should only be fetched at startup: got %d fetches", fetches)
+	}
+}
+
+// TestJWTJWKSTimeout makes sure a JWKS URL that never answers fails
+// startup rather than hanging it.
+func TestJWTJWKSTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+	start := time.Now()
+	_, err := newJWTAuthenticator(&fhidConfig.JWTProvider{JWKSURL: srv.URL, JWKSTimeout: 1})
+	if err == nil {
+		t.Error("expected an error from a JWKS URL that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("gave up after %s, want about 1s", elapsed)
+	}
+}
+
+// TestJWTJWKSRefreshStops makes sure the refresh goroutine stops when
+// the authenticator is replaced.
+func TestJWTJWKSRefreshStops(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := writeJWKS(t, key, "url-key")
+	defer os.Remove(filename)
+	jwks, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write(jwks)
+	}))
+	defer srv.Close()
+	setupProvider(t, fhidConfig.ProviderJWT, func(a *fhidConfig.Authentication) {
+		a.JWT = &fhidConfig.JWTProvider{JWKSURL: srv.URL}
+	})
+	j := authProvider.(*jwtAuthenticator)
+	go j.refreshJWKS(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&fetches) < 2 {
+		t.Fatal("JWKS wasn't refreshed")
+	}
+
+	setupProvider(t, fhidConfig.ProviderGaudi, func(a *fhidConfig.Authentication) {
+		a.JWT = nil
+	})
+	// let a fetch already under way finish
+	time.Sleep(20 * time.Millisecond)
+	stopped := atomic.LoadInt32(&fetches)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&fetches); got != stopped {
+		t.Errorf("JWKS still refreshed after the provider was replaced: %d more fetches", got-stopped)
+	}
+}
@@ -0,0 +1,135 @@
+package fhid
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// apiKey is an entry in the API keys file. Only the SHA-256 hash of
+// the key is stored.
+type apiKey struct {
+	Name    string
+	KeyHash string
+	Groups  []string
+}
+
+// apiKeyAuthenticator checks the AuthHeaderKey header against a file
+// of static API keys.
+type apiKeyAuthenticator struct {
+	keys map[string]*apiKey
+}
+
+func newAPIKeyAuthenticator(filename string) (*apiKeyAuthenticator, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*apiKey
+	err = json.Unmarshal(b, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing API keys file '%s': %s", filename, err)
+	}
+	a := &apiKeyAuthenticator{keys: make(map[string]*apiKey)}
+	for _, k := range keys {
+		a.keys[strings.ToLower(k.KeyHash)] = k
+	}
+	fhidLogger.Loggo.Info("Loaded API keys", "File", filename, "Count", len(a.keys))
+	return a, nil
+}
+
+func (a *apiKeyAuthenticator) Name() string {
+	return fhidConfig.ProviderAPIKeys
+}
+
+func (a *apiKeyAuthenticator) Memberships(r *http.Request, groups []*fhidConfig.AuthGroup) ([]bool, string, error) {
+	key := r.Header.Get(fhidConfig.Config.Authentication.AuthHeaderKey)
+	if key == "" {
+		return make([]bool, len(groups)), "", nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	k, ok := a.keys[hex.EncodeToString(sum[:])]
+	if !ok {
+		fhidLogger.Loggo.Info("Unknown API key", "Key", redacter(key))
+		return make([]bool, len(groups)), "", nil
+	}
+	id := &identity{Prefix: fhidConfig.MemberAPIKey, Name: k.Name, Groups: k.Groups}
+	return id.memberships(groups)
+}
+
+// htpasswdAuthenticator checks HTTP Basic credentials against an
+// htpasswd file. bcrypt and {SHA} hashes are supported.
+type htpasswdAuthenticator struct {
+	users map[string]string
+}
+
+func newHtpasswdAuthenticator(filename string) (*htpasswdAuthenticator, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := &htpasswdAuthenticator{users: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Malformed line in htpasswd file '%s'", filename)
+		}
+		h.users[parts[0]] = parts[1]
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	fhidLogger.Loggo.Info("Loaded htpasswd users", "File", filename, "Count", len(h.users))
+	return h, nil
+}
+
+func (h *htpasswdAuthenticator) Name() string {
+	return fhidConfig.ProviderHtpasswd
+}
+
+func (h *htpasswdAuthenticator) Memberships(r *http.Request, groups []*fhidConfig.AuthGroup) ([]bool, string, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok || !h.check(user, pass) {
+		return make([]bool, len(groups)), "", nil
+	}
+	id := &identity{Prefix: fhidConfig.MemberHtpasswd, Name: user}
+	return id.memberships(groups)
+}
+
+// check returns true if pass matches the stored hash for user.
+func (h *htpasswdAuthenticator) check(user, pass string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+	}
+	fhidLogger.Loggo.Error("Unsupported htpasswd hash, use bcrypt", "User", user)
+	return false
+}
@@ -0,0 +1,300 @@
+package fhid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+)
+
+// Batch modes, chosen with the Mode query parameter of the batch
+// endpoints. Transactional batches are written all or nothing, best
+// effort batches write every item that passes and report the rest.
+const (
+	batchTransactional = "transactional"
+	batchBestEffort    = "besteffort"
+)
+
+// batchResult is the outcome of one item of a batch.
+type batchResult struct {
+	Index   int
+	ImageID string `json:",omitempty"`
+	Status  int
+	Error   *apiError `json:",omitempty"`
+}
+
+// batchResults is the Data of a successful batch response.
+type batchResults struct {
+	Mode    string
+	Written int
+	Failed  int
+	Results []*batchResult
+}
+
+// batchRelease is one item of a batch release, the body of a release
+// PATCH along with the entry it's for.
+type batchRelease struct {
+	ImageID      string `validate:"required"`
+	ReleaseNotes *ReleaseNotes
+}
+
+// batch tracks the items of a batch request as they're checked, and
+// queues the writes of those that pass so they all go to Redis in one
+// round trip.
+type batch struct {
+	mode    string
+	results []*batchResult
+	txn     *redisTxn
+}
+
+// readBatch reads the mode and items of a batch request. If it returns
+// false a response has already been sent.
+func readBatch(w http.ResponseWriter, r *http.Request) (*batch, []json.RawMessage, bool) {
+	mode := r.URL.Query().Get("Mode")
+	if mode == "" {
+		mode = batchTransactional
+	}
+	if mode != batchTransactional && mode != batchBestEffort {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest,
+			fmt.Sprintf("Unknown Mode '%s', use '%s' or '%s'", mode, batchTransactional, batchBestEffort))
+		return nil, nil, false
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	var items []json.RawMessage
+	err := json.Unmarshal(body, &items)
+	if err != nil {
+		writeBadBody(w, r, &bodyError{err})
+		return nil, nil, false
+	}
+	if len(items) == 0 {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Batch has no items")
+		return nil, nil, false
+	}
+	if max := fhidConfig.Config.ValidationRules().MaxBatchItems; len(items) > max {
+		writeError(w, r, http.StatusRequestEntityTooLarge, errCodeTooLarge,
+			fmt.Sprintf("Batch has %d items, the limit is %d", len(items), max))
+		return nil, nil, false
+	}
+	b := &batch{mode: mode, txn: &redisTxn{}}
+	for n := range items {
+		b.results = append(b.results, &batchResult{Index: n})
+	}
+	return b, items, true
+}
+
+// fail records why an item won't be written.
+func (b *batch) fail(n, status int, e *apiError) {
+	b.results[n].Status = status
+	b.results[n].Error = e
+}
+
+// accept queues the write of an item.
+func (b *batch) accept(n int, key, value string) {
+	b.results[n].ImageID = key
+	b.results[n].Status = http.StatusOK
+	b.txn.addEntry(key, value, 0)
+}
+
+// commit writes the accepted items and sends the response. In
+// transactional mode nothing is written if any item failed, and the
+// error has the field errors of every failed item prefixed with its
+// index.
+func (b *batch) commit(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	var failed []*batchResult
+	for _, res := range b.results {
+		if res.Error != nil {
+			failed = append(failed, res)
+		}
+	}
+	if b.mode == batchTransactional && len(failed) > 0 {
+		first := failed[0]
+		e := &apiError{
+			Code: first.Error.Code,
+			Message: fmt.Sprintf("%d of %d items failed so nothing was written, item %d: %s",
+				len(failed), len(b.results), first.Index, first.Error.Message),
+		}
+		for _, res := range failed {
+			prefix := fmt.Sprintf("[%d]", res.Index)
+			if len(res.Error.Fields) == 0 {
+				e.Fields = append(e.Fields, &fieldError{Field: prefix, Message: res.Error.Message})
+			}
+			for _, f := range res.Error.Fields {
+				e.Fields = append(e.Fields, &fieldError{Field: prefix + "." + f.Field, Message: f.Message})
+			}
+		}
+		writeAPIError(w, r, first.Status, e)
+		return
+	}
+	err := b.txn.exec()
+	if err != nil {
+		if b.mode == batchTransactional {
+			writeError(w, r, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Error writing to database: %s", err))
+			return
+		}
+		for n, res := range b.results {
+			if res.Error == nil {
+				b.fail(n, http.StatusInternalServerError, &apiError{
+					Code:    errCodeInternal,
+					Message: fmt.Sprintf("Error writing to database: %s", err),
+				})
+				failed = append(failed, res)
+			}
+		}
+	}
+	log.Info("Wrote batch", "Mode", b.mode, "Items", len(b.results), "Failed", len(failed))
+	writeData(w, r, &batchResults{
+		Mode:    b.mode,
+		Written: len(b.results) - len(failed),
+		Failed:  len(failed),
+		Results: b.results,
+	})
+}
+
+// handlerCreateImages creates the entries in a batch, each checked the
+// same way as a single POST to /images. Batches aren't deduplicated,
+// neither by Idempotency-Key nor by natural key, so a key is refused
+// rather than ignored.
+func handlerCreateImages(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, rateClassWrite) {
+		return
+	}
+	if r.Header.Get(idempotencyHeader) != "" {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest,
+			fmt.Sprintf("%s isn't supported on batches, post entries one at a time to retry them safely", idempotencyHeader))
+		return
+	}
+	access, err := writeAccess(r, fhidConfig.EntitlementImageCreate)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	r = withPrincipal(r, access.principal)
+	if principalRateLimited(w, r, rateClassWrite) {
+		return
+	}
+	b, items, ok := readBatch(w, r)
+	if !ok {
+		return
+	}
+	var releaseAccess *tenantAccess
+	for n, item := range items {
+		var image buildEntry
+		err := decodeBody(item, &image)
+		if err == nil {
+			err = validateEntry(&image, "")
+		}
+		itemAccess := access
+		// release notes on a new entry release it, so they need their own entitlement
+		if err == nil && releaseNotesSet(image.ReleaseNotes) {
+			if releaseAccess == nil {
+				releaseAccess, err = writeAccess(r, fhidConfig.EntitlementImageRelease)
+				if err != nil {
+					writeAuthError(w, r, err)
+					return
+				}
+			}
+			itemAccess = access.intersect(releaseAccess)
+		}
+		var key string
+		var srep []byte
+		if err == nil {
+			key, srep, err = image.stamp(itemAccess)
+		}
+		if err != nil {
+			status, e := createError(&image, err)
+			b.fail(n, status, e)
+			continue
+		}
+		b.accept(n, key, string(srep))
+	}
+	b.commit(w, r)
+}
+
+// handlerReleaseImages replaces the release notes of the entries in a
+// batch. The entries are read in one round trip.
+func handlerReleaseImages(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, rateClassWrite) {
+		return
+	}
+	access, err := writeAccess(r, fhidConfig.EntitlementImageRelease)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	r = withPrincipal(r, access.principal)
+	if principalRateLimited(w, r, rateClassWrite) {
+		return
+	}
+	b, items, ok := readBatch(w, r)
+	if !ok {
+		return
+	}
+	releases := make([]*batchRelease, len(items))
+	var ids []string
+	seen := make(map[string]bool)
+	for n, item := range items {
+		var rel batchRelease
+		err := decodeBody(item, &rel)
+		if err == nil {
+			err = validateEntry(&rel, "")
+		}
+		if err == nil && seen[rel.ImageID] {
+			err = &validationError{[]*fieldError{{Field: "ImageID", Message: "appears more than once in the batch"}}}
+		}
+		b.results[n].ImageID = rel.ImageID
+		if err != nil {
+			status, e := requestError(err)
+			b.fail(n, status, e)
+			continue
+		}
+		seen[rel.ImageID] = true
+		releases[n] = &rel
+		ids = append(ids, rel.ImageID)
+	}
+	values, err := Rmget(ids)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Error reading from database: %s", err))
+		return
+	}
+	for n, rel := range releases {
+		if rel == nil {
+			continue
+		}
+		value := values[0]
+		values = values[1:]
+		notFound := &apiError{Code: errCodeNotFound, Message: fmt.Sprintf("Error locating record '%s'", rel.ImageID)}
+		if value == nil {
+			b.fail(n, http.StatusNotFound, notFound)
+			continue
+		}
+		var ie buildEntry
+		_, err = decodeEntry(value, &ie)
+		if err != nil {
+			b.fail(n, http.StatusInternalServerError, &apiError{
+				Code:    errCodeInternal,
+				Message: fmt.Sprintf("Error processing object retrieved from database: %s", err),
+			})
+			continue
+		}
+		// entries in other tenants look the same as missing ones
+		if !access.allows(ie.tenant()) {
+			b.fail(n, http.StatusNotFound, notFound)
+			continue
+		}
+		ie.ReleaseNotes = rel.ReleaseNotes
+		ie.UpdatedBy = access.principal.UserID
+		writedata, err := json.Marshal(&ie)
+		if err != nil {
+			status, e := requestError(err)
+			b.fail(n, status, e)
+			continue
+		}
+		b.accept(n, rel.ImageID, string(writedata))
+	}
+	b.commit(w, r)
+}
@@ -0,0 +1,168 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+)
+
+type batchResponse struct {
+	Success string
+	Data    batchResults
+}
+
+func sendBatch(t *testing.T, method, query, body string) (*httptest.ResponseRecorder, *batchResults) {
+	req, err := http.NewRequest(method, "/images:batch"+query, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	var resp batchResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("body isn't JSON: %s", rr.Body.String())
+	}
+	return rr, &resp.Data
+}
+
+// indexed returns the number of entries in the image index.
+func indexed(t *testing.T) int {
+	keys, err := Rmembers(fhidConfig.Config.RedisImageIndexSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(keys)
+}
+
+// TestBatchCreate makes sure transactional batches are written all or
+// nothing and best effort batches write the items that pass.
+func TestBatchCreate(t *testing.T) {
+	setupValidation(t)
+	before := indexed(t)
+
+	rr, res := sendBatch(t, "POST", "", "["+imageGood+","+imageGood2+","+imageWithReleaseNotes+"]")
+	if rr.Code != http.StatusOK || res.Written != 3 || res.Failed != 0 {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	if res.Mode != batchTransactional {
+		t.Errorf("got mode '%s', want the default of '%s'", res.Mode, batchTransactional)
+	}
+	for n, item := range res.Results {
+		if item.Index != n || item.Status != http.StatusOK {
+			t.Errorf("item %d: unexpected result %+v", n, item)
+		}
+		val, err := Rget(item.ImageID)
+		if err != nil {
+			t.Fatalf("item %d: %s", n, err)
+		}
+		var ie buildEntry
+		json.Unmarshal([]byte(val), &ie)
+		if ie.ImageID != item.ImageID || ie.CreateDate == "" {
+			t.Errorf("item %d: stored entry wasn't stamped: %s", n, val)
+		}
+	}
+	if got := indexed(t); got != before+3 {
+		t.Errorf("got %d indexed entries, want %d", got, before+3)
+	}
+
+	before = indexed(t)
+	rr, _ = sendBatch(t, "POST", "?Mode=transactional", "["+imageGood+`,{"Version":"1"},`+imageGood2+`,{"BaseOS":"x"}]`)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := strings.Join(fieldsOf(t, rr), ","); got != "[1].BaseOS,[3].Version" {
+		t.Errorf("got field errors for %s", got)
+	}
+	if got := indexed(t); got != before {
+		t.Errorf("failed transactional batch wrote %d entries", got-before)
+	}
+
+	rr, res = sendBatch(t, "POST", "?Mode=besteffort", "["+imageGood+`,{"Version":"1"},`+imageGood2+"]")
+	if rr.Code != http.StatusOK || res.Written != 2 || res.Failed != 1 {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	if bad := res.Results[1]; bad.Status != http.StatusBadRequest || bad.Error == nil || bad.ImageID != "" {
+		t.Errorf("unexpected result for the bad item %+v", bad)
+	}
+	if got := indexed(t); got != before+2 {
+		t.Errorf("got %d new indexed entries, want 2", got-before)
+	}
+}
+
+// TestBatchRelease makes sure release notes are replaced in bulk and
+// missing entries are reported.
+func TestBatchRelease(t *testing.T) {
+	setupValidation(t)
+	_, res := sendBatch(t, "POST", "", "["+imageGood+","+imageGood2+"]")
+	if res.Written != 2 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	a, b := res.Results[0].ImageID, res.Results[1].ImageID
+	release := func(id, note string) string {
+		return `{"ImageID":"` + id + `","ReleaseNotes":{"ReleaseNote":"` + note + `"}}`
+	}
+	note := func(id string) string {
+		val, err := Rget(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ie buildEntry
+		json.Unmarshal([]byte(val), &ie)
+		if ie.ReleaseNotes == nil {
+			return ""
+		}
+		return ie.ReleaseNotes.ReleaseNote
+	}
+
+	rr, _ := sendBatch(t, "PATCH", "", "["+release(a, "first")+","+release("nope", "first")+"]")
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	if note(a) != "" {
+		t.Error("failed transactional batch released an entry")
+	}
+
+	rr, res = sendBatch(t, "PATCH", "?Mode=besteffort", "["+release(a, "GA")+","+release("nope", "GA")+","+release(b, "GA")+"]")
+	if rr.Code != http.StatusOK || res.Written != 2 || res.Results[1].Status != http.StatusNotFound {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	if note(a) != "GA" || note(b) != "GA" {
+		t.Errorf("got release notes '%s' and '%s', want GA", note(a), note(b))
+	}
+
+	rr, _ = sendBatch(t, "PATCH", "", "["+release(a, "1")+","+release(a, "2")+`,{"ReleaseNotes":{}}]`)
+	if got := strings.Join(fieldsOf(t, rr), ","); rr.Code != http.StatusBadRequest || got != "[1].ImageID,[2].ImageID" {
+		t.Errorf("got status %d and field errors for %s", rr.Code, got)
+	}
+}
+
+// TestBatchLimits makes sure malformed and oversized batches are
+// rejected before anything is checked.
+func TestBatchLimits(t *testing.T) {
+	setupValidation(t)
+	fhidConfig.Config.Validation = &fhidConfig.Validation{MaxBatchItems: 2}
+	defer func() { fhidConfig.Config.Validation = nil }()
+	cases := []struct {
+		name   string
+		query  string
+		body   string
+		status int
+	}{
+		{"unknown mode", "?Mode=yolo", "[" + imageGood + "]", http.StatusBadRequest},
+		{"not an array", "", imageGood, http.StatusBadRequest},
+		{"empty", "", "[]", http.StatusBadRequest},
+		{"too many items", "", "[" + imageGood + "," + imageGood + "," + imageGood + "]", http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		rr, _ := sendBatch(t, "POST", c.query, c.body)
+		if rr.Code != c.status {
+			t.Errorf("%s: got status %d, want %d: %s", c.name, rr.Code, c.status, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// Conflict policies for ImportEntries when an entry being imported
+// already exists in the datastore.
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictFail      = "fail"
+)
+
+// importProgressEvery is how many entries are processed between calls
+// to the import progress function.
+const importProgressEvery = 100
+
+// ImportOptions controls how ImportEntries treats the incoming entries.
+type ImportOptions struct {
+	// DryRun checks entries and conflicts without writing anything.
+	// Rather than stopping at the first problem it carries on and
+	// lists them all in ImportStats.Problems.
+	DryRun bool
+	// Validate also checks entries the same way as a POST. Off by
+	// default so catalogs exported from older versions, or holding
+	// entries written before a rule was added, still import.
+	Validate bool
+	// Conflict is one of ConflictSkip, ConflictOverwrite or ConflictFail.
+	Conflict string
+	// Progress, if set, is called periodically and once at the end
+	// with the running totals.
+	Progress func(stats *ImportStats)
+}
+
+// ImportStats holds running totals for an import. On a dry run Written
+// counts the entries that would have been written.
+type ImportStats struct {
+	Read        int
+	Written     int
+	Skipped     int
+	Overwritten int
+	// Problems lists every entry a dry run found that a real import
+	// would stop at.
+	Problems []string
+}
+
+// catalogLine is one line of an exported catalog, an entry along with
+// its score in the image index so import can restore the index order.
+// Catalogs of bare entries are still accepted and imported with a
+// score of 0.
+type catalogLine struct {
+	Score int
+	Entry json.RawMessage
+}
+
+// ExportEntries writes every indexed entry and its index score to w as
+// newline delimited JSON in index order and returns the number of
+// entries written.
+func ExportEntries(w io.Writer) (n int, err error) {
+	index := fhidConfig.Config.RedisImageIndexSet
+	keys, err := Rmembers(index)
+	if err != nil {
+		return n, err
+	}
+	for _, key := range keys {
+		val, err := Rget(key)
+		if err != nil {
+			fhidLogger.Loggo.Error("Error retrieving key for export, skipping.", "Key", key, "Error", err)
+			continue
+		}
+		score, err := redis.Int(Rconn.Do("ZSCORE", nsKey(index), key))
+		if err != nil {
+			fhidLogger.Loggo.Error("Error retrieving index score for export, skipping.", "Key", key, "Error", err)
+			continue
+		}
+		var entry bytes.Buffer
+		err = json.Compact(&entry, []byte(val))
+		if err != nil {
+			fhidLogger.Loggo.Error("Stored entry is not valid JSON, skipping.", "Key", key, "Error", err)
+			continue
+		}
+		line, err := json.Marshal(&catalogLine{Score: score, Entry: entry.Bytes()})
+		if err != nil {
+			return n, err
+		}
+		line = append(line, '\n')
+		_, err = w.Write(line)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	fhidLogger.Loggo.Info("Export complete", "Entries", n)
+	return n, err
+}
+
+// ImportEntries reads newline delimited JSON entries from r and writes
+// them to the datastore under their original ImageIDs and index scores.
+// Entries only have to decode and have a valid ImageID unless
+// opts.Validate is set. The import stops at the first problem,
+// including an existing entry with ConflictFail, and anything before it
+// has already been written. A dry run writes nothing and reports every
+// problem instead.
+func ImportEntries(r io.Reader, opts ImportOptions) (stats *ImportStats, err error) {
+	stats = &ImportStats{}
+	switch opts.Conflict {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+	default:
+		return stats, fmt.Errorf("Unknown conflict policy '%s'", opts.Conflict)
+	}
+	progress := func() {
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+	}
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		err = dec.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// the decoder can't carry on past broken JSON, even on
+			// a dry run
+			return stats, fmt.Errorf("Entry %d: %s", stats.Read+1, err)
+		}
+		stats.Read++
+		if stats.Read%importProgressEvery == 0 {
+			progress()
+		}
+		ie, score, err := importLine(raw, opts.Validate)
+		if err == nil {
+			var exists bool
+			exists, err = redis.Bool(Rconn.Do("EXISTS", nsKey(ie.ImageID)))
+			if err != nil {
+				return stats, err
+			}
+			if exists {
+				switch opts.Conflict {
+				case ConflictSkip:
+					stats.Skipped++
+					continue
+				case ConflictFail:
+					err = fmt.Errorf("ImageID '%s' already exists", ie.ImageID)
+				default:
+					stats.Overwritten++
+				}
+			}
+		}
+		if err != nil {
+			if !opts.DryRun {
+				return stats, fmt.Errorf("Entry %d: %s", stats.Read, err)
+			}
+			stats.Problems = append(stats.Problems, fmt.Sprintf("Entry %d: %s", stats.Read, err))
+			continue
+		}
+		if !opts.DryRun {
+			srep, err := json.MarshalIndent(ie, "", "    ")
+			if err != nil {
+				return stats, err
+			}
+			err = Rset(ie.ImageID, string(srep), score)
+			if err != nil {
+				return stats, err
+			}
+		}
+		stats.Written++
+	}
+	progress()
+	if stats.Read == 0 {
+		return stats, errors.New("No entries found to import")
+	}
+	if len(stats.Problems) > 0 {
+		return stats, fmt.Errorf("Found %d problems in %d entries", len(stats.Problems), stats.Read)
+	}
+	return stats, nil
+}
+
+// importLine decodes one line of a catalog and checks it can be
+// stored, and if validate is set that a POST would accept it.
+func importLine(raw json.RawMessage, validate bool) (ie *buildEntry, score int, err error) {
+	var line catalogLine
+	err = json.Unmarshal(raw, &line)
+	if err != nil {
+		return ie, score, err
+	}
+	if len(line.Entry) == 0 {
+		line.Entry = raw
+	}
+	ie = &buildEntry{}
+	_, err = decodeEntry(line.Entry, ie)
+	if err != nil {
+		return ie, score, err
+	}
+	if !entryKeyPattern.MatchString(ie.ImageID) {
+		return ie, score, fmt.Errorf("invalid ImageID '%s'", ie.ImageID)
+	}
+	if validate {
+		err = validateEntry(ie, "")
+	}
+	return ie, line.Score, err
+}
+
+// PurgeEntries deletes every stored entry along with the index set and
+// the idempotency records of the posts that created them, and returns
+// the number of entries deleted, or that would be on a dry run.
+// Only entry keys within the configured RedisNamespace are touched,
+// service accounts and anything else sharing the Redis instance are
+// left alone.
+func PurgeEntries(dryRun bool) (n int, err error) {
+	keys, err := scanKeys(nsKey("*"))
+	if err != nil {
+		return n, err
+	}
+	t := &redisTxn{}
+	for _, k := range keys {
+		name := strings.TrimPrefix(k, nsKey(""))
+		// retries of the posts that created them would return
+		// entries that no longer exist
+		if strings.HasPrefix(name, "idempotency:") {
+			t.add("DEL", txnKey(k))
+			continue
+		}
+		if !entryKeyPattern.MatchString(name) {
+			continue
+		}
+		t.add("DEL", txnKey(k))
+		n++
+	}
+	if dryRun {
+		fhidLogger.Loggo.Info("Purge dry run complete", "Entries", n)
+		return n, err
+	}
+	t.add("DEL", txnKey(nsKey(fhidConfig.Config.RedisImageIndexSet)))
+	err = t.exec()
+	if err != nil {
+		fhidLogger.Loggo.Error("Error purging entries", "Error", err)
+		return 0, err
+	}
+	fhidLogger.Loggo.Info("Purge complete", "Entries", n)
+	return n, err
+}
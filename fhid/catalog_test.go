@@ -0,0 +1,193 @@
+package fhid
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// TestExportImport makes sure an exported catalog can be imported into
+// an empty datastore and that conflict policies are honored.
+func TestExportImport(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	err = seedQueryData()
+	if err != nil {
+		t.Fatalf("Error seeding query data. '%s'", err)
+	}
+	var backup bytes.Buffer
+	n, err := ExportEntries(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 || strings.Count(backup.String(), "\n") != 4 {
+		t.Fatalf("Unexpected export: got %d entries\n%s", n, backup.String())
+	}
+
+	// importing over the top of the same data should conflict
+	_, err = ImportEntries(bytes.NewReader(backup.Bytes()), ImportOptions{Conflict: ConflictFail})
+	if err == nil {
+		t.Errorf("Expected import to fail on existing entries")
+	}
+	stats, err := ImportEntries(bytes.NewReader(backup.Bytes()), ImportOptions{Conflict: ConflictSkip})
+	if err != nil || stats.Skipped != 4 || stats.Written != 0 {
+		t.Errorf("Unexpected skip import: %+v, %v", stats, err)
+	}
+
+	// now load it into a fresh datastore
+	addr, err = runFakeRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = ImportEntries(bytes.NewReader(backup.Bytes()), ImportOptions{Conflict: ConflictFail, DryRun: true})
+	if err != nil || stats.Written != 4 {
+		t.Errorf("Unexpected dry run import: %+v, %v", stats, err)
+	}
+	if keys, _ := Rmembers("IMAGE_INDEX"); len(keys) != 0 {
+		t.Errorf("Dry run wrote %d entries", len(keys))
+	}
+	stats, err = ImportEntries(bytes.NewReader(backup.Bytes()), ImportOptions{Conflict: ConflictFail})
+	if err != nil || stats.Written != 4 {
+		t.Errorf("Unexpected import: %+v, %v", stats, err)
+	}
+	var restored bytes.Buffer
+	_, err = ExportEntries(&restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the index order comes back with the scores
+	if restored.String() != backup.String() {
+		t.Errorf("Restored catalog differs from backup:\n%s\n%s", restored.String(), backup.String())
+	}
+}
+
+// TestImportInvalid makes sure entries without a valid ImageID are
+// refused, and entries a POST would reject only are with Validate.
+func TestImportInvalid(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	_, err = ImportEntries(strings.NewReader(imageGood), ImportOptions{Conflict: ConflictFail})
+	if err == nil {
+		t.Errorf("Expected import of entry without ImageID to fail")
+	}
+	invalid := `{"Score":3,"Entry":{"ImageID":"e9373eb2-b17f-4344-a933-4db2d358c020","Version":"1"}}`
+	for _, dryRun := range []bool{true, false} {
+		_, err = ImportEntries(strings.NewReader(invalid), ImportOptions{Conflict: ConflictFail, DryRun: dryRun, Validate: true})
+		if err == nil {
+			t.Errorf("dry run %t: expected validated import of entry without BaseOS to fail", dryRun)
+		}
+	}
+	if keys, _ := Rmembers("IMAGE_INDEX"); len(keys) != 0 {
+		t.Errorf("Invalid import wrote %d entries", len(keys))
+	}
+	stats, err := ImportEntries(strings.NewReader(invalid), ImportOptions{Conflict: ConflictFail})
+	if err != nil || stats.Written != 1 {
+		t.Errorf("Unexpected unvalidated import of entry without BaseOS: %+v, %v", stats, err)
+	}
+
+	// catalogs of bare entries still import
+	bare := `{"ImageID":"0b5a3b0e-8a8f-4e0e-9c43-5d0f3bd7a1c2","Version":"1","BaseOS":"x"}`
+	stats, err = ImportEntries(strings.NewReader(bare), ImportOptions{Conflict: ConflictFail})
+	if err != nil || stats.Written != 1 {
+		t.Errorf("Unexpected import of bare entry: %+v, %v", stats, err)
+	}
+}
+
+// TestImportDryRunProblems makes sure a dry run reports every problem
+// rather than stopping at the first.
+func TestImportDryRunProblems(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	existing := `{"ImageID":"e9373eb2-b17f-4344-a933-4db2d358c020","Version":"1","BaseOS":"x"}`
+	_, err = ImportEntries(strings.NewReader(existing), ImportOptions{Conflict: ConflictFail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := strings.Join([]string{
+		existing,
+		`{"ImageID":"not-a-uuid","Version":"1","BaseOS":"x"}`,
+		`{"ImageID":"0b5a3b0e-8a8f-4e0e-9c43-5d0f3bd7a1c2","Version":"1","BaseOS":"x"}`,
+		existing,
+	}, "\n")
+	stats, err := ImportEntries(strings.NewReader(catalog), ImportOptions{Conflict: ConflictFail, DryRun: true})
+	if err == nil {
+		t.Errorf("Expected dry run with problems to fail")
+	}
+	if stats.Read != 4 || stats.Written != 1 || len(stats.Problems) != 3 {
+		t.Errorf("Unexpected dry run: %+v", stats)
+	}
+	if keys, _ := Rmembers("IMAGE_INDEX"); len(keys) != 1 {
+		t.Errorf("Dry run wrote entries, %d indexed", len(keys))
+	}
+}
+
+// TestPurge makes sure purging removes entries and the index but
+// leaves other keys alone.
+func TestPurge(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	err = seedQueryData()
+	if err != nil {
+		t.Fatalf("Error seeding query data. '%s'", err)
+	}
+	_, err = Rconn.Do("SET", nsKey("unrelated"), "keep me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := PurgeEntries(true)
+	if err != nil || n != 4 {
+		t.Errorf("Unexpected dry run purge: %d, %v", n, err)
+	}
+	if keys, _ := Rmembers("IMAGE_INDEX"); len(keys) != 4 {
+		t.Errorf("Dry run purged entries, %d left", len(keys))
+	}
+	n, err = PurgeEntries(false)
+	if err != nil || n != 4 {
+		t.Errorf("Unexpected purge: %d, %v", n, err)
+	}
+	if keys, _ := Rmembers("IMAGE_INDEX"); len(keys) != 0 {
+		t.Errorf("Purge left %d entries in the index", len(keys))
+	}
+	report, err := CheckConsistency(false)
+	if err != nil || !report.Consistent() {
+		t.Errorf("Purge left entries behind: %+v, %v", report, err)
+	}
+	if v, err := Rget("unrelated"); v != "keep me" {
+		t.Errorf("Purge removed an unrelated key: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package fhid
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// entryKeyPattern matches the keys that image entries are stored under.
+var entryKeyPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// ConsistencyReport holds the results of a datastore consistency check.
+type ConsistencyReport struct {
+	// OrphanedKeys are entries that exist but are missing from the
+	// index set so they're invisible to queries.
+	OrphanedKeys []string
+	// DanglingMembers are index set members with no matching entry.
+	DanglingMembers []string
+	// Fixed is true if the problems found were repaired.
+	Fixed bool
+}
+
+// Consistent returns true if no problems were found.
+func (c *ConsistencyReport) Consistent() bool {
+	return len(c.OrphanedKeys) == 0 && len(c.DanglingMembers) == 0
+}
+
+// CheckConsistency compares the stored entries against the index set
+// and reports any orphaned keys or dangling index members. If fix is
+// true orphaned keys are added back to the index and dangling members
+// are removed from it.
+func CheckConsistency(fix bool) (report *ConsistencyReport, err error) {
+	report = &ConsistencyReport{}
+	index := fhidConfig.Config.RedisImageIndexSet
+	keys, err := scanKeys(nsKey("*"))
+	if err != nil {
+		return report, err
+	}
+	members, err := Rmembers(index)
+	if err != nil {
+		return report, err
+	}
+	indexed := make(map[string]bool)
+	for _, m := range members {
+		indexed[m] = true
+	}
+	stored := make(map[string]bool)
+	for _, k := range keys {
+		k = strings.TrimPrefix(k, nsKey(""))
+		if !entryKeyPattern.MatchString(k) {
+			continue
+		}
+		stored[k] = true
+		if !indexed[k] {
+			report.OrphanedKeys = append(report.OrphanedKeys, k)
+		}
+	}
+	for _, m := range members {
+		if !stored[m] {
+			report.DanglingMembers = append(report.DanglingMembers, m)
+		}
+	}
+	fhidLogger.Loggo.Info("Consistency check complete",
+		"Entries", len(stored), "IndexMembers", len(members),
+		"OrphanedKeys", len(report.OrphanedKeys), "DanglingMembers", len(report.DanglingMembers))
+	if !fix || report.Consistent() {
+		return report, err
+	}
+	repaired, err := repairIndex(index, report.OrphanedKeys, report.DanglingMembers)
+	if err != nil {
+		fhidLogger.Loggo.Error("Error repairing datastore", "Error", err)
+		return report, err
+	}
+	report.Fixed = true
+	fhidLogger.Loggo.Info("Repaired datastore inconsistencies", "Repaired", repaired,
+		"Skipped", len(report.OrphanedKeys)+len(report.DanglingMembers)-repaired)
+	return report, err
+}
+
+// repairScript fixes the index set in KEYS[1] for the entry keys in
+// the rest of KEYS. ARGV holds a member and 'add' or 'rem' for each of
+// them. Every repair is checked again here since the scan isn't
+// atomic: members are only removed if their entry still doesn't exist
+// and only added, without changing an existing score, if it still
+// does. Returns how many repairs were made.
+var repairScript = redis.NewScript(-1, `
+local n = 0
+for j = 2, #KEYS do
+	local member = ARGV[j * 2 - 3]
+	local exists = redis.call('EXISTS', KEYS[j])
+	if ARGV[j * 2 - 2] == 'add' then
+		if exists == 1 then
+			n = n + redis.call('ZADD', KEYS[1], 'NX', 0, member)
+		end
+	elseif exists == 0 then
+		n = n + redis.call('ZREM', KEYS[1], member)
+	end
+end
+return n
+`)
+
+// repairIndex adds orphaned entries back to index and removes dangling
+// members from it, skipping any that were fixed by a write since they
+// were found.
+func repairIndex(index string, orphaned, dangling []string) (repaired int, err error) {
+	keys := []interface{}{nsKey(index)}
+	var args []interface{}
+	for _, k := range orphaned {
+		keys = append(keys, nsKey(k))
+		args = append(args, k, "add")
+	}
+	for _, m := range dangling {
+		keys = append(keys, nsKey(m))
+		args = append(args, m, "rem")
+	}
+	args = append(append([]interface{}{len(keys)}, keys...), args...)
+	repaired, err = redis.Int(repairScript.Do(Rconn.Conn, args...))
+	if err != nil {
+		return repaired, &txnError{err}
+	}
+	return repaired, nil
+}
+
+// scanKeys returns all keys matching pattern using SCAN so that large
+// databases don't block the server the way KEYS would.
+func scanKeys(pattern string) (keys []string, err error) {
+	cursor := 0
+	for {
+		values, err := redis.Values(Rconn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return keys, err
+		}
+		var batch []string
+		_, err = redis.Scan(values, &cursor, &batch)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, batch...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
@@ -10,8 +10,10 @@ import (
 	"time"
 
 	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidTypes"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/inconshreveable/log15"
 	uuid "github.com/satori/go.uuid"
 	"github.com/youtube/vitess/go/pools"
 	"golang.org/x/net/context"
@@ -32,79 +34,105 @@ func (r ResourceConn) Close() {
 	r.Conn.Close()
 }
 
-// AmiEntry just holds basic structure of an AMI ID
-// and an AMI region.
-type AmiEntry struct {
-	AmiID       string
-	AmiRegion   string
-	AmiSharedTo []string
-	AmiTags     []*Tags
-}
-
-// Tags is a struct for holding AMI tags
-type Tags struct {
-	Key   string
-	Value string
-}
-
-// BuildNotes holds specific structure for packer
-// aws builds
-type BuildNotes struct {
-	BuildLog   []string
-	OutputAmis []*AmiEntry
-	SourceAmi  string
-}
+// The API types live in fhidTypes so clients don't need this package.
+type (
+	AmiEntry          = fhidTypes.AmiEntry
+	Tags              = fhidTypes.Tags
+	BuildNotes        = fhidTypes.BuildNotes
+	ReleaseNotes      = fhidTypes.ReleaseNotes
+	ImageEntry        = fhidTypes.ImageEntry
+	ImageQueryResults = fhidTypes.ImageQueryResults
+)
 
-// ReleaseNotes holds specific structure for packer
-// aws builds
-type ReleaseNotes struct {
-	ReleaseNote string
-	Amis        []*AmiEntry
-	ReleaseDate string
+// releaseNotesSet returns true if the release notes carry any content.
+func releaseNotesSet(rn *ReleaseNotes) bool {
+	return rn != nil && (rn.ReleaseNote != "" || len(rn.Amis) > 0 || len(rn.Artifacts) > 0 || rn.ReleaseDate != "")
 }
 
 // buildEntry holds the structure of the image
 // entry to push and pull to the database.
-type buildEntry struct {
-	ImageID      string
-	Version      string
-	BaseOS       string
-	ReleaseNotes *ReleaseNotes
-	BuildNotes   *BuildNotes
-	CreateDate   string
-}
+// The validate tags are checked on posted entries, see validation.go.
+type buildEntry ImageEntry
 
-type ImageQueryResults struct {
-	Results []buildEntry
-}
+// errTenantForbidden is returned when a caller tries to write to a
+// tenant they aren't entitled in.
+var errTenantForbidden = errors.New("Not entitled to write to tenant")
 
 // ParseBodyWrite is the method to parse the body of the buildEntry object from
 // the web request.
-func (i *buildEntry) ParseBodyWrite(rbody []byte, score int) (key string, err error) {
-	fhidLogger.Loggo.Info("Processing image body request", "Body", string(rbody))
-	err = json.Unmarshal(rbody, i)
+func (i *buildEntry) ParseBodyWrite(rbody []byte, score int, access *tenantAccess) (key string, err error) {
+	err = i.parseBody(fhidLogger.Loggo, rbody)
+	if err != nil {
+		return "", err
+	}
+	return i.write(fhidLogger.Loggo, score, access)
+}
+
+// parseBody decodes and validates a posted entry, logging to the
+// request's logger.
+func (i *buildEntry) parseBody(logger log15.Logger, rbody []byte) error {
+	logger.Info("Processing image body request", "Body", string(rbody))
+	err := decodeBody(rbody, i)
+	if err != nil {
+		return err
+	}
+	return validateEntry(i, "")
+}
+
+// write stores a new entry that has already been validated, filling
+// in its tenant, ImageID and audit fields.
+func (i *buildEntry) write(logger log15.Logger, score int, access *tenantAccess) (key string, err error) {
+	key, srep, err := i.stamp(access)
 	if err != nil {
 		return "", err
 	}
+	err = rset(logger, key, string(srep), score)
+	return key, err
+}
+
+// stamp fills in the tenant, ImageID and audit fields of a new entry
+// and returns it serialized for storage.
+func (i *buildEntry) stamp(access *tenantAccess) (key string, srep []byte, err error) {
+	if i.Tenant == "" {
+		i.Tenant = access.defaultTenant()
+	}
+	if !access.allows(i.Tenant) {
+		return "", nil, errTenantForbidden
+	}
 	t := time.Now()
 	tstring := t.Format("2006-01-02 15:04:05")
 	key = getUUID()
 	i.ImageID = key
+	i.SchemaVersion = currentSchemaVersion
 	i.CreateDate = tstring
-	srep, err := json.MarshalIndent(i, "", "    ")
+	i.CreatedBy = access.principal.UserID
+	i.UpdatedBy = ""
+	srep, err = json.MarshalIndent(i, "", "    ")
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
+	return key, srep, nil
+}
 
-	err = Rset(key, string(srep), score)
-	return key, err
+// nsKey returns the name of a key within the configured namespace.
+func nsKey(name string) string {
+	if fhidConfig.Config.RedisNamespace == "" {
+		return name
+	}
+	return fhidConfig.Config.RedisNamespace + ":" + name
 }
 
 // Rget returns the value of keyname.
 func Rget(keyname string) (value string, err error) {
-	value, err = redis.String(Rconn.Do("GET", keyname))
+	return rget(fhidLogger.Loggo, keyname)
+}
+
+// rget is Rget logging to logger, handlers pass the request's logger
+// so the principal and request ID are on every line.
+func rget(logger log15.Logger, keyname string) (value string, err error) {
+	value, err = redis.String(Rconn.Do("GET", nsKey(keyname)))
 	if err == nil {
-		fhidLogger.Loggo.Debug("Retrieved entry successfully", "KeyName", keyname, "Value", value)
+		logger.Debug("Retrieved entry successfully", "KeyName", keyname, "Value", value)
 		return value, err
 	}
 	// see if we just got a nil response
@@ -112,35 +140,66 @@ func Rget(keyname string) (value string, err error) {
 		err = errors.New("NOT FOUND")
 		return "", err
 	}
-	fhidLogger.Loggo.Error("Error retrieving Redis data", "Error", err)
+	logger.Error("Error retrieving Redis data", "KeyName", keyname, "Error", err)
 	return "", err
 }
 
+// Rmget returns the values of keynames in a single round trip, nil for
+// any that don't exist.
+func Rmget(keynames []string) (values [][]byte, err error) {
+	if len(keynames) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(keynames))
+	for n, keyname := range keynames {
+		args[n] = nsKey(keyname)
+	}
+	return redis.ByteSlices(Rconn.Do("MGET", args...))
+}
+
 // Rmembers gets members of a set and returns the []string
 func Rmembers(setName string) (results []string, err error) {
-	n, err := redis.Strings(Rconn.Do("ZRANGE", setName, 0, -1))
+	n, err := redis.Strings(Rconn.Do("ZRANGE", nsKey(setName), 0, -1))
 	return n, err
 }
 
-// Rset sets the value of keyname to value.
+// Rset sets the value of keyname to value and adds keyname to the
+// image index set. Both writes go in one script call so no other
+// client sees one without the other, but there's no rollback: if Redis
+// rejects the ZADD the entry is left out of the index until
+// CheckConsistency repairs it.
 func Rset(keyname, value string, score int) error {
-	n, err := Rconn.Do("SET", keyname, value)
-	if err == nil {
-		fhidLogger.Loggo.Info("Wrote entry successfully", "KeyName", keyname, "Value", n)
-	} else {
-		fhidLogger.Loggo.Error("Error writing Redis data", "Error", Rconn.Err())
-		return err
-	}
-	n, err = Rconn.Do("ZADD", fhidConfig.Config.RedisImageIndexSet, score, keyname)
-	if err == nil {
-		fhidLogger.Loggo.Debug("Successfully wrote keyname to index", "KeyName", keyname, "Index", fhidConfig.Config.RedisImageIndexSet)
-	} else {
-		fhidLogger.Loggo.Error("Error writing index entry", "Error", Rconn.Err())
+	return rset(fhidLogger.Loggo, keyname, value, score)
+}
+
+// rset is Rset logging to logger, see rget.
+func rset(logger log15.Logger, keyname, value string, score int) error {
+	t := entryTxn(keyname, value, score)
+	err := t.exec()
+	if err != nil {
+		logger.Error("Error writing Redis data", "KeyName", keyname, "Error", err)
 		return err
 	}
+	logger.Info("Wrote entry successfully", "KeyName", keyname, "Index", fhidConfig.Config.RedisImageIndexSet)
 	return err
 }
 
+// entryTxn returns a transaction that writes the entry body and its
+// index set membership. Callers that maintain secondary indexes can add
+// their own commands before calling exec.
+func entryTxn(keyname, value string, score int) *redisTxn {
+	t := &redisTxn{}
+	t.addEntry(keyname, value, score)
+	return t
+}
+
+// addEntry queues the writes of an entry body and its index set
+// membership.
+func (t *redisTxn) addEntry(keyname, value string, score int) {
+	t.add("SET", txnKey(nsKey(keyname)), value)
+	t.add("ZADD", txnKey(nsKey(fhidConfig.Config.RedisImageIndexSet)), score, keyname)
+}
+
 func getUUID() string {
 	uid := uuid.Must(uuid.NewV4())
 	suid := fmt.Sprintf("%s", uid)
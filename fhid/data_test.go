@@ -0,0 +1,274 @@
+package fhid
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// TestRsetIndexes makes sure that a write puts the entry in both
+// the keyspace and the index set.
+func TestRsetIndexes(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	key := getUUID()
+	err = Rset(key, `{"Version":"1.0"}`, 0)
+	if err != nil {
+		t.Fatalf("Error writing entry: %s", err)
+	}
+	val, err := Rget(key)
+	if err != nil || val != `{"Version":"1.0"}` {
+		t.Errorf("Entry not written: got '%s', '%v'", val, err)
+	}
+	members, err := Rmembers(fhidConfig.Config.RedisImageIndexSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0] != key {
+		t.Errorf("Entry not indexed: got %v want [%s]", members, key)
+	}
+}
+
+// TestTxnErrors makes sure a failed write can be matched against
+// errTxnFailed and still carries the Redis error, and that commands
+// before the one that failed stay applied.
+func TestTxnErrors(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	// the index set is a string so the ZADD is rejected
+	_, err = Rconn.Do("SET", nsKey(fhidConfig.Config.RedisImageIndexSet), "not a set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := getUUID()
+	err = Rset(key, `{"Version":"1.0"}`, 0)
+	if !errors.Is(err, errTxnFailed) {
+		t.Fatalf("got %v, want errTxnFailed", err)
+	}
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) || !strings.Contains(err.Error(), "WRONGTYPE") {
+		t.Errorf("Redis error isn't wrapped: %v", err)
+	}
+	if val, _ := Rget(key); val == "" {
+		t.Error("expected the SET before the failed ZADD to stay applied")
+	}
+}
+
+// TestCheckConsistency makes sure orphaned keys and dangling index
+// members are detected and repaired.
+func TestCheckConsistency(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	good := getUUID()
+	orphan := getUUID()
+	dangling := getUUID()
+	if err = Rset(good, "{}", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Rconn.Do("SET", nsKey(orphan), "{}"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Rconn.Do("ZADD", nsKey(fhidConfig.Config.RedisImageIndexSet), 0, dangling); err != nil {
+		t.Fatal(err)
+	}
+	report, err := CheckConsistency(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.OrphanedKeys) != 1 || report.OrphanedKeys[0] != orphan {
+		t.Errorf("Unexpected orphaned keys: got %v want [%s]", report.OrphanedKeys, orphan)
+	}
+	if len(report.DanglingMembers) != 1 || report.DanglingMembers[0] != dangling {
+		t.Errorf("Unexpected dangling members: got %v want [%s]", report.DanglingMembers, dangling)
+	}
+	report, err = CheckConsistency(true)
+	if err != nil || !report.Fixed {
+		t.Fatalf("Expected repair to succeed: %v", err)
+	}
+	report, err = CheckConsistency(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent() {
+		t.Errorf("Datastore still inconsistent after repair: %+v", report)
+	}
+}
+
+// TestRepairIndexRechecks makes sure repairs that a write has made
+// stale since the scan are skipped.
+func TestRepairIndexRechecks(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	index := fhidConfig.Config.RedisImageIndexSet
+	// found dangling, then written before the repair
+	written := getUUID()
+	if err = Rset(written, "{}", 5); err != nil {
+		t.Fatal(err)
+	}
+	// found orphaned, then indexed with its own score
+	indexed := getUUID()
+	if err = Rset(indexed, "{}", 7); err != nil {
+		t.Fatal(err)
+	}
+	// found orphaned, then deleted
+	deleted := getUUID()
+	repaired, err := repairIndex(index, []string{indexed, deleted}, []string{written})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 0 {
+		t.Errorf("Stale repairs applied: got %d want 0", repaired)
+	}
+	for member, want := range map[string]int{written: 5, indexed: 7} {
+		score, err := redis.Int(Rconn.Do("ZSCORE", nsKey(index), member))
+		if err != nil || score != want {
+			t.Errorf("Score of %s changed: got %d want %d: %v", member, score, want, err)
+		}
+	}
+	if n, _ := redis.Int(Rconn.Do("ZCARD", nsKey(index))); n != 2 {
+		t.Errorf("Deleted entry added to the index: got %d members want 2", n)
+	}
+}
+
+// TestMigrateNamespace makes sure entries stored under bare keys are
+// moved into the namespace and stay queryable.
+func TestMigrateNamespace(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	bare := getUUID()
+	if _, err = Rconn.Do("SET", bare, `{"Version":"0.1"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Rconn.Do("ZADD", fhidConfig.Config.RedisImageIndexSet, 0, bare); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Rconn.Do("SET", "someone-elses-key", "x"); err != nil {
+		t.Fatal(err)
+	}
+	moved, skipped, err := MigrateNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 || skipped != 0 {
+		t.Errorf("Unexpected migration counts: moved %d skipped %d", moved, skipped)
+	}
+	if _, err = Rget(bare); err != nil {
+		t.Errorf("Migrated entry not found in namespace: %s", err)
+	}
+	members, err := Rmembers(fhidConfig.Config.RedisImageIndexSet)
+	if err != nil || len(members) != 1 || members[0] != bare {
+		t.Errorf("Migrated entry not in namespaced index: got %v, %v", members, err)
+	}
+	other, err := Rconn.Do("GET", "someone-elses-key")
+	if err != nil || other == nil {
+		t.Errorf("Migration touched a key outside of fhid: %v", err)
+	}
+}
+
+// TestSchemaMigration makes sure entries written before schema
+// versioning are migrated on read and by the bulk migration.
+func TestSchemaMigration(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	key := getUUID()
+	err = Rset(key, `{"ImageID":"`+key+`","Version":"0.9","BaseOS":"Ubuntu14.04"}`, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := Rget(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ie buildEntry
+	migrated, err := decodeEntry([]byte(val), &ie)
+	if err != nil || !migrated || ie.SchemaVersion != currentSchemaVersion || ie.Version != "0.9" {
+		t.Errorf("Entry not migrated on read: %+v, %v", ie, err)
+	}
+	n, err := MigrateSchema(true)
+	if err != nil || n != 1 {
+		t.Errorf("Dry run should find one entry to migrate: got %d, %v", n, err)
+	}
+	n, err = MigrateSchema(false)
+	if err != nil || n != 1 {
+		t.Errorf("Migration should rewrite one entry: got %d, %v", n, err)
+	}
+	n, err = MigrateSchema(false)
+	if err != nil || n != 0 {
+		t.Errorf("Migrated entry should not need migrating again: got %d, %v", n, err)
+	}
+	score, err := Rconn.Do("ZSCORE", nsKey(fhidConfig.Config.RedisImageIndexSet), key)
+	if err != nil || string(score.([]byte)) != "7" {
+		t.Errorf("Migration did not preserve index score: got %s, %v", score, err)
+	}
+
+	// a migration only replaces the entry it read
+	other := getUUID()
+	err = Rset(other, `{"Version":"0.9","BaseOS":"Ubuntu14.04"}`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := `{"SchemaVersion":1,"Version":"0.9","BaseOS":"Ubuntu14.04","ReleaseNotes":{"ReleaseNote":"GA"}}`
+	set, err := setIfUnchanged(nsKey(other), `{"Version":"0.9"}`, released)
+	if err != nil || set {
+		t.Errorf("replaced an entry that had changed: %v, %v", set, err)
+	}
+	set, err = setIfUnchanged(nsKey(other), `{"Version":"0.9","BaseOS":"Ubuntu14.04"}`, released)
+	if val, _ := Rget(other); err != nil || !set || val != released {
+		t.Errorf("didn't replace an unchanged entry: %v, %v, %s", set, err, val)
+	}
+	_, err = decodeEntry([]byte(`{"SchemaVersion": 999}`), &ie)
+	if err == nil {
+		t.Errorf("Expected entries from a newer schema to be rejected")
+	}
+}
@@ -6,14 +6,12 @@ import (
 	"regexp"
 
 	"github.com/GESkunkworks/fhid/fhidConfig"
-	fi "github.com/GESkunkworks/fhid/fhidLogger"
+	"github.com/GESkunkworks/fhid/fhidTypes"
+	"github.com/inconshreveable/log15"
 )
 
-type ImageQuerySub struct {
-	StringMatch string
-	Function    string
-	Value       string // e.g., 'latest' or '.*'
-}
+// ImageQuerySub is a search on one field of an entry.
+type ImageQuerySub = fhidTypes.ImageQuerySub
 
 func NewImageQuerySub() *ImageQuerySub {
 	iqs := ImageQuerySub{}
@@ -23,12 +21,8 @@ func NewImageQuerySub() *ImageQuerySub {
 	return &iqs
 }
 
-type ImageQuery struct {
-	Version      *ImageQuerySub
-	BaseOS       *ImageQuerySub
-	BuildNotes   *ImageQuerySub
-	ReleaseNotes *ImageQuerySub
-}
+// ImageQuery is the body of a query, see fhidTypes.ImageQuery.
+type ImageQuery fhidTypes.ImageQuery
 
 // NewImageQuery instantiates and returns a blank ImageQuery so that
 // unset fields can be queried assuming default values.
@@ -38,6 +32,7 @@ func NewImageQuery() ImageQuery {
 	iq.BaseOS = NewImageQuerySub()
 	iq.BuildNotes = NewImageQuerySub()
 	iq.ReleaseNotes = NewImageQuerySub()
+	iq.Artifact = NewImageQuerySub()
 	return iq
 }
 
@@ -52,73 +47,103 @@ func (iq *ImageQuery) Read(p []byte) (n int, err error) {
 
 func (iq *ImageQuery) ProcessBody(rbody []byte) error {
 	err := json.Unmarshal(rbody, &iq)
+	// fields sent as null are left empty rather than nil so search
+	// can treat them like fields that weren't sent
+	for _, sub := range []**ImageQuerySub{&iq.Version, &iq.BaseOS, &iq.BuildNotes, &iq.ReleaseNotes, &iq.Artifact} {
+		if *sub == nil {
+			*sub = NewImageQuerySub()
+		}
+	}
 	return err
 }
 
-// ImageQuery loops through the query properties and tries to detect
+// search loops through the query properties and tries to detect
 // which type of query search to run then executes and returns
 // true if the search matches the given buildEntry
-func (iq *ImageQuery) search(ie *buildEntry) (match bool, err error) {
+func (iq *ImageQuery) search(log log15.Logger, ie *buildEntry) (match bool, err error) {
 	switch {
 	case iq.Version.StringMatch != "":
-		fi.Loggo.Debug("Detected StringMatch on Version")
+		log.Debug("Detected StringMatch on Version")
 		match, err = iq.stringMatch(ie.Version, iq.Version.StringMatch)
 	case iq.BaseOS.StringMatch != "":
-		fi.Loggo.Debug("Detected StringMatch on BaseOS")
+		log.Debug("Detected StringMatch on BaseOS")
 		match, err = iq.stringMatch(ie.BaseOS, iq.BaseOS.StringMatch)
 	case iq.ReleaseNotes.StringMatch != "":
-		fi.Loggo.Debug("Detected StringMatch on ReleaseNotes")
+		log.Debug("Detected StringMatch on ReleaseNotes")
 		rnb, err := json.Marshal(ie.ReleaseNotes)
 		if err != nil {
 			return match, err
 		}
 		match, err = iq.stringMatch(string(rnb), iq.ReleaseNotes.StringMatch)
 	case iq.BuildNotes.StringMatch != "":
-		fi.Loggo.Debug("Detected StringMatch on BuildNotes")
+		log.Debug("Detected StringMatch on BuildNotes")
 		rnb, err := json.Marshal(ie.BuildNotes)
 		if err != nil {
 			return match, err
 		}
 		match, err = iq.stringMatch(string(rnb), iq.BuildNotes.StringMatch)
+	case iq.Artifact.StringMatch != "":
+		log.Debug("Detected StringMatch on Artifact")
+		match, err = iq.artifactMatch(ie, iq.Artifact.StringMatch)
 	default:
-		fi.Loggo.Info("No queries could be parsed.")
+		log.Info("No queries could be parsed.")
 	}
 	return match, err
 }
 
-func (iq *ImageQuery) execute() (sresults string, err error) {
-	var qresults []buildEntry
-	fi.Loggo.Info("Executing query...")
+func (iq *ImageQuery) execute(log log15.Logger, access *tenantAccess) (iqr *ImageQueryResults, err error) {
+	var qresults []ImageEntry
+	log.Info("Executing query...")
 	results, err := Rmembers(fhidConfig.Config.RedisImageIndexSet)
 	if err != nil {
-		fi.Loggo.Error("Error in getting index set", "Error", err)
-		return sresults, err
+		log.Error("Error in getting index set", "Error", err)
+		return iqr, err
 	}
-	fi.Loggo.Debug("Got set", "Set", fhidConfig.Config.RedisImageIndexSet, "Value", results)
+	log.Debug("Got set", "Set", fhidConfig.Config.RedisImageIndexSet, "Value", results)
 	for _, key := range results {
-		val, err := Rget(key)
+		val, err := rget(log, key)
 		if err != nil {
-			fi.Loggo.Error("Error retreiving key.", "Error", err, "Key", key)
+			log.Error("Error retreiving key.", "Error", err, "Key", key)
 		}
-		fi.Loggo.Debug("Got value", "Value", val)
+		log.Debug("Got value", "Value", val)
 		var ie buildEntry
-		err = json.Unmarshal([]byte(val), &ie)
+		_, err = decodeEntry([]byte(val), &ie)
 		if err != nil {
-			fi.Loggo.Error("Error unmarshaling retrieved value.", "Error", err)
+			log.Error("Error unmarshaling retrieved value.", "Error", err)
+		}
+		if !access.allows(ie.tenant()) {
+			continue
 		}
-		match, err := iq.search(&ie)
+		match, err := iq.search(log, &ie)
 		if err != nil {
-			fi.Loggo.Error("Error search val for match", "Error", err)
+			log.Error("Error search val for match", "Error", err)
 		}
 		if match == true {
-			qresults = append(qresults, ie)
+			qresults = append(qresults, ImageEntry(ie))
+		}
+	}
+	log.Info("Query returned no errors.", "NumberOfResults", len(qresults))
+	return &ImageQueryResults{Results: qresults}, nil
+}
+
+// artifactMatch returns true if any identifier of any of the entry's
+// artifacts matches reg.
+func (iq *ImageQuery) artifactMatch(ie *buildEntry, reg string) (bool, error) {
+	re, err := regexp.Compile(reg)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range ie.artifacts() {
+		if a == nil {
+			continue
+		}
+		for _, id := range artifactIDs(a) {
+			if re.MatchString(id) {
+				return true, nil
+			}
 		}
 	}
-	fi.Loggo.Info("Query returned no errors.", "NumberOfResults", len(qresults))
-	var iqr ImageQueryResults
-	iqr.Results = qresults
-	bsresults, err := json.MarshalIndent(iqr, "", "    ")
-	return string(bsresults), err
+	return false, nil
 }
 
 func (iq *ImageQuery) stringMatch(value, reg string) (bool, error) {
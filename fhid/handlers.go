@@ -3,280 +3,468 @@ package fhid
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strconv"
 
-	"github.com/GESkunkworks/fhid/fhidLogger"
-
 	"github.com/GESkunkworks/fhid/fhidConfig"
 )
 
-// HandlerImagesQuery handles posted queries to search
+// Names of the read endpoints as used in
+// Authentication.EndpointReadAccess
+const (
+	endpointImages = fhidConfig.ReadEndpointImages
+	endpointQuery  = fhidConfig.ReadEndpointQuery
+)
+
+// imageID returns the ID of the image a request is for, taken from
+// the path or, for older clients, the ImageID query parameter.
+func imageID(r *http.Request) string {
+	if id := pathParam(r, "id"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("ImageID")
+}
+
+// handlerQueryImages handles posted queries to search
 // for images.
-func HandlerImagesQuery(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		http.Error(w, messageMethodNotAllowed(), http.StatusMethodNotAllowed)
-	case "POST":
-		// Removing auth checks for image query.
-		// TODO: Add support in config for the idea of anon read
-		/*
-			if fhidConfig.Config.Authentication.AuthEnabled {
-				// Begin check auth
-				needs := "read"
-				err := requiresAuth(r, needs)
-				if err != nil {
-					msg := fmt.Sprintf(`{"Error": "Error checking authorization: '%s'"}`, err)
-					http.Error(w, msg, http.StatusUnauthorized)
-					return
-				}
-				// End check auth
-			}
-		*/
-		fhidLogger.Loggo.Info("ImageQuery request")
-		fhidLogger.Loggo.Debug("ImageQuery Body captured", "Body", r.Body)
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			fhidLogger.Loggo.Crit("Error processing body", "Error", err)
-		} else {
-			query := NewImageQuery()
-			err = query.ProcessBody(body)
-			results, err := query.execute()
-			if err != nil {
-				http.Error(w, messageErrorHandlerQuery(err), http.StatusInternalServerError)
-			} else {
-				fmt.Fprintf(w, results)
-			}
-		}
+func handlerQueryImages(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, rateClassQuery) {
+		return
+	}
+	access, err := readAccess(r, endpointQuery)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	r = withPrincipal(r, access.principal)
+	if principalRateLimited(w, r, rateClassQuery) {
+		return
+	}
+	log := requestLog(r)
+	log.Info("ImageQuery request")
+	log.Debug("ImageQuery Body captured", "Body", r.Body)
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	query := NewImageQuery()
+	err = query.ProcessBody(body)
+	if err != nil {
+		writeBadBody(w, r, err)
+		return
+	}
+	results, err := query.execute(log, access)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeQueryFailed, fmt.Sprintf("Query failed: %s", err))
+		return
+	}
+	writeData(w, r, results)
+}
 
-	case "DELETE":
-		http.Error(w, messageMethodNotAllowed(), http.StatusMethodNotAllowed)
-	case "PUT":
-		http.Error(w, messageMethodNotAllowed(), http.StatusMethodNotAllowed)
-	default:
-		http.Error(w, messageMethodNotAllowed(), http.StatusMethodNotAllowed)
+// handlerGetImage returns a single image entry.
+func handlerGetImage(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, rateClassRead) {
+		return
 	}
+	access, err := readAccess(r, endpointImages)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	r = withPrincipal(r, access.principal)
+	if principalRateLimited(w, r, rateClassRead) {
+		return
+	}
+	log := requestLog(r)
+	log.Info("Request URL captured", "URL", r.URL)
+	id := imageID(r)
+	log.Debug("Parsed ImageID", "ImageID", id)
+	if id == "" {
+		writeMissingImageID(w, r)
+		return
+	}
+	ie, ok := loadImage(w, r, id, access)
+	if !ok {
+		return
+	}
+	log.Debug("Retrieved data successfully", "ImageID", id)
+	writeData(w, r, &ImageQueryResults{Results: []ImageEntry{ImageEntry(*ie)}})
 }
 
-// HandlerImages handles the post to the database
-func HandlerImages(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		// Removing auth checks for image read.
-		// TODO: Add support in config for the idea of anon read
-		/*
-			if fhidConfig.Config.Authentication.AuthEnabled {
-				// Begin check auth
-				needs := "read"
-				err := requiresAuth(r, needs)
-				if err != nil {
-					msg := fmt.Sprintf(`{"Error": "Error checking authorization: '%s'"}`, err)
-					http.Error(w, msg, http.StatusUnauthorized)
-					return
-				}
-				// End check auth
-			}
-		*/
-		fhidLogger.Loggo.Info("Request URL captured", "URL", r.URL)
-		u, err := url.Parse(r.URL.String())
-		q, err := url.ParseQuery(u.RawQuery)
-		if err != nil {
-			fhidLogger.Loggo.Error("Error processing URL", "Error", err)
-			http.Error(w, `{"Error": "Error processing URL"}`, http.StatusBadRequest)
-		}
-		fhidLogger.Loggo.Debug("Parsed URL query successfully", "Query", q)
-		key := "ImageID"
-		value, ok := q[key]
-		if !ok {
-			fhidLogger.Loggo.Info("Key not found in URL string", "Key", key)
-		}
-		fhidLogger.Loggo.Debug("Parsed ImageID", "ImageID", value)
-		if len(value) < 1 {
-			msg := fmt.Sprintf(`{"Error": "Key '%s' not found in URL string."}`, key)
-			http.Error(w, msg, http.StatusBadRequest)
-		} else {
-			data, err := Rget(value[0])
-			if err != nil {
-				if err.Error() == "NOT FOUND" {
-					msg := fmt.Sprintf(`{"Error": "Error locating record '%s': '%s'"}`, value, err)
-					http.Error(w, msg, http.StatusNotFound)
-					return
-				}
-				msg := fmt.Sprintf(`{"Error": "Error fullfilling request for '%s': '%s'"}`, value, err)
-				http.Error(w, msg, http.StatusBadRequest)
-				return
-			}
-			var iqr ImageQueryResults
-			var ie buildEntry
-			err = json.Unmarshal([]byte(data), &ie)
-			if err != nil {
-				msg := fmt.Sprintf(`{"Error": "Error processing object retrieved from database. %s}`, err)
-				http.Error(w, msg, http.StatusBadRequest)
-				return
-			}
-			iqr.Results = append(iqr.Results, ie)
-			rdata, err := json.MarshalIndent(&iqr, "", "    ")
-			if err != nil {
-				msg := fmt.Sprintf(`{"Error": "Error processing objects retrieved from database. %s}`, err)
-				http.Error(w, msg, http.StatusBadRequest)
-				return
-			}
-			fhidLogger.Loggo.Debug("Retrieved data successfully", "Data", string(rdata))
-			fmt.Fprintf(w, string(rdata))
-		}
+// writeMissingImageID reports a request that didn't say which image
+// it was for.
+func writeMissingImageID(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest,
+		"Key 'ImageID' not found in URL string.",
+		&fieldError{Field: "ImageID", Message: "is required"})
+}
 
-	case "POST":
-		if fhidConfig.Config.Authentication.AuthEnabled {
-			// Begin check auth
-			needs := "write"
-			err := requiresAuth(r, needs)
-			if err != nil {
-				msg := fmt.Sprintf(`{"Error": "Error checking authorization: '%s'"}`, err)
-				fhidLogger.Loggo.Error("error in auth", "Error", msg)
-				http.Error(w, msg, http.StatusUnauthorized)
-				return
-			}
-			// End check auth
+// loadImage reads an entry the caller is allowed to see. Entries in
+// other tenants look the same as missing ones. If it returns false a
+// response has already been sent.
+func loadImage(w http.ResponseWriter, r *http.Request, id string, access *tenantAccess) (*buildEntry, bool) {
+	data, err := rget(requestLog(r), id)
+	if err != nil {
+		if err.Error() == "NOT FOUND" {
+			writeError(w, r, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Error locating record '%s'", id))
+			return nil, false
 		}
-		body, err := ioutil.ReadAll(r.Body)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Error fullfilling request for '%s': %s", id, err))
+		return nil, false
+	}
+	var ie buildEntry
+	_, err = decodeEntry([]byte(data), &ie)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Error processing object retrieved from database: %s", err))
+		return nil, false
+	}
+	if !access.allows(ie.tenant()) {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Error locating record '%s'", id))
+		return nil, false
+	}
+	return &ie, true
+}
+
+// handlerCreateImage handles the post to the database
+func handlerCreateImage(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, rateClassWrite) {
+		return
+	}
+	access, err := writeAccess(r, fhidConfig.EntitlementImageCreate)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	r = withPrincipal(r, access.principal)
+	if principalRateLimited(w, r, rateClassWrite) {
+		return
+	}
+	log := requestLog(r)
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	// release notes on a new entry release it, so they need their own entitlement
+	var probe struct{ ReleaseNotes *ReleaseNotes }
+	if json.Unmarshal(body, &probe) == nil && releaseNotesSet(probe.ReleaseNotes) {
+		releaseAccess, err := writeAccess(r, fhidConfig.EntitlementImageRelease)
 		if err != nil {
-			fhidLogger.Loggo.Error("Error reading body", "Error", err)
-			msg := fmt.Sprintf(`{"Success": "False", "Data": "%s", "Error": "Error reading body."}`, err)
-			http.Error(w, msg, http.StatusBadRequest)
+			writeAuthError(w, r, err)
 			return
 		}
-		// have to parse in a score in case we want to override ording in testing
-		u, err := url.Parse(r.URL.String())
-		q, err := url.ParseQuery(u.RawQuery)
+		access = access.intersect(releaseAccess)
+	}
+	// have to parse in a score in case we want to override ording in testing
+	score := 0
+	if value := r.URL.Query().Get("Score"); value != "" {
+		log.Info("Found score override in url query", "Key", "Score")
+		log.Debug("Parsed Score", "Score", value)
+		score, err = strconv.Atoi(value)
 		if err != nil {
-			fhidLogger.Loggo.Error("Error processing URL", "Error", err)
-			msg := fmt.Sprintf(`{"Success": "False", "Data": "%s", "Error": "Error processing URL"}`, err)
-			http.Error(w, msg, http.StatusBadRequest)
-			return
-		}
-		fhidLogger.Loggo.Debug("Parsed URL query successfully", "Query", q)
-		score := 0
-		key := "Score"
-		value, ok := q[key]
-		if ok {
-			fhidLogger.Loggo.Info("Found score override in url query", "Key", key)
-			fhidLogger.Loggo.Debug("Parsed Score", "Score", value)
-			score, err = strconv.Atoi(value[0])
-			if err != nil {
-				fhidLogger.Loggo.Error("Error parsing score overide, defaulting to zero", "Error", err)
-			}
-		} else {
+			log.Error("Error parsing score overide, defaulting to zero", "Error", err)
 			score = 0
 		}
-		image := buildEntry{}
-		key, err = image.ParseBodyWrite(body, score)
-		if err != nil {
-			fhidLogger.Loggo.Error("Error writing to database", "Error", err)
-			msg := fmt.Sprintf(`{"Success": "False", "Data": "%s", "Error": "Error in body parse and post."}`, err)
-			http.Error(w, msg, http.StatusInternalServerError)
-			return
-		} else {
-			fmt.Fprintf(w, messageSuccessData(key))
+	}
+	if !checkIdempotencyKey(w, r) {
+		return
+	}
+	image := buildEntry{}
+	var key string
+	var replayed bool
+	err = image.parseBody(requestLog(r), body)
+	if err == nil {
+		key, replayed, err = image.writeIdempotent(r, score, access)
+	}
+	if err != nil {
+		writeCreateError(w, r, &image, err)
+		return
+	}
+	if replayed {
+		log.Info("Post is a retry, returning the entry it created", "ImageID", key)
+		w.Header().Set(idempotencyReplayedHeader, "true")
+	}
+	writeData(w, r, key)
+}
 
+// writeCreateError reports why a new entry couldn't be written.
+func writeCreateError(w http.ResponseWriter, r *http.Request, image *buildEntry, err error) {
+	status, e := createError(image, err)
+	writeAPIError(w, r, status, e)
+}
+
+// createError returns the status and error reported when a new entry
+// couldn't be written.
+func createError(image *buildEntry, err error) (int, *apiError) {
+	if err == errTenantForbidden {
+		return http.StatusForbidden, &apiError{
+			Code:    errCodeTenantForbidden,
+			Message: fmt.Sprintf("%s: '%s'", err, image.Tenant),
+			Fields:  []*fieldError{{Field: "Tenant", Message: err.Error()}},
 		}
-	case "PATCH":
-		if fhidConfig.Config.Authentication.AuthEnabled {
-			// Begin check auth
-			needs := "write"
-			err := requiresAuth(r, needs)
-			if err != nil {
-				msg := fmt.Sprintf(`{"Error": "Error checking authorization: '%s'"}`, err)
-				http.Error(w, msg, http.StatusUnauthorized)
-				return
-			}
-			// End auth check
-		}
-		fhidLogger.Loggo.Info("Request URL captured for patch", "URL", r.URL)
-		u, err := url.Parse(r.URL.String())
-		q, err := url.ParseQuery(u.RawQuery)
-		if err != nil {
-			fhidLogger.Loggo.Error("Error processing URL", "Error", err)
-			http.Error(w, `{"Error": "Error processing URL"}`, http.StatusBadRequest)
-			return
-		}
-		fhidLogger.Loggo.Debug("Parsed URL query successfully", "Query", q)
-		key := "ImageID"
-		value, ok := q[key]
-		if !ok {
-			fhidLogger.Loggo.Info("Key not found in URL string", "Key", key)
-		}
-		fhidLogger.Loggo.Debug("Parsed ImageID", "ImageID", value)
-		// now parse the body into a struct
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			fhidLogger.Loggo.Error("Error reading body", "Error", err)
-			msg := fmt.Sprintf(`{"Success": "False", "Data": "%s", "Error": "Error reading body."}`, err)
-			http.Error(w, msg, http.StatusBadRequest)
-			return
-		}
-		var rnotes buildEntry
-		err = json.Unmarshal(body, &rnotes)
-		if err != nil {
-			fhidLogger.Loggo.Error("Error parsing body", "Error", err)
-			msg := fmt.Sprintf(`{"Success": "False", "Data": "%s", "Error": "Error parsing body."}`, err)
-			http.Error(w, msg, http.StatusBadRequest)
-			return
+	}
+	if c, ok := err.(*idempotencyConflict); ok {
+		return http.StatusConflict, &apiError{Code: errCodeConflict, Message: c.Error()}
+	}
+	return requestError(err)
+}
+
+// requestError returns the status and error reported for a body that
+// couldn't be decoded or validated, or for any other failure while
+// handling it.
+func requestError(err error) (int, *apiError) {
+	switch e := err.(type) {
+	case *bodyError:
+		return http.StatusBadRequest, badBodyError(err)
+	case *validationError:
+		return http.StatusBadRequest, &apiError{Code: errCodeInvalidRequest, Message: err.Error(), Fields: e.fields}
+	}
+	return http.StatusInternalServerError, &apiError{Code: errCodeInternal, Message: fmt.Sprintf("Error in body parse and post: %s", err)}
+}
+
+// handlerReleaseImage replaces the release notes of an image.
+func handlerReleaseImage(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, rateClassWrite) {
+		return
+	}
+	access, err := writeAccess(r, fhidConfig.EntitlementImageRelease)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	r = withPrincipal(r, access.principal)
+	if principalRateLimited(w, r, rateClassWrite) {
+		return
+	}
+	log := requestLog(r)
+	log.Info("Request URL captured for patch", "URL", r.URL)
+	id := imageID(r)
+	log.Debug("Parsed ImageID", "ImageID", id)
+	// now parse the body into a struct
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	var rnotes buildEntry
+	err = decodeBody(body, &rnotes)
+	if err != nil {
+		writeBadBody(w, r, err)
+		return
+	}
+	err = validateEntry(rnotes.ReleaseNotes, "ReleaseNotes")
+	if ve, ok := err.(*validationError); ok {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error(), ve.fields...)
+		return
+	}
+	// now we should  have a buildEntry object, we'll find the desired
+	// imageID and update just the release notes
+	if id == "" {
+		writeMissingImageID(w, r)
+		return
+	}
+	ie, ok := loadImage(w, r, id, access)
+	if !ok {
+		return
+	}
+	// overwrite the entry's release notes from those of the body
+	ie.ReleaseNotes = rnotes.ReleaseNotes
+	ie.UpdatedBy = access.principal.UserID
+	// marshal and write to database
+	writedata, err := json.Marshal(ie)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Error updating object retrieved from database: %s", err))
+		return
+	}
+	err = rset(log, id, string(writedata), 0)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Error writing to database: %s", err))
+		return
+	}
+	writeData(w, r, id)
+}
+
+// serviceAccountKeyResponse is the Data returned whenever a key is
+// issued, it's the only time the key is ever shown.
+type serviceAccountKeyResponse struct {
+	Name    string
+	Key     string
+	Expires string `json:",omitempty"`
+}
+
+// serviceAccountAdmin checks the caller may manage service accounts.
+// It returns the request with the caller's principal, the tenants the
+// caller administers and false if a response has already been sent.
+func serviceAccountAdmin(w http.ResponseWriter, r *http.Request) (*http.Request, *tenantAccess, bool) {
+	if rateLimited(w, r, rateClassWrite) {
+		return r, nil, false
+	}
+	access, err := writeAccess(r, fhidConfig.EntitlementAdmin)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return r, nil, false
+	}
+	r = withPrincipal(r, access.principal)
+	if principalRateLimited(w, r, rateClassWrite) {
+		return r, nil, false
+	}
+	requestLog(r).Info("Service account request", "RequestMethod", r.Method, "Name", pathParam(r, "name"))
+	return r, access, true
+}
+
+// loadServiceAccount reads an account the caller may manage. Accounts
+// with access the caller doesn't have look the same as missing ones.
+// If it returns false a response has already been sent.
+func loadServiceAccount(w http.ResponseWriter, r *http.Request, name string, access *tenantAccess) bool {
+	sa, err := getServiceAccount(name)
+	if err == nil && !access.canManage(sa) {
+		err = errServiceAccountNotFound
+	}
+	if err == errServiceAccountNotFound {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("%s: '%s'", err, name))
+		return false
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return false
+	}
+	return true
+}
+
+// handlerListServiceAccounts lists the service accounts managed by fhid.
+func handlerListServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	r, access, ok := serviceAccountAdmin(w, r)
+	if !ok {
+		return
+	}
+	accounts, err := ListServiceAccounts()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+	visible := []*serviceAccount{}
+	for _, sa := range accounts {
+		if access.canManage(sa) {
+			visible = append(visible, sa)
 		}
-		// now we should  have a buildEntry object, we'll find the desired
-		// imageID and update just the release notes
-		if len(value) < 1 {
-			msg := fmt.Sprintf(`{"Error": "Key '%s' not found in URL string."}`, key)
-			http.Error(w, msg, http.StatusBadRequest)
-			return
-		} else {
-			data, err := Rget(value[0])
-			if err != nil {
-				msg := fmt.Sprintf(`{"Error": "Error fullfilling request for '%s': '%s'"}`, value, err)
-				http.Error(w, msg, http.StatusBadRequest)
-				return
-			}
-			var ie buildEntry
-			err = json.Unmarshal([]byte(data), &ie)
-			if err != nil {
-				msg := fmt.Sprintf(`{"Error": "Error processing object retrieved from database. %s}`, err)
-				http.Error(w, msg, http.StatusBadRequest)
-				return
-			}
-			// overwrite the entry's release notes from those of the body
-			ie.ReleaseNotes = rnotes.ReleaseNotes
-			// marshal and write to database
-			writedata, err := json.Marshal(ie)
-			if err != nil {
-				msg := fmt.Sprintf(`{"Error": "Error updating object retrieved from database. %s}`, err)
-				http.Error(w, msg, http.StatusBadRequest)
-				return
-			}
-			err = Rset(value[0], string(writedata), 0)
-			if err != nil {
-				fhidLogger.Loggo.Error("Error writing to database", "Error", err)
-				msg := fmt.Sprintf(`{"Success": "False", "Data": "%s", "Error": "Error in body parse and post."}`, err)
-				http.Error(w, msg, http.StatusInternalServerError)
-				return
-			}
-			fmt.Fprintf(w, messageSuccessData(value[0]))
+	}
+	writeData(w, r, visible)
+}
+
+// handlerCreateServiceAccount creates a service account and issues its key.
+func handlerCreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	r, access, ok := serviceAccountAdmin(w, r)
+	if !ok {
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	sa := &serviceAccount{}
+	err := json.Unmarshal(body, sa)
+	if err != nil {
+		writeBadBody(w, r, err)
+		return
+	}
+	err = sa.validate()
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	// admins can only issue keys with access they have themselves
+	if !access.canManage(sa) {
+		field := "Tenants"
+		if sa.Admin {
+			field = "Admin"
 		}
-	case "PUT":
-		http.Error(w, messageMethodNotAllowed(), http.StatusMethodNotAllowed)
-	case "DELETE":
-		http.Error(w, messageMethodNotAllowed(), http.StatusMethodNotAllowed)
-	default:
-		http.Error(w, messageMethodNotAllowed(), http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusForbidden, errCodeTenantForbidden, errServiceAccountForbidden.Error(),
+			&fieldError{Field: field, Message: errServiceAccountForbidden.Error()})
+		return
+	}
+	key, err := CreateServiceAccount(sa)
+	if err == errServiceAccountExists {
+		writeError(w, r, http.StatusConflict, errCodeConflict, fmt.Sprintf("%s: '%s'", err, sa.Name))
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
 	}
+	writeServiceAccountKey(w, r, sa.Name, key, sa.Expires)
 }
 
-// HealthCheck is a health check handler.
+// handlerRotateServiceAccount issues a new key for a service account.
+func handlerRotateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	r, access, ok := serviceAccountAdmin(w, r)
+	if !ok {
+		return
+	}
+	name := pathParam(r, "name")
+	if !loadServiceAccount(w, r, name, access) {
+		return
+	}
+	key, sa, err := RotateServiceAccount(name)
+	if err == errServiceAccountNotFound {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("%s: '%s'", err, name))
+		return
+	}
+	if err == errServiceAccountChanged {
+		writeError(w, r, http.StatusConflict, errCodeConflict, fmt.Sprintf("%s: '%s'", err, name))
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+	writeServiceAccountKey(w, r, name, key, sa.Expires)
+}
+
+// handlerRevokeServiceAccount deletes a service account and its key.
+func handlerRevokeServiceAccount(w http.ResponseWriter, r *http.Request) {
+	r, access, ok := serviceAccountAdmin(w, r)
+	if !ok {
+		return
+	}
+	name := pathParam(r, "name")
+	if !loadServiceAccount(w, r, name, access) {
+		return
+	}
+	err := RevokeServiceAccount(name)
+	if err == errServiceAccountNotFound {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("%s: '%s'", err, name))
+		return
+	}
+	if err == errServiceAccountChanged {
+		writeError(w, r, http.StatusConflict, errCodeConflict, fmt.Sprintf("%s: '%s'", err, name))
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+	writeData(w, r, name)
+}
+
+func writeServiceAccountKey(w http.ResponseWriter, r *http.Request, name, key, expires string) {
+	writeData(w, r, &serviceAccountKeyResponse{
+		Name:    name,
+		Key:     key,
+		Expires: expires,
+	})
+}
+
+// HealthCheck is a health check handler. The auth cache stats are only
+// included for callers with read access, anonymous checks such as a
+// load balancer's never reach the auth provider.
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(w, r)
 	status := &status{}
 	status.State = "Healthy"
 	// Status.Version = &fhidConfig.Config.Version
 	status.Version = fhidConfig.Version
-	msg := status.getStatus()
-	fmt.Fprintf(w, msg)
+	if !fhidConfig.Config.Authentication.AuthEnabled {
+		status.AuthCache = membershipCache.stats()
+	} else if _, err := requiresAuth(r, fhidConfig.EntitlementRead); err == nil {
+		status.AuthCache = membershipCache.stats()
+	}
+	writeData(w, r, status)
 }
@@ -21,6 +21,11 @@ type imagePostResponse struct {
 	Data    string
 }
 
+type imageQueryResponse struct {
+	Success string
+	Data    ImageQueryResults
+}
+
 const imageGood = `
 {
 "Version":"1.2.3.145",
@@ -237,6 +242,7 @@ func writeConfigFile() (*bytes.Buffer, error) {
 	seed := `{
         "RedisEndpoint": "localhost:6379",
 		"RedisImageIndexSet": "IMAGE_INDEX",
+		"RedisNamespace": "fhid",
         "ListenPort": "8090",
 		"ListenHost": "127.0.0.1",
 		"Authentication": {
@@ -302,6 +308,16 @@ func setup(fake bool, addr string) error {
 	if fake == true {
 		fhidConfig.Config.RedisEndpoint = addr
 	}
+	err = fhidConfig.Config.Validate()
+	if err != nil {
+		fhidLogger.Loggo.Error("Invalid config", "Error", err)
+		return err
+	}
+	err = SetupAuth()
+	if err != nil {
+		fhidLogger.Loggo.Error("Error setting up auth", "Error", err)
+		return err
+	}
 	fhidLogger.Loggo.Debug("Connecting to Redis at address.", "Address", fhidConfig.Config.RedisEndpoint)
 	err = SetupConnection()
 	if err != nil {
@@ -338,7 +354,7 @@ func seedQueryData() error {
 		return err
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImages)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusOK {
 		fhidLogger.Loggo.Error("handler returned wrong status code",
@@ -417,7 +433,7 @@ func TestBadMethods(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImages)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusMethodNotAllowed {
 		fhidLogger.Loggo.Error("handler returned wrong status code",
@@ -429,7 +445,7 @@ func TestBadMethods(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(HandlerImages)
+	handler = NewRouter()
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusMethodNotAllowed {
 		fhidLogger.Loggo.Error("handler returned wrong status code",
@@ -441,7 +457,7 @@ func TestBadMethods(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(HandlerImages)
+	handler = NewRouter()
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusMethodNotAllowed {
 		fhidLogger.Loggo.Error("handler returned wrong status code",
@@ -471,7 +487,7 @@ func TestImageBad(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImages)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusBadRequest {
 		fhidLogger.Loggo.Error("handler returned wrong status code",
@@ -503,7 +519,7 @@ func TestImageUpdate(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImages)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusOK {
 		fhidLogger.Loggo.Error("handler returned wrong status code",
@@ -520,13 +536,13 @@ func TestImageUpdate(t *testing.T) {
 	// set up response recorder
 	rr = httptest.NewRecorder()
 	queryBody := bytes.NewBufferString(imageGoodReleaseUpdate)
-	urlString := fmt.Sprintf("/image?ImageID=%s", imageID)
+	urlString := fmt.Sprintf("/images?ImageID=%s", imageID)
 	req, err = http.NewRequest("PATCH", urlString, queryBody)
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(HandlerImages)
+	handler = NewRouter()
 	handler.ServeHTTP(rr, req)
 	match := (rr.Code == 200)
 	if !match {
@@ -565,11 +581,12 @@ func TestImageQueryBuildNotes(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr = httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImagesQuery)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
 	// Check the number of results is what we expect
-	var results ImageQueryResults
-	err = json.Unmarshal(rr.Body.Bytes(), &results)
+	var resp imageQueryResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	results := resp.Data
 	expectedResults := 3
 	match := (len(results.Results) == expectedResults)
 	if !match {
@@ -608,11 +625,12 @@ func TestImageQueryReleaseNotes(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr = httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImagesQuery)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
 	// Check the number of results is what we expect
-	var results ImageQueryResults
-	err = json.Unmarshal(rr.Body.Bytes(), &results)
+	var resp imageQueryResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	results := resp.Data
 	expectedResults := 1
 	match := (len(results.Results) == expectedResults)
 	if !match {
@@ -646,16 +664,17 @@ func TestImageQueryVersion(t *testing.T) {
 	// set up response recorder
 	rr := httptest.NewRecorder()
 	queryBody := bytes.NewBufferString(ImageQueryVersion)
-	req, err := http.NewRequest("POST", "/image_query", queryBody)
+	req, err := http.NewRequest("POST", "/query", queryBody)
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr = httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImagesQuery)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
 	// Check the number of results is what we expect
-	var results ImageQueryResults
-	err = json.Unmarshal(rr.Body.Bytes(), &results)
+	var resp imageQueryResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	results := resp.Data
 	expectedResults := 1
 	match := (len(results.Results) == expectedResults)
 	if !match {
@@ -684,17 +703,21 @@ func TestImageGetNone(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImages)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusBadRequest {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusBadRequest)
 	}
 	// Check the response body is what we expect.
-	expected := `{"Error": "Key 'ImageID' not found in URL string."}` + "\n"
-	if rr.Body.String() != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), expected)
+	var body envelope
+	err = json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Error == nil || body.Error.Code != errCodeInvalidRequest ||
+		body.Error.Message != "Key 'ImageID' not found in URL string." {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
 	}
 }
 
@@ -723,16 +746,17 @@ func TestImageQueryBaseOS(t *testing.T) {
 	// set up response recorder
 	rr := httptest.NewRecorder()
 	queryBody := bytes.NewBufferString(ImageQueryBaseOS)
-	req, err := http.NewRequest("POST", "/image_query", queryBody)
+	req, err := http.NewRequest("POST", "/query", queryBody)
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr = httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerImagesQuery)
+	handler := NewRouter()
 	handler.ServeHTTP(rr, req)
 	// Check the number of results is what we expect
-	var results ImageQueryResults
-	err = json.Unmarshal(rr.Body.Bytes(), &results)
+	var resp imageQueryResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	results := resp.Data
 	expectedResults := 1
 	match := (len(results.Results) == expectedResults)
 	if !match {
@@ -0,0 +1,131 @@
+package fhid
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+)
+
+// idempotencyHeader carries the caller's key for a post to /images.
+// Posts with the same key within the window are treated as retries.
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotencyReplayedHeader is set on the response to a retried post.
+const idempotencyReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength caps the length of an Idempotency-Key.
+const maxIdempotencyKeyLength = 255
+
+// idempotencyRecord is what's remembered about a post, the entry it
+// created and a hash of what was posted.
+type idempotencyRecord struct {
+	ImageID string
+	Hash    string
+}
+
+// idempotencyConflict is returned when a key is reused for a different
+// entry.
+type idempotencyConflict struct {
+	imageID string
+	natural bool
+}
+
+func (e *idempotencyConflict) Error() string {
+	if e.natural {
+		return fmt.Sprintf("An entry with the same Tenant, BaseOS, Version and SourceAmi but different content already exists: '%s'", e.imageID)
+	}
+	return fmt.Sprintf("%s was already used for a different entry: '%s'", idempotencyHeader, e.imageID)
+}
+
+// checkIdempotencyKey rejects an Idempotency-Key that's too long. If
+// it returns false a response has already been sent.
+func checkIdempotencyKey(w http.ResponseWriter, r *http.Request) bool {
+	if len(r.Header.Get(idempotencyHeader)) > maxIdempotencyKeyLength {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest,
+			fmt.Sprintf("%s can't be longer than %d characters", idempotencyHeader, maxIdempotencyKeyLength))
+		return false
+	}
+	return true
+}
+
+// idempotencyScope returns what identifies a post as a retry of an
+// earlier one, or an empty string if it can't be recognised. Keys
+// given by callers only apply to the same credential and tenant,
+// natural keys apply across callers since they identify the image.
+func (i *buildEntry) idempotencyScope(r *http.Request, access *tenantAccess) (scope string, natural bool) {
+	if key := r.Header.Get(idempotencyHeader); key != "" {
+		return strings.Join([]string{"key", access.principal.Credential, i.Tenant, key}, "\x00"), false
+	}
+	if !fhidConfig.Config.IdempotencyRules().NaturalKey {
+		return "", false
+	}
+	sourceAmi := ""
+	if i.BuildNotes != nil {
+		sourceAmi = i.BuildNotes.SourceAmi
+	}
+	return "natural\x00" + strings.Join([]string{i.Tenant, i.BaseOS, i.Version, sourceAmi}, "\x00"), true
+}
+
+// idempotencyHash hashes a stamped entry without the fields fhid fills
+// in, so a retry matches whether or not it named the tenant it was
+// defaulted to the first time.
+func (i *buildEntry) idempotencyHash() (string, error) {
+	posted := *i
+	posted.SchemaVersion = 0
+	posted.ImageID = ""
+	posted.CreateDate = ""
+	posted.CreatedBy = ""
+	posted.UpdatedBy = ""
+	b, err := json.Marshal(&posted)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeIdempotent stores a new entry like write, unless it's a retry
+// of a post within the configured window. A retry returns the ImageID
+// written the first time with replayed set, and a different entry
+// posted under the same key gets an *idempotencyConflict.
+func (i *buildEntry) writeIdempotent(r *http.Request, score int, access *tenantAccess) (key string, replayed bool, err error) {
+	key, srep, err := i.stamp(access)
+	if err != nil {
+		return "", false, err
+	}
+	hash, err := i.idempotencyHash()
+	if err != nil {
+		return "", false, err
+	}
+	scope, natural := i.idempotencyScope(r, access)
+	if scope == "" {
+		return key, false, rset(requestLog(r), key, string(srep), score)
+	}
+	scopeSum := sha256.Sum256([]byte(scope))
+	name := nsKey("idempotency:" + hex.EncodeToString(scopeSum[:]))
+	record, err := json.Marshal(&idempotencyRecord{ImageID: key, Hash: hash})
+	if err != nil {
+		return "", false, err
+	}
+	existing, err := entryTxn(key, string(srep), score).execOnce(name, string(record), fhidConfig.Config.IdempotencyRules().WindowSeconds)
+	if err != nil {
+		return "", false, err
+	}
+	if existing == "" {
+		return key, false, nil
+	}
+	var prev idempotencyRecord
+	err = json.Unmarshal([]byte(existing), &prev)
+	if err != nil {
+		return "", false, fmt.Errorf("Error reading idempotency record: %s", err)
+	}
+	if prev.Hash != hash {
+		return prev.ImageID, false, &idempotencyConflict{imageID: prev.ImageID, natural: natural}
+	}
+	return prev.ImageID, true, nil
+}
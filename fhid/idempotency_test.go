@@ -0,0 +1,194 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/jarcoal/httpmock"
+)
+
+func postIdempotent(t *testing.T, key, body string) (*httptest.ResponseRecorder, string) {
+	req, err := http.NewRequest("POST", "/images", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set(idempotencyHeader, key)
+	}
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	var j imagePostResponse
+	json.Unmarshal(rr.Body.Bytes(), &j)
+	return rr, j.Data
+}
+
+// TestIdempotencyKey makes sure retried posts return the entry created
+// the first time and reused keys are caught.
+func TestIdempotencyKey(t *testing.T) {
+	setupValidation(t)
+	fhidConfig.Config.Idempotency = &fhidConfig.Idempotency{WindowSeconds: 600}
+	defer func() { fhidConfig.Config.Idempotency = nil }()
+	before := indexed(t)
+
+	rr, first := postIdempotent(t, "build-42", imageGood)
+	if rr.Code != http.StatusOK || rr.Header().Get(idempotencyReplayedHeader) != "" {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	rr, retry := postIdempotent(t, "build-42", imageGood)
+	if rr.Code != http.StatusOK || retry != first {
+		t.Errorf("retry got status %d and ImageID '%s', want '%s'", rr.Code, retry, first)
+	}
+	if rr.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Error("retry isn't marked as replayed")
+	}
+	if got := indexed(t); got != before+1 {
+		t.Errorf("got %d new entries, want 1", got-before)
+	}
+
+	rr, id := postIdempotent(t, "build-42", imageGood2)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("reused key got status %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), first) {
+		t.Errorf("conflict doesn't name the original entry: %s", rr.Body.String())
+	}
+	_, id = postIdempotent(t, "build-43", imageGood)
+	_, other := postIdempotent(t, "", imageGood)
+	if id == first || other == first || id == "" || other == "" {
+		t.Errorf("posts without the same key weren't written as new entries")
+	}
+
+	keys, err := scanKeys(nsKey("idempotency:*"))
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("got idempotency keys %v: %v", keys, err)
+	}
+	ttl, err := redis.Int(Rconn.Do("TTL", keys[0]))
+	if err != nil || ttl <= 0 || ttl > 600 {
+		t.Errorf("got TTL %d, want up to the 600 second window: %v", ttl, err)
+	}
+
+	rr, _ = postIdempotent(t, strings.Repeat("k", maxIdempotencyKeyLength+1), imageGood)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("long key got status %d", rr.Code)
+	}
+
+	// purged entries aren't handed back to retries
+	_, err = PurgeEntries(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, retry = postIdempotent(t, "build-42", imageGood)
+	if rr.Code != http.StatusOK || retry == first {
+		t.Errorf("post after purge got status %d and ImageID '%s'", rr.Code, retry)
+	}
+}
+
+// TestIdempotencyNaturalKey makes sure posts without a key are matched
+// on Tenant, BaseOS, Version and SourceAmi when NaturalKey is set.
+func TestIdempotencyNaturalKey(t *testing.T) {
+	setupValidation(t)
+	fhidConfig.Config.Idempotency = &fhidConfig.Idempotency{NaturalKey: true}
+	defer func() { fhidConfig.Config.Idempotency = nil }()
+
+	_, first := postIdempotent(t, "", imageGood)
+	rr, retry := postIdempotent(t, "", imageGood)
+	if rr.Code != http.StatusOK || retry != first {
+		t.Errorf("retry got status %d and ImageID '%s', want '%s'", rr.Code, retry, first)
+	}
+	changed := strings.Replace(imageGood, "line two", "line three", 1)
+	rr, _ = postIdempotent(t, "", changed)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("changed entry got status %d: %s", rr.Code, rr.Body.String())
+	}
+	rr, id := postIdempotent(t, "", strings.Replace(imageGood, "1.2.3.145", "1.2.3.146", 1))
+	if rr.Code != http.StatusOK || id == first {
+		t.Errorf("new version got status %d and ImageID '%s'", rr.Code, id)
+	}
+	// a caller's key takes precedence
+	rr, id = postIdempotent(t, "rebuild", changed)
+	if rr.Code != http.StatusOK || id == first {
+		t.Errorf("post with a key got status %d and ImageID '%s'", rr.Code, id)
+	}
+}
+
+// TestIdempotencyDefaultTenant makes sure a retry that names the tenant
+// the first post was defaulted to is still a retry.
+func TestIdempotencyDefaultTenant(t *testing.T) {
+	setupTenancy(t)
+	defer func() { fhidConfig.Config.Tenancy = nil }()
+	fhidConfig.Config.Authentication.AuthEnabled = true
+	fhidConfig.Config.Idempotency = &fhidConfig.Idempotency{WindowSeconds: 600}
+	defer func() { fhidConfig.Config.Idempotency = nil }()
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockMemberOf("g01236390")
+
+	post := func(body string) (int, string) {
+		req, err := http.NewRequest("POST", "/images", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
+		req.Header.Set(idempotencyHeader, "build-42")
+		rr := httptest.NewRecorder()
+		NewRouter().ServeHTTP(rr, req)
+		var j imagePostResponse
+		json.Unmarshal(rr.Body.Bytes(), &j)
+		return rr.Code, j.Data
+	}
+	code, first := post(`{"Version":"1.0.0","BaseOS":"Ubuntu16.04"}`)
+	if code != http.StatusOK {
+		t.Fatalf("first post got status %d", code)
+	}
+	code, retry := post(`{"Version":"1.0.0","BaseOS":"Ubuntu16.04","Tenant":"bu-a"}`)
+	if code != http.StatusOK || retry != first {
+		t.Errorf("retry naming the tenant got status %d and ImageID '%s', want '%s'", code, retry, first)
+	}
+}
+
+// TestIdempotencyBatch makes sure batches refuse an Idempotency-Key
+// rather than ignore it.
+func TestIdempotencyBatch(t *testing.T) {
+	setupValidation(t)
+	req, err := http.NewRequest("POST", "/images:batch", bytes.NewBufferString("["+imageGood+"]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(idempotencyHeader, "build-42")
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), idempotencyHeader) {
+		t.Errorf("batch with a key got status %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// TestIdempotencyScope makes sure keys given by callers are scoped to
+// the credential and tenant rather than the reported user ID.
+func TestIdempotencyScope(t *testing.T) {
+	req, err := http.NewRequest("POST", "/images", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(idempotencyHeader, "build-42")
+	scope := func(credential, tenant string) string {
+		access := &tenantAccess{principal: &principal{UserID: "shared", Credential: credential}}
+		s, _ := (&buildEntry{Tenant: tenant}).idempotencyScope(req, access)
+		return s
+	}
+	if scope("a", "team1") == scope("b", "team1") {
+		t.Error("different credentials with the same user ID share a scope")
+	}
+	if scope("a", "team1") == scope("a", "team2") {
+		t.Error("different tenants share a scope")
+	}
+	if scope("a", "team1") != scope("a", "team1") {
+		t.Error("the same credential and tenant got different scopes")
+	}
+}
@@ -1,41 +1,160 @@
 package fhid
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
 
-	"github.com/GESkunkworks/fhid/fhidLogger"
+// Codes returned in the Error.Code field of the response envelope
+const (
+	errCodeInvalidRequest   = "InvalidRequest"
+	errCodeNotFound         = "NotFound"
+	errCodeMethodNotAllowed = "MethodNotAllowed"
+	errCodeConflict         = "Conflict"
+	errCodeTenantForbidden  = "TenantForbidden"
+	errCodeQueryFailed      = "QueryFailed"
+	errCodeInternal         = "InternalError"
+	errCodeRateLimited      = "RateLimited"
+	errCodeTooLarge         = "RequestTooLarge"
 )
 
-func messageInvalidRequest(err error) string {
-	msg := fmt.Sprintf(`{"Msg":"Invalid Request","Error":"%v"}`, err)
-	fhidLogger.Loggo.Error("Invalid Request", "Error", err)
-	return msg
+// fieldError describes a problem with one field of a request body.
+type fieldError struct {
+	Field   string
+	Message string
+}
+
+// apiError is the Error part of the response envelope.
+type apiError struct {
+	Code    string
+	Message string
+	// Entitlement is the entitlement an auth failure was for.
+	Entitlement string        `json:",omitempty"`
+	Fields      []*fieldError `json:",omitempty"`
+}
+
+// envelope wraps every status message and error fhid sends. Success
+// stays a string for older clients that compare it to "True".
+type envelope struct {
+	Success   string
+	Data      interface{} `json:",omitempty"`
+	Error     *apiError   `json:",omitempty"`
+	RequestID string      `json:",omitempty"`
+}
+
+// requestIDHeader carries the request ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern limits which caller supplied request IDs are reused.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// withRequestID makes sure the request has an ID on its context and in
+// the response headers. A sane X-Request-ID from the caller is reused,
+// otherwise a new one is generated.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	if requestID(r) != "" {
+		return r
+	}
+	id := r.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = getUUID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestID returns the ID of the request or an empty string if it
+// hasn't been given one.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// writeJSON serializes v as the response body.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		requestLog(r).Error("Error serializing response", "Error", err)
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(&envelope{
+			Success:   "False",
+			Error:     &apiError{Code: errCodeInternal, Message: "Error serializing response"},
+			RequestID: requestID(r),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+	fmt.Fprintln(w)
 }
 
-func messageErrorHandler(err error) string {
-	msg := fmt.Sprintf(`{"Msg":"Internal Server Error","Error":"%v"}`, err)
-	fhidLogger.Loggo.Error("Internal Server Error", "Error", err)
-	return msg
+// writeDocument serves v as is, outside of the envelope, for documents
+// such as schemas that other tools consume directly.
+func writeDocument(w http.ResponseWriter, r *http.Request, contentType string, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Error serializing document: %s", err))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(body)
+	fmt.Fprintln(w)
 }
 
-func messageErrorHandlerQuery(err error) string {
-	msg := fmt.Sprintf(`{"Msg":"Query failed.","Error":"%v"}`, err)
-	fhidLogger.Loggo.Error("Query failed", "Error", err)
-	return msg
+// writeData sends a successful envelope carrying data.
+func writeData(w http.ResponseWriter, r *http.Request, data interface{}) {
+	writeJSON(w, r, http.StatusOK, &envelope{Success: "True", Data: data, RequestID: requestID(r)})
 }
 
-func messageSuccess() string {
-	return `{"Success": "True"}`
+// writeAPIError sends a failed envelope carrying e.
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, e *apiError) {
+	log := requestLog(r)
+	if status >= http.StatusInternalServerError {
+		log.Error("Request failed", "Status", status, "Code", e.Code, "Error", e.Message)
+	} else {
+		log.Info("Request rejected", "Status", status, "Code", e.Code, "Error", e.Message)
+	}
+	writeJSON(w, r, status, &envelope{Success: "False", Error: e, RequestID: requestID(r)})
 }
 
-func messageSuccessData(s string) string {
-	return fmt.Sprintf(`{"Success": "True", "Data": "%s"}`, s)
+// writeError sends a failed envelope with the given code and message.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, msg string, fields ...*fieldError) {
+	writeAPIError(w, r, status, &apiError{Code: code, Message: msg, Fields: fields})
 }
 
-func messageFailData(s string) string {
-	return fmt.Sprintf(`{"Success": "False", "Data": "%s"}`, s)
+// writeBadBody reports a request body that couldn't be decoded,
+// pointing at the offending field when the decoder says which it was.
+func writeBadBody(w http.ResponseWriter, r *http.Request, err error) {
+	writeAPIError(w, r, http.StatusBadRequest, badBodyError(err))
 }
 
-func messageMethodNotAllowed() string {
-	return `{"Error":"Method not allowed"}`
+// badBodyError returns the error reported for a body that couldn't be
+// decoded.
+func badBodyError(err error) *apiError {
+	if be, ok := err.(*bodyError); ok {
+		err = be.err
+	}
+	var fields []*fieldError
+	if te, ok := err.(*json.UnmarshalTypeError); ok && te.Field != "" {
+		fields = append(fields, &fieldError{
+			Field:   te.Field,
+			Message: fmt.Sprintf("must be %s, not %s", te.Type, te.Value),
+		})
+	}
+	// the decoder only reports unknown fields in its message
+	if name := strings.TrimPrefix(err.Error(), "json: unknown field "); name != err.Error() {
+		fields = append(fields, &fieldError{
+			Field:   strings.Trim(name, `"`),
+			Message: "is not a known field",
+		})
+	}
+	return &apiError{Code: errCodeInvalidRequest, Message: fmt.Sprintf("Error parsing body: %s", err), Fields: fields}
 }
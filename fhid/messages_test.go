@@ -0,0 +1,90 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// TestEnvelope makes sure successes and errors from every kind of
+// handler come back as the same JSON envelope with a request ID.
+func TestEnvelope(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	fhidConfig.Config.Authentication.AuthEnabled = false
+	do := func(method, path, body, reqID string) (*httptest.ResponseRecorder, *envelope) {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reqID != "" {
+			req.Header.Set(requestIDHeader, reqID)
+		}
+		rr := httptest.NewRecorder()
+		NewRouter().ServeHTTP(rr, req)
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: got content type '%s'", method, path, ct)
+		}
+		var env envelope
+		err = json.Unmarshal(rr.Body.Bytes(), &env)
+		if err != nil {
+			t.Fatalf("%s %s: body isn't JSON: %s", method, path, rr.Body.String())
+		}
+		if env.RequestID == "" || env.RequestID != rr.Header().Get(requestIDHeader) {
+			t.Errorf("%s %s: request ID '%s' doesn't match header '%s'",
+				method, path, env.RequestID, rr.Header().Get(requestIDHeader))
+		}
+		return rr, &env
+	}
+
+	rr, env := do("GET", "/healthcheck", "", "deploy-check.42")
+	if rr.Code != http.StatusOK || env.Success != "True" || env.Error != nil {
+		t.Errorf("healthcheck: unexpected response %d %s", rr.Code, rr.Body.String())
+	}
+	if env.RequestID != "deploy-check.42" {
+		t.Errorf("healthcheck: caller's request ID wasn't kept, got '%s'", env.RequestID)
+	}
+
+	// request IDs that could mess with logs are replaced
+	_, env = do("GET", "/healthcheck", "", "bad id\"\n")
+	if env.RequestID == "bad id\"\n" {
+		t.Error("unsafe request ID was echoed back")
+	}
+
+	// quotes in the path used to break the hand built error JSON
+	rr, env = do("GET", `/images/a"b`, "", "")
+	if rr.Code != http.StatusNotFound || env.Error == nil || env.Error.Code != errCodeNotFound {
+		t.Errorf("missing image: unexpected response %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr, env = do("PUT", "/images", "", "")
+	if rr.Code != http.StatusMethodNotAllowed || env.Error == nil || env.Error.Code != errCodeMethodNotAllowed {
+		t.Errorf("bad method: unexpected response %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr, env = do("POST", "/images", `{"Version": 5}`, "")
+	if rr.Code != http.StatusBadRequest || env.Error == nil || env.Error.Code != errCodeInvalidRequest {
+		t.Fatalf("bad field type: unexpected response %d %s", rr.Code, rr.Body.String())
+	}
+	if len(env.Error.Fields) != 1 || env.Error.Fields[0].Field != "Version" {
+		t.Errorf("bad field type: expected a field error for Version, got %s", rr.Body.String())
+	}
+
+	rr, env = do("POST", "/query", `{"BaseOS": `, "")
+	if rr.Code != http.StatusBadRequest || env.Error == nil || env.Error.Code != errCodeInvalidRequest {
+		t.Errorf("bad query: unexpected response %d %s", rr.Code, rr.Body.String())
+	}
+}
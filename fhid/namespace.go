@@ -0,0 +1,54 @@
+package fhid
+
+import (
+	"errors"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// MigrateNamespace moves entries stored under bare UUID keys, along
+// with the bare index set, into the configured RedisNamespace. Entries
+// that already exist in the namespace are left alone and reported as
+// skipped.
+func MigrateNamespace() (moved int, skipped int, err error) {
+	if fhidConfig.Config.RedisNamespace == "" {
+		return moved, skipped, errors.New("No RedisNamespace configured to migrate into")
+	}
+	keys, err := scanKeys("*")
+	if err != nil {
+		return moved, skipped, err
+	}
+	for _, k := range keys {
+		if !entryKeyPattern.MatchString(k) {
+			continue
+		}
+		ok, err := redis.Bool(Rconn.Do("RENAMENX", k, nsKey(k)))
+		if err != nil {
+			fhidLogger.Loggo.Error("Error moving key into namespace", "Key", k, "Error", err)
+			return moved, skipped, err
+		}
+		if !ok {
+			fhidLogger.Loggo.Info("Key already exists in namespace, skipping", "Key", k)
+			skipped++
+			continue
+		}
+		moved++
+	}
+	// merge the old index into the namespaced one, keeping the
+	// highest score for any member that's in both
+	index := fhidConfig.Config.RedisImageIndexSet
+	t := &redisTxn{}
+	t.add("ZUNIONSTORE", txnKey(nsKey(index)), 2, txnKey(nsKey(index)), txnKey(index), "AGGREGATE", "MAX")
+	t.add("DEL", txnKey(index))
+	err = t.exec()
+	if err != nil {
+		fhidLogger.Loggo.Error("Error moving index set into namespace", "Index", index, "Error", err)
+		return moved, skipped, err
+	}
+	fhidLogger.Loggo.Info("Namespace migration complete",
+		"Namespace", fhidConfig.Config.RedisNamespace, "Moved", moved, "Skipped", skipped)
+	return moved, skipped, err
+}
@@ -0,0 +1,378 @@
+package fhid
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+)
+
+// apiOperation documents one method on a route for the OpenAPI
+// document. Every operation NewRouter registers needs an entry in
+// apiOperations, the contract test fails if they drift apart.
+type apiOperation struct {
+	summary string
+	// entitlement is the one the caller needs, optional for reads
+	// that may be anonymous.
+	entitlement  string
+	optionalAuth bool
+	deprecated   bool
+	query        []string
+	header       []string
+	// body is the schema of the request body, if it takes one.
+	body map[string]interface{}
+	// form is the schema of a multipart/form-data body accepted as
+	// well as body.
+	form map[string]interface{}
+	// data is the schema of Data in a successful envelope, or of the
+	// whole body when document is set.
+	data map[string]interface{}
+	// document is the content type of responses served outside of
+	// the envelope.
+	document string
+	errors   []int
+}
+
+// apiComponents are the types documented as reusable schemas.
+var apiComponents = map[reflect.Type]string{
+	reflect.TypeOf(buildEntry{}):                "ImageEntry",
+	reflect.TypeOf(ImageEntry{}):                "ImageEntry",
+	reflect.TypeOf(BuildNotes{}):                "BuildNotes",
+	reflect.TypeOf(ReleaseNotes{}):              "ReleaseNotes",
+	reflect.TypeOf(AmiEntry{}):                  "AmiEntry",
+	reflect.TypeOf(Artifact{}):                  "Artifact",
+	reflect.TypeOf(Tags{}):                      "Tag",
+	reflect.TypeOf(ImageQuery{}):                "ImageQuery",
+	reflect.TypeOf(ImageQuerySub{}):             "ImageQuerySub",
+	reflect.TypeOf(ImageQueryResults{}):         "ImageQueryResults",
+	reflect.TypeOf(batchRelease{}):              "BatchRelease",
+	reflect.TypeOf(batchResult{}):               "BatchResult",
+	reflect.TypeOf(batchResults{}):              "BatchResults",
+	reflect.TypeOf(envelope{}):                  "Envelope",
+	reflect.TypeOf(apiError{}):                  "Error",
+	reflect.TypeOf(fieldError{}):                "FieldError",
+	reflect.TypeOf(serviceAccount{}):            "ServiceAccount",
+	reflect.TypeOf(serviceAccountKeyResponse{}): "ServiceAccountKey",
+	reflect.TypeOf(status{}):                    "Status",
+	reflect.TypeOf(authCacheStats{}):            "AuthCacheStats",
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func stringSchema() map[string]interface{} {
+	return map[string]interface{}{"type": "string"}
+}
+
+func objectSchema() map[string]interface{} {
+	return map[string]interface{}{"type": "object"}
+}
+
+func arraySchema(items map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+// releaseBody is what PATCHing release notes takes.
+var releaseBody = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"ReleaseNotes": schemaRef("ReleaseNotes"),
+	},
+}
+
+// packerManifestBody is the part of a Packer manifest fhid reads,
+// anything else in it is ignored.
+var packerManifestBody = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"builds": arraySchema(map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"artifact_id":     stringSchema(),
+				"packer_run_uuid": stringSchema(),
+				"custom_data":     objectSchema(),
+			},
+		}),
+		"last_run_uuid": stringSchema(),
+	},
+	"required": []string{"builds"},
+}
+
+var apiOperations = map[string]*apiOperation{
+	"GET /images": {
+		summary:      "Get an image entry by the ImageID query parameter",
+		entitlement:  fhidConfig.EntitlementRead,
+		optionalAuth: true,
+		deprecated:   true,
+		query:        []string{"ImageID"},
+		data:         schemaRef("ImageQueryResults"),
+		errors:       []int{400, 401, 403, 404, 429, 503},
+	},
+	"POST /images": {
+		summary:     "Create an image entry, release notes also need image:release",
+		entitlement: fhidConfig.EntitlementImageCreate,
+		query:       []string{"Score"},
+		header:      []string{idempotencyHeader},
+		body:        schemaRef("ImageEntry"),
+		data:        stringSchema(),
+		errors:      []int{400, 401, 403, 409, 413, 429, 503},
+	},
+	"PATCH /images": {
+		summary:     "Replace the release notes of the entry in the ImageID query parameter",
+		entitlement: fhidConfig.EntitlementImageRelease,
+		deprecated:  true,
+		query:       []string{"ImageID"},
+		body:        releaseBody,
+		data:        stringSchema(),
+		errors:      []int{400, 401, 403, 404, 413, 429, 503},
+	},
+	"POST /images:batch": {
+		summary:     "Create image entries in bulk, release notes also need image:release",
+		entitlement: fhidConfig.EntitlementImageCreate,
+		query:       []string{"Mode"},
+		body:        arraySchema(schemaRef("ImageEntry")),
+		data:        schemaRef("BatchResults"),
+		errors:      []int{400, 401, 403, 413, 429, 503},
+	},
+	"PATCH /images:batch": {
+		summary:     "Replace the release notes of image entries in bulk",
+		entitlement: fhidConfig.EntitlementImageRelease,
+		query:       []string{"Mode"},
+		body:        arraySchema(schemaRef("BatchRelease")),
+		data:        schemaRef("BatchResults"),
+		errors:      []int{400, 401, 403, 404, 413, 429, 503},
+	},
+	"GET /images/{id}": {
+		summary:      "Get an image entry",
+		entitlement:  fhidConfig.EntitlementRead,
+		optionalAuth: true,
+		data:         schemaRef("ImageQueryResults"),
+		errors:       []int{401, 403, 404, 429, 503},
+	},
+	"PATCH /images/{id}/release": {
+		summary:     "Replace the release notes of an image entry",
+		entitlement: fhidConfig.EntitlementImageRelease,
+		body:        releaseBody,
+		data:        stringSchema(),
+		errors:      []int{400, 401, 403, 404, 413, 429, 503},
+	},
+	"POST /packer/manifests": {
+		summary:     "Create an image entry from a Packer manifest and build log",
+		entitlement: fhidConfig.EntitlementImageCreate,
+		body:        packerManifestBody,
+		form: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"manifest": packerManifestBody,
+				"log":      stringSchema(),
+			},
+			"required": []string{"manifest"},
+		},
+		header: []string{idempotencyHeader},
+		data:   stringSchema(),
+		errors: []int{400, 401, 403, 409, 413, 429, 503},
+	},
+	"POST /query": {
+		summary:      "Search image entries",
+		entitlement:  fhidConfig.EntitlementRead,
+		optionalAuth: true,
+		body:         schemaRef("ImageQuery"),
+		data:         schemaRef("ImageQueryResults"),
+		errors:       []int{400, 401, 403, 413, 429, 503},
+	},
+	"GET /schemas/image": {
+		summary:  "JSON Schema for posted image entries",
+		document: "application/schema+json",
+		data:     objectSchema(),
+		errors:   []int{429},
+	},
+	"GET /serviceaccounts": {
+		summary:     "List service accounts",
+		entitlement: fhidConfig.EntitlementAdmin,
+		data:        arraySchema(schemaRef("ServiceAccount")),
+		errors:      []int{401, 403, 429, 503},
+	},
+	"POST /serviceaccounts": {
+		summary:     "Create a service account and issue its key",
+		entitlement: fhidConfig.EntitlementAdmin,
+		body:        schemaRef("ServiceAccount"),
+		data:        schemaRef("ServiceAccountKey"),
+		errors:      []int{400, 401, 403, 409, 413, 429, 503},
+	},
+	"DELETE /serviceaccounts/{name}": {
+		summary:     "Revoke a service account",
+		entitlement: fhidConfig.EntitlementAdmin,
+		data:        stringSchema(),
+		errors:      []int{401, 403, 404, 429, 503},
+	},
+	"POST /serviceaccounts/{name}/rotate": {
+		summary:     "Issue a new key for a service account",
+		entitlement: fhidConfig.EntitlementAdmin,
+		data:        schemaRef("ServiceAccountKey"),
+		errors:      []int{401, 403, 404, 429, 503},
+	},
+	"GET /openapi.json": {
+		summary:  "This document",
+		document: "application/json",
+		data:     objectSchema(),
+		errors:   []int{429},
+	},
+	"GET /healthcheck": {
+		summary: "Service health, with auth cache stats for callers with read access",
+		data:    schemaRef("Status"),
+	},
+}
+
+// openAPIDocument describes the operations rt handles. server is the
+// path the API is mounted under.
+func openAPIDocument(rt *Router, server string) map[string]interface{} {
+	rules := fhidConfig.Config.ValidationRules()
+	schemas := make(map[string]interface{})
+	for t, name := range apiComponents {
+		schemas[name] = inlineSchema(rules, t, apiComponents)
+	}
+	paths := make(map[string]interface{})
+	for _, op := range rt.operations() {
+		parts := strings.SplitN(op, " ", 2)
+		method, pattern := strings.ToLower(parts[0]), parts[1]
+		item, ok := paths[pattern].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[pattern] = item
+		}
+		item[method] = apiOperations[op].operationObject(op, pattern)
+	}
+	version := fhidConfig.Version
+	if version == "" {
+		version = "dev"
+	}
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "Fixham Harbour Image Depot",
+			"version": version,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": server}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "The request failed, see Error.Code",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": schemaRef("Envelope")},
+					},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "header",
+					"name": fhidConfig.Config.Authentication.AuthHeaderKey,
+				},
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"basic":  map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		},
+	}
+}
+
+// operationObject returns the OpenAPI operation object. Operations without
+// an entry in apiOperations are still listed so the gap shows.
+func (o *apiOperation) operationObject(op, pattern string) map[string]interface{} {
+	doc := map[string]interface{}{"operationId": op}
+	if o == nil {
+		doc["responses"] = map[string]interface{}{"default": map[string]interface{}{"$ref": "#/components/responses/Error"}}
+		return doc
+	}
+	doc["summary"] = o.summary
+	if o.deprecated {
+		doc["deprecated"] = true
+	}
+	var params []interface{}
+	for _, segment := range splitPath(pattern) {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			params = append(params, map[string]interface{}{
+				"name": segment[1 : len(segment)-1], "in": "path", "required": true, "schema": stringSchema(),
+			})
+		}
+	}
+	for _, name := range o.query {
+		params = append(params, map[string]interface{}{"name": name, "in": "query", "schema": stringSchema()})
+	}
+	for _, name := range o.header {
+		params = append(params, map[string]interface{}{"name": name, "in": "header", "schema": stringSchema()})
+	}
+	if len(params) > 0 {
+		doc["parameters"] = params
+	}
+	if o.entitlement != "" {
+		doc["description"] = "Needs the " + o.entitlement + " entitlement"
+		security := []interface{}{
+			map[string]interface{}{"apiKey": []string{}},
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"basic": []string{}},
+		}
+		if o.optionalAuth {
+			doc["description"] = "Needs the " + o.entitlement + " entitlement if reads are authenticated"
+			security = append(security, map[string]interface{}{})
+		}
+		doc["security"] = security
+	}
+	if o.body != nil {
+		content := map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": o.body},
+		}
+		if o.form != nil {
+			content["multipart/form-data"] = map[string]interface{}{"schema": o.form}
+		}
+		doc["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	}
+	contentType, schema := "application/json", map[string]interface{}{
+		"allOf": []interface{}{
+			schemaRef("Envelope"),
+			map[string]interface{}{
+				"properties": map[string]interface{}{"Data": o.data},
+				"required":   []string{"Success", "Data"},
+			},
+		},
+	}
+	if o.document != "" {
+		contentType, schema = o.document, o.data
+	}
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "Success",
+			"content": map[string]interface{}{
+				contentType: map[string]interface{}{"schema": schema},
+			},
+		},
+		"default": map[string]interface{}{"$ref": "#/components/responses/Error"},
+	}
+	errors := append([]int{}, o.errors...)
+	sort.Ints(errors)
+	for _, code := range errors {
+		responses[strconv.Itoa(code)] = map[string]interface{}{"$ref": "#/components/responses/Error"}
+	}
+	doc["responses"] = responses
+	return doc
+}
+
+// handlerOpenAPI serves the OpenAPI document for the API.
+func handlerOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, rateClassRead) {
+		return
+	}
+	// the router is mounted with StripPrefix so the prefix is only
+	// left in the original request URI
+	server := strings.SplitN(r.RequestURI, "?", 2)[0]
+	server = strings.TrimSuffix(server, r.URL.Path)
+	if server == "" {
+		server = "/"
+	}
+	writeDocument(w, r, "application/json", openAPIDocument(NewRouter(), server))
+}
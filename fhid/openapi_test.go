@@ -0,0 +1,253 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// checkSchema validates v against the parts of JSON Schema the
+// OpenAPI document uses and returns what doesn't match.
+func checkSchema(spec map[string]interface{}, schema map[string]interface{}, v interface{}, path string) (problems []string) {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		target, ok := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})[name].(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: unresolved $ref %s", path, ref)}
+		}
+		problems = append(problems, checkSchema(spec, target, v, path)...)
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range all {
+			problems = append(problems, checkSchema(spec, s.(map[string]interface{}), v, path)...)
+		}
+	}
+	if any, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, s := range any {
+			if len(checkSchema(spec, s.(map[string]interface{}), v, path)) == 0 {
+				matched = true
+			}
+		}
+		if !matched {
+			problems = append(problems, fmt.Sprintf("%s: matches none of anyOf", path))
+		}
+	}
+	if t, ok := schema["type"]; ok {
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []interface{}:
+			for _, s := range t {
+				types = append(types, s.(string))
+			}
+		}
+		matched := false
+		for _, t := range types {
+			switch v.(type) {
+			case nil:
+				matched = matched || t == "null"
+			case string:
+				matched = matched || t == "string"
+			case bool:
+				matched = matched || t == "boolean"
+			case float64:
+				f := v.(float64)
+				matched = matched || t == "number" || (t == "integer" && f == float64(int64(f)))
+			case []interface{}:
+				matched = matched || t == "array"
+			case map[string]interface{}:
+				matched = matched || t == "object"
+			}
+		}
+		if !matched {
+			return append(problems, fmt.Sprintf("%s: %v isn't %v", path, v, types))
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(v) {
+			problems = append(problems, fmt.Sprintf("%s: '%s' doesn't match %s", path, v, pattern))
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, e := range enum {
+				found = found || e == v
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s: '%s' isn't in %v", path, v, enum))
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				problems = append(problems, checkSchema(spec, items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case map[string]interface{}:
+		props, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := v[name.(string)]; !ok {
+					problems = append(problems, fmt.Sprintf("%s: missing required %s", path, name))
+				}
+			}
+		}
+		for name, value := range v {
+			prop, ok := props[name].(map[string]interface{})
+			if !ok {
+				if schema["additionalProperties"] == false {
+					problems = append(problems, fmt.Sprintf("%s: unexpected property %s", path, name))
+				}
+				continue
+			}
+			problems = append(problems, checkSchema(spec, prop, value, path+"."+name)...)
+		}
+	}
+	return problems
+}
+
+// TestOpenAPIContract runs a request against every operation in the
+// OpenAPI document and fails if a handler's status, content type or
+// body doesn't match what the document says, or if the router and the
+// document list different operations.
+func TestOpenAPIContract(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	fhidConfig.Config.Authentication.AuthEnabled = false
+
+	routed := NewRouter().operations()
+	var documented []string
+	for op := range apiOperations {
+		documented = append(documented, op)
+	}
+	sort.Strings(documented)
+	if strings.Join(routed, "\n") != strings.Join(documented, "\n") {
+		t.Fatalf("router and OpenAPI operations differ:\nrouted:\n%s\ndocumented:\n%s",
+			strings.Join(routed, "\n"), strings.Join(documented, "\n"))
+	}
+
+	router := http.StripPrefix("/v1.0", NewRouter())
+	req, err := http.NewRequest("GET", "/v1.0/openapi.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/v1.0/openapi.json"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var spec map[string]interface{}
+	err = json.Unmarshal(rr.Body.Bytes(), &spec)
+	if err != nil {
+		t.Fatalf("OpenAPI document isn't JSON: %s", err)
+	}
+	if spec["openapi"] != "3.1.0" {
+		t.Errorf("got openapi version %v", spec["openapi"])
+	}
+	if url := spec["servers"].([]interface{})[0].(map[string]interface{})["url"]; url != "/v1.0" {
+		t.Errorf("got server url %v, want /v1.0", url)
+	}
+	paths := spec["paths"].(map[string]interface{})
+
+	exercised := make(map[string]bool)
+	call := func(method, pattern, path, body string) *httptest.ResponseRecorder {
+		op := method + " " + pattern
+		exercised[op] = true
+		req, err := http.NewRequest(method, "/v1.0"+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RequestURI = "/v1.0" + path
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		item, ok := paths[pattern].(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s: path isn't documented", op)
+		}
+		doc, ok := item[strings.ToLower(method)].(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s: method isn't documented", op)
+		}
+		response, ok := doc["responses"].(map[string]interface{})[strconv.Itoa(rr.Code)].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: status %d isn't documented: %s", op, rr.Code, rr.Body.String())
+			return rr
+		}
+		if ref, ok := response["$ref"].(string); ok {
+			name := strings.TrimPrefix(ref, "#/components/responses/")
+			response = spec["components"].(map[string]interface{})["responses"].(map[string]interface{})[name].(map[string]interface{})
+		}
+		contentType := rr.Header().Get("Content-Type")
+		media, ok := response["content"].(map[string]interface{})[contentType].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: content type '%s' for status %d isn't documented", op, contentType, rr.Code)
+			return rr
+		}
+		var v interface{}
+		err = json.Unmarshal(rr.Body.Bytes(), &v)
+		if err != nil {
+			t.Errorf("%s: body isn't JSON: %s", op, rr.Body.String())
+			return rr
+		}
+		for _, problem := range checkSchema(spec, media["schema"].(map[string]interface{}), v, "body") {
+			t.Errorf("%s %d: %s", op, rr.Code, problem)
+		}
+		return rr
+	}
+
+	call("GET", "/healthcheck", "/healthcheck", "")
+	call("GET", "/openapi.json", "/openapi.json", "")
+	call("GET", "/schemas/image", "/schemas/image", "")
+	rr = call("POST", "/images", "/images", imageWithReleaseNotes)
+	var j imagePostResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call("POST", "/images", "/images", `{}`)
+	call("GET", "/images/{id}", "/images/"+j.Data, "")
+	call("GET", "/images/{id}", "/images/nope", "")
+	call("GET", "/images", "/images?ImageID="+j.Data, "")
+	call("GET", "/images", "/images", "")
+	call("PATCH", "/images/{id}/release", "/images/"+j.Data+"/release", imageGoodReleaseUpdate)
+	call("PATCH", "/images", "/images?ImageID="+j.Data, imageGoodReleaseUpdate)
+	call("POST", "/images:batch", "/images:batch", "["+imageGood+","+imageGood2+"]")
+	call("POST", "/images:batch", "/images:batch?Mode=besteffort", "["+imageGood+",{}]")
+	call("POST", "/images:batch", "/images:batch", "["+imageGood+",{}]")
+	call("PATCH", "/images:batch", "/images:batch", `[{"ImageID":"`+j.Data+`","ReleaseNotes":{"ReleaseNote":"GA"}}]`)
+	call("PATCH", "/images:batch", "/images:batch", `[{"ImageID":"nope","ReleaseNotes":{}}]`)
+	call("POST", "/packer/manifests", "/packer/manifests", packerManifestGood)
+	call("POST", "/packer/manifests", "/packer/manifests", `{"builds": []}`)
+	call("POST", "/query", "/query", ImageQueryBaseOS)
+	call("POST", "/query", "/query", `{"BaseOS": `)
+	call("POST", "/serviceaccounts", "/serviceaccounts", `{"Name":"ci-bot","Entitlements":["image:create"]}`)
+	call("POST", "/serviceaccounts", "/serviceaccounts", `{"Name":"ci-bot","Entitlements":["image:create"]}`)
+	call("GET", "/serviceaccounts", "/serviceaccounts", "")
+	call("POST", "/serviceaccounts/{name}/rotate", "/serviceaccounts/ci-bot/rotate", "")
+	call("DELETE", "/serviceaccounts/{name}", "/serviceaccounts/ci-bot", "")
+
+	for _, op := range routed {
+		if !exercised[op] {
+			t.Errorf("%s isn't exercised by the contract test", op)
+		}
+	}
+}
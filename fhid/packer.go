@@ -0,0 +1,210 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+)
+
+// packerManifest is the manifest.json written by Packer's manifest
+// post-processor. Builds are kept as generic objects so that
+// Packer.Mapping can point anywhere within them, custom_data included.
+type packerManifest struct {
+	Builds      []map[string]interface{} `json:"builds"`
+	LastRunUUID string                   `json:"last_run_uuid"`
+}
+
+// packerArtifactPattern matches one region:ami pair in the artifact_id
+// of an AWS builder, which lists them comma separated.
+var packerArtifactPattern = regexp.MustCompile(`^([a-z0-9-]+):(ami-[0-9a-f]+)$`)
+
+// readPackerBody splits a posted manifest from its build log. The body
+// is either the manifest on its own or a multipart form with manifest
+// and log parts.
+func readPackerBody(r *http.Request, body []byte) (manifest []byte, buildLog string, err error) {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return body, "", nil
+	}
+	form := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := form.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, "", &bodyError{fmt.Errorf("Error reading multipart body: %s", err)}
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, "", &bodyError{fmt.Errorf("Error reading multipart body: %s", err)}
+		}
+		switch part.FormName() {
+		case "manifest":
+			manifest = data
+		case "log":
+			buildLog = string(data)
+		}
+	}
+	if manifest == nil {
+		return nil, "", &bodyError{errors.New("Multipart body has no 'manifest' part")}
+	}
+	return manifest, buildLog, nil
+}
+
+// runBuilds returns the builds from the last Packer run recorded in the
+// manifest. Packer appends to the manifest on every run so older builds
+// are ignored, unless the manifest predates run UUIDs.
+func (m *packerManifest) runBuilds() []map[string]interface{} {
+	var builds []map[string]interface{}
+	for _, b := range m.Builds {
+		if m.LastRunUUID == "" || b["packer_run_uuid"] == m.LastRunUUID {
+			builds = append(builds, b)
+		}
+	}
+	if len(builds) == 0 {
+		return m.Builds
+	}
+	return builds
+}
+
+// packerValue returns the value at the dotted path within a build.
+// Numbers and booleans are formatted, anything else that isn't a string
+// is treated as missing.
+func packerValue(build map[string]interface{}, path string) string {
+	var v interface{} = build
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = obj[key]
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// entry turns the manifest into a validated entry. The AMIs of every
+// build in the last run become OutputAmis and the other fields are
+// taken from the first build with AMIs according to mapping.
+func (m *packerManifest) entry(mapping map[string]string, buildLog string) (*buildEntry, error) {
+	notes := &BuildNotes{}
+	var source map[string]interface{}
+	for _, b := range m.runBuilds() {
+		artifacts, _ := b["artifact_id"].(string)
+		for _, artifact := range strings.Split(artifacts, ",") {
+			match := packerArtifactPattern.FindStringSubmatch(strings.TrimSpace(artifact))
+			if match == nil {
+				continue
+			}
+			notes.OutputAmis = append(notes.OutputAmis, &AmiEntry{AmiID: match[2], AmiRegion: match[1]})
+			if source == nil {
+				source = b
+			}
+		}
+	}
+	if source == nil {
+		return nil, &validationError{[]*fieldError{{
+			Field:   "builds",
+			Message: "has no AMI artifacts in the last run",
+		}}}
+	}
+	if buildLog != "" {
+		for _, line := range strings.Split(strings.TrimRight(buildLog, "\r\n"), "\n") {
+			notes.BuildLog = append(notes.BuildLog, strings.TrimSuffix(line, "\r"))
+		}
+	}
+	ie := &buildEntry{BuildNotes: notes}
+	targets := map[string]*string{
+		"Version":   &ie.Version,
+		"BaseOS":    &ie.BaseOS,
+		"SourceAmi": &notes.SourceAmi,
+		"Tenant":    &ie.Tenant,
+	}
+	for field, path := range mapping {
+		if target, ok := targets[field]; ok && path != "" {
+			*target = packerValue(source, path)
+		}
+	}
+	err := validateEntry(ie, "")
+	if ve, ok := err.(*validationError); ok {
+		// point at where the field was meant to come from
+		for _, f := range ve.fields {
+			if path := mapping[strings.TrimPrefix(f.Field, "BuildNotes.")]; path != "" {
+				f.Message += fmt.Sprintf(" (mapped from '%s')", path)
+			}
+		}
+	}
+	return ie, err
+}
+
+// handlerPackerManifest creates an entry from a Packer manifest.
+func handlerPackerManifest(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, rateClassWrite) {
+		return
+	}
+	access, err := writeAccess(r, fhidConfig.EntitlementImageCreate)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	r = withPrincipal(r, access.principal)
+	if principalRateLimited(w, r, rateClassWrite) {
+		return
+	}
+	log := requestLog(r)
+	// build logs easily outgrow the limit on other bodies
+	body, ok := readBodyLimit(w, r, fhidConfig.Config.PackerMaxBodyBytes())
+	if !ok {
+		return
+	}
+	if !checkIdempotencyKey(w, r) {
+		return
+	}
+	manifest, buildLog, err := readPackerBody(r, body)
+	if err != nil {
+		writeBadBody(w, r, err)
+		return
+	}
+	var m packerManifest
+	err = json.Unmarshal(manifest, &m)
+	if err != nil {
+		writeBadBody(w, r, err)
+		return
+	}
+	image, err := m.entry(fhidConfig.Config.PackerMapping(), buildLog)
+	if err != nil {
+		writeCreateError(w, r, image, err)
+		return
+	}
+	key, replayed, err := image.writeIdempotent(r, 0, access)
+	if err != nil {
+		writeCreateError(w, r, image, err)
+		return
+	}
+	if replayed {
+		log.Info("Manifest post is a retry, returning the entry it created", "ImageID", key)
+		w.Header().Set(idempotencyReplayedHeader, "true")
+	} else {
+		log.Info("Created entry from Packer manifest", "ImageID", key, "Amis", len(image.BuildNotes.OutputAmis))
+	}
+	writeData(w, r, key)
+}
@@ -0,0 +1,207 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+)
+
+// packerManifestGood has an older run that should be ignored, and a
+// docker build in the last run that has no AMIs.
+const packerManifestGood = `{
+  "builds": [
+    {
+      "name": "amazon-ebs",
+      "builder_type": "amazon-ebs",
+      "build_time": 1517286985,
+      "artifact_id": "us-east-1:ami-0aaa1",
+      "packer_run_uuid": "5d2e6b7a-old",
+      "custom_data": {"version": "3.4.0", "base_os": "Ubuntu16.04"}
+    },
+    {
+      "name": "amazon-ebs",
+      "builder_type": "amazon-ebs",
+      "build_time": 1517373385,
+      "artifact_id": "us-east-1:ami-0abc1,us-west-2:ami-0abc2",
+      "packer_run_uuid": "9f1c2d3e-new",
+      "custom_data": {"version": "3.4.1", "base_os": "Ubuntu16.04", "source_ami": "ami-0def1", "release": 7}
+    },
+    {
+      "name": "docker",
+      "builder_type": "docker",
+      "artifact_id": "sha256:4e9f2cdf4387",
+      "packer_run_uuid": "9f1c2d3e-new"
+    },
+    {
+      "name": "amazon-ebs-gov",
+      "builder_type": "amazon-ebs",
+      "artifact_id": "us-gov-west-1:ami-0abc3",
+      "packer_run_uuid": "9f1c2d3e-new"
+    }
+  ],
+  "last_run_uuid": "9f1c2d3e-new"
+}`
+
+func postPacker(t *testing.T, contentType, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/packer/manifests", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+// packerEntry reads back the entry created by a Packer post.
+func packerEntry(t *testing.T, rr *httptest.ResponseRecorder) *buildEntry {
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	var j imagePostResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := Rget(j.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ie buildEntry
+	_, err = decodeEntry([]byte(val), &ie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ie
+}
+
+// TestPackerManifest posts Packer manifests with and without a build
+// log and with the default and a configured field mapping.
+func TestPackerManifest(t *testing.T) {
+	setupValidation(t)
+
+	ie := packerEntry(t, postPacker(t, "application/json", packerManifestGood))
+	amis := ie.BuildNotes.OutputAmis
+	if ie.Version != "3.4.1" || ie.BaseOS != "Ubuntu16.04" || ie.BuildNotes.SourceAmi != "ami-0def1" {
+		t.Errorf("unexpected entry %+v", ie)
+	}
+	if len(amis) != 3 || amis[0].AmiID != "ami-0abc1" || amis[1].AmiRegion != "us-west-2" || amis[2].AmiID != "ami-0abc3" {
+		data, _ := json.Marshal(amis)
+		t.Errorf("unexpected OutputAmis %s", data)
+	}
+	if ie.BuildNotes.BuildLog != nil {
+		t.Errorf("unexpected BuildLog %v", ie.BuildNotes.BuildLog)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("manifest", "manifest.json")
+	part.Write([]byte(packerManifestGood))
+	part, _ = form.CreateFormFile("log", "build.log")
+	part.Write([]byte("==> amazon-ebs: Creating AMI\r\n==> amazon-ebs: Done\n"))
+	form.Close()
+	ie = packerEntry(t, postPacker(t, form.FormDataContentType(), body.String()))
+	if log := ie.BuildNotes.BuildLog; len(log) != 2 || log[1] != "==> amazon-ebs: Done" {
+		t.Errorf("unexpected BuildLog %q", log)
+	}
+
+	fhidConfig.Config.Packer = &fhidConfig.Packer{Mapping: map[string]string{
+		"Version":   "custom_data.release",
+		"BaseOS":    "builder_type",
+		"SourceAmi": "",
+	}}
+	defer func() { fhidConfig.Config.Packer = nil }()
+	ie = packerEntry(t, postPacker(t, "application/json", packerManifestGood))
+	if ie.Version != "7" || ie.BaseOS != "amazon-ebs" || ie.BuildNotes.SourceAmi != "" {
+		t.Errorf("unexpected mapped entry %+v", ie)
+	}
+}
+
+// TestPackerManifestInvalid makes sure manifests that don't make a
+// valid entry are rejected with the fields at fault.
+func TestPackerManifestInvalid(t *testing.T) {
+	setupValidation(t)
+	cases := []struct {
+		name    string
+		body    string
+		mapping map[string]string
+		fields  []string
+	}{
+		{"not json", `{"builds": `, nil, nil},
+		{"no amis", `{"builds": [{"artifact_id": "sha256:4e9f2cdf4387"}]}`, nil, []string{"builds"}},
+		{"unmapped version", packerManifestGood, map[string]string{"Version": "custom_data.nope"}, []string{"Version"}},
+		{"bad region", `{"builds": [{"artifact_id": "mars-north-1:ami-0abc1", "custom_data": {"version": "1", "base_os": "x"}}]}`,
+			nil, []string{"BuildNotes.OutputAmis[0].AmiRegion"}},
+	}
+	for _, c := range cases {
+		fhidConfig.Config.Packer = &fhidConfig.Packer{Mapping: c.mapping}
+		rr := postPacker(t, "application/json", c.body)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d: %s", c.name, rr.Code, rr.Body.String())
+			continue
+		}
+		if c.fields != nil && strings.Join(fieldsOf(t, rr), ",") != strings.Join(c.fields, ",") {
+			t.Errorf("%s: got fields %v, want %v", c.name, fieldsOf(t, rr), c.fields)
+		}
+	}
+	fhidConfig.Config.Packer = &fhidConfig.Packer{Mapping: map[string]string{"Version": "custom_data.nope"}}
+	rr := postPacker(t, "application/json", packerManifestGood)
+	if !strings.Contains(rr.Body.String(), "mapped from 'custom_data.nope'") {
+		t.Errorf("error doesn't say where Version was mapped from: %s", rr.Body.String())
+	}
+	fhidConfig.Config.Packer = &fhidConfig.Packer{Mapping: map[string]string{"Verison": "custom_data.version"}}
+	if err := fhidConfig.Config.Validate(); err == nil {
+		t.Error("expected config with an unknown mapped field to be invalid")
+	}
+	fhidConfig.Config.Packer = nil
+}
+
+// TestPackerManifestRetries makes sure retried manifest posts return
+// the entry created the first time, and that manifests have their own
+// body limit.
+func TestPackerManifestRetries(t *testing.T) {
+	setupValidation(t)
+	post := func(key string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/packer/manifests", strings.NewReader(packerManifestGood))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(idempotencyHeader, key)
+		rr := httptest.NewRecorder()
+		NewRouter().ServeHTTP(rr, req)
+		return rr
+	}
+	before := indexed(t)
+	first := packerEntry(t, post("run-9f1c2d3e"))
+	rr := post("run-9f1c2d3e")
+	if retry := packerEntry(t, rr); retry.ImageID != first.ImageID {
+		t.Errorf("retry got ImageID '%s', want '%s'", retry.ImageID, first.ImageID)
+	}
+	if rr.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Error("retry isn't marked as replayed")
+	}
+	if got := indexed(t); got != before+1 {
+		t.Errorf("got %d new entries, want 1", got-before)
+	}
+	if rr := post(strings.Repeat("k", maxIdempotencyKeyLength+1)); rr.Code != http.StatusBadRequest {
+		t.Errorf("long key got status %d", rr.Code)
+	}
+
+	// the limit on other bodies doesn't apply to manifests
+	fhidConfig.Config.Validation = &fhidConfig.Validation{MaxBodyBytes: 256}
+	defer func() { fhidConfig.Config.Validation = nil }()
+	if rr := postPacker(t, "application/json", packerManifestGood); rr.Code != http.StatusOK {
+		t.Errorf("manifest over Validation.MaxBodyBytes got status %d: %s", rr.Code, rr.Body.String())
+	}
+	fhidConfig.Config.Packer = &fhidConfig.Packer{MaxBodyBytes: 256}
+	defer func() { fhidConfig.Config.Packer = nil }()
+	if rr := postPacker(t, "application/json", packerManifestGood); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("manifest over Packer.MaxBodyBytes got status %d", rr.Code)
+	}
+}
@@ -0,0 +1,80 @@
+package fhid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/inconshreveable/log15"
+
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// Auth methods that aren't provider names
+const (
+	methodAnonymous      = "anonymous"
+	methodServiceAccount = "serviceaccount"
+)
+
+// principal identifies the caller behind a request.
+type principal struct {
+	UserID string
+	// Group is the first authorized group that granted the request.
+	Group string
+	// Method is the auth provider that identified the caller.
+	Method string
+	// Token is the caller's credential as produced by redacter.
+	Token string
+	// Credential is a hash of the credential the caller presented,
+	// the same on every request made with it.
+	Credential string
+}
+
+// anonymousPrincipal is used whenever a request didn't need auth.
+func anonymousPrincipal() *principal {
+	return &principal{UserID: methodAnonymous, Method: methodAnonymous}
+}
+
+// credentialHash returns a hash of the credential a request presented:
+// the API key or bearer token, else the Basic auth user, else the
+// client certificate.
+func credentialHash(r *http.Request, authKey string) string {
+	credential := "key:" + authKey
+	if authKey == "" {
+		if user, _, ok := r.BasicAuth(); ok {
+			credential = "basic:" + user
+		} else if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			credential = "cert:" + string(r.TLS.PeerCertificates[0].Raw)
+		}
+	}
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:])
+}
+
+type principalKey struct{}
+
+// withPrincipal returns a copy of r carrying p on its context.
+func withPrincipal(r *http.Request, p *principal) *http.Request {
+	if p == nil {
+		p = anonymousPrincipal()
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// principalFrom returns the principal on the request's context, or the
+// anonymous principal if auth hasn't been checked yet.
+func principalFrom(r *http.Request) *principal {
+	p, ok := r.Context().Value(principalKey{}).(*principal)
+	if !ok {
+		return anonymousPrincipal()
+	}
+	return p
+}
+
+// requestLog returns a logger that tags every line with the request's
+// ID and principal.
+func requestLog(r *http.Request) log15.Logger {
+	p := principalFrom(r)
+	return fhidLogger.Loggo.New("RequestID", requestID(r), "Principal", p.UserID, "Group", p.Group, "AuthMethod", p.Method, "Token", p.Token)
+}
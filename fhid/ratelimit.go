@@ -0,0 +1,229 @@
+package fhid
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// Classes of request that get their own rate limit budget
+const (
+	rateClassRead  = "read"
+	rateClassQuery = "query"
+	rateClassWrite = "write"
+)
+
+// rateLimitNow is swapped out by tests.
+var rateLimitNow = time.Now
+
+// rateLimitScript takes a token from every bucket in KEYS, but only if
+// they all have one to give so a request denied by one bucket doesn't
+// drain the others. Buckets are hashes of their token count and the
+// time they were last refilled in milliseconds. ARGV is the refill
+// rate per millisecond, the burst size, the current time and the TTL
+// for idle buckets. Returns whether the request is allowed, the fewest
+// tokens left in any bucket and how many milliseconds until the
+// emptiest bucket has a token again.
+var rateLimitScript = redis.NewScript(-1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+local tokens = {}
+local allowed = 1
+for i, key in ipairs(KEYS) do
+	local state = redis.call("HMGET", key, "tokens", "ts")
+	local t = tonumber(state[1])
+	local ts = tonumber(state[2])
+	if t == nil or ts == nil then
+		t = burst
+		ts = now
+	end
+	t = math.min(burst, t + math.max(0, now - ts) * rate)
+	tokens[i] = t
+	if t < 1 then
+		allowed = 0
+	end
+end
+local remaining = burst
+for i, key in ipairs(KEYS) do
+	local t = tokens[i]
+	if allowed == 1 then
+		t = t - 1
+	end
+	redis.call("HMSET", key, "tokens", tostring(t), "ts", tostring(now))
+	redis.call("PEXPIRE", key, ttl)
+	remaining = math.min(remaining, t)
+end
+local wait = 0
+if remaining < 1 then
+	wait = math.ceil((1 - remaining) / rate)
+end
+return {allowed, math.floor(remaining), wait}
+`)
+
+// rateLimitResult is the outcome of taking a token for a request.
+type rateLimitResult struct {
+	allowed   bool
+	limit     int
+	remaining int
+	wait      time.Duration
+}
+
+// rateLimitFor returns the budget for a class of request or nil if
+// it isn't limited.
+func rateLimitFor(class string) *fhidConfig.RateLimit {
+	rl := fhidConfig.Config.RateLimits
+	if rl == nil || !rl.Enabled {
+		return nil
+	}
+	switch class {
+	case rateClassRead:
+		return rl.Read
+	case rateClassQuery:
+		return rl.Query
+	case rateClassWrite:
+		return rl.Write
+	}
+	return nil
+}
+
+// clientIP works out the address the request came from. Behind
+// proxies that's the X-Forwarded-For entry added by the outermost
+// trusted proxy, anything to the left of it came from the client and
+// can't be trusted.
+func clientIP(r *http.Request) string {
+	rl := fhidConfig.Config.RateLimits
+	if rl != nil && rl.TrustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			hops := strings.Split(fwd, ",")
+			proxies := rl.TrustedProxies
+			if proxies < 1 {
+				proxies = 1
+			}
+			// a shorter header was written entirely by our proxies
+			n := len(hops) - proxies
+			if n < 0 {
+				n = 0
+			}
+			return strings.TrimSpace(hops[n])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientRateLimitKeys returns the buckets a request draws from before
+// it's authenticated: one for the client IP and one for the API key or
+// bearer token if it sent one. Taking these first means requests with
+// bad credentials are limited before they cost a call to the auth
+// provider.
+func clientRateLimitKeys(r *http.Request, class string) []interface{} {
+	prefix := "ratelimit:" + class + ":"
+	keys := []interface{}{nsKey(prefix + "ip:" + clientIP(r))}
+	authKey := r.Header.Get(fhidConfig.Config.Authentication.AuthHeaderKey)
+	if authKey == "" {
+		authKey = bearerToken(r)
+	}
+	if authKey != "" {
+		sum := sha256.Sum256([]byte(authKey))
+		keys = append(keys, nsKey(prefix+"key:"+hex.EncodeToString(sum[:])))
+	}
+	return keys
+}
+
+// principalRateLimitKeys returns the bucket for the authenticated
+// principal, shared by all of its keys and tokens.
+func principalRateLimitKeys(r *http.Request, class string) []interface{} {
+	if p := principalFrom(r); p.Method != methodAnonymous {
+		return []interface{}{nsKey("ratelimit:" + class + ":principal:" + p.Method + ":" + p.UserID)}
+	}
+	return nil
+}
+
+// takeToken takes a token for the request from each of its buckets.
+func takeToken(keys []interface{}, limit *fhidConfig.RateLimit) (res *rateLimitResult, err error) {
+	res = &rateLimitResult{allowed: true, limit: limit.Burst, remaining: limit.Burst}
+	perMs := limit.Rate / 1000
+	ttl := int64(math.Ceil(float64(limit.Burst)/perMs)) + 1000
+	args := append([]interface{}{len(keys)}, keys...)
+	args = append(args,
+		strconv.FormatFloat(perMs, 'f', -1, 64),
+		limit.Burst,
+		rateLimitNow().UnixNano()/int64(time.Millisecond),
+		ttl)
+	vals, err := redis.Int64s(rateLimitScript.Do(Rconn.Conn, args...))
+	if err != nil {
+		return res, err
+	}
+	if len(vals) != 3 {
+		return res, fmt.Errorf("Unexpected rate limit reply %v", vals)
+	}
+	res.allowed = vals[0] == 1
+	res.remaining = int(vals[1])
+	res.wait = time.Duration(vals[2]) * time.Millisecond
+	return res, nil
+}
+
+// rateLimited takes a token for the request from the client's buckets
+// and sets the rate limit headers. It's called before authentication.
+// If the request is over its budget a 429 is sent and true is
+// returned. Errors talking to Redis let the request through.
+func rateLimited(w http.ResponseWriter, r *http.Request, class string) bool {
+	return takeRateLimit(w, r, class, clientRateLimitKeys(r, class))
+}
+
+// principalRateLimited takes a token from the authenticated principal's
+// bucket once the request has been authenticated, see rateLimited.
+func principalRateLimited(w http.ResponseWriter, r *http.Request, class string) bool {
+	return takeRateLimit(w, r, class, principalRateLimitKeys(r, class))
+}
+
+func takeRateLimit(w http.ResponseWriter, r *http.Request, class string, keys []interface{}) bool {
+	limit := rateLimitFor(class)
+	if limit == nil || len(keys) == 0 {
+		return false
+	}
+	res, err := takeToken(keys, limit)
+	if err != nil {
+		fhidLogger.Loggo.Error("Error checking rate limit, allowing request", "Class", class, "Error", err)
+		return false
+	}
+	if res.remaining < 0 {
+		res.remaining = 0
+	}
+	// the headers describe the emptiest bucket the request drew from
+	prev, err := strconv.Atoi(w.Header().Get("X-RateLimit-Remaining"))
+	if err != nil || res.remaining < prev {
+		resetSeconds := int(math.Ceil(float64(limit.Burst-res.remaining) / limit.Rate))
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(resetSeconds))
+	}
+	if res.allowed {
+		return false
+	}
+	retry := int(math.Ceil(res.wait.Seconds()))
+	if retry < 1 {
+		retry = 1
+	}
+	requestLog(r).Info("Rate limited request", "Class", class, "ClientIP", clientIP(r), "RetryAfter", retry)
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	writeError(w, r, http.StatusTooManyRequests, errCodeRateLimited,
+		fmt.Sprintf("Too many %s requests, retry after %d seconds.", class, retry))
+	return true
+}
@@ -0,0 +1,202 @@
+package fhid
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+	"github.com/jarcoal/httpmock"
+)
+
+// TestRateLimits makes sure clients are held to their budget, each
+// class of request has its own budget and buckets refill over time.
+func TestRateLimits(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	fhidConfig.Config.Authentication.AuthEnabled = false
+	fhidConfig.Config.RateLimits = &fhidConfig.RateLimits{
+		Enabled: true,
+		Query:   &fhidConfig.RateLimit{Rate: 1, Burst: 2},
+		Write:   &fhidConfig.RateLimit{Rate: 1, Burst: 5},
+	}
+	now := time.Unix(1500000000, 0)
+	rateLimitNow = func() time.Time { return now }
+	defer func() { rateLimitNow = time.Now }()
+
+	query := func(ip string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/query", bytes.NewBufferString(ImageQueryBaseOS))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = ip + ":40000"
+		rr := httptest.NewRecorder()
+		NewRouter().ServeHTTP(rr, req)
+		return rr
+	}
+	for i, want := range []string{"1", "0"} {
+		rr := query("10.0.0.1")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("query %d: got status %d, want %d", i, rr.Code, http.StatusOK)
+		}
+		if got := rr.Header().Get("X-RateLimit-Remaining"); got != want {
+			t.Errorf("query %d: got X-RateLimit-Remaining %s, want %s", i, got, want)
+		}
+		if got := rr.Header().Get("X-RateLimit-Limit"); got != "2" {
+			t.Errorf("query %d: got X-RateLimit-Limit %s, want 2", i, got)
+		}
+	}
+	rr := query("10.0.0.1")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("over budget: got status %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("over budget: got Retry-After %s, want 1", got)
+	}
+
+	// other clients and other classes of request aren't affected
+	if rr := query("10.0.0.2"); rr.Code != http.StatusOK {
+		t.Errorf("other client: got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	req, err := http.NewRequest("POST", "/images", bytes.NewBufferString(imageGood))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:40000"
+	rr = httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("write from limited client: got status %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	// the bucket refills
+	now = now.Add(time.Second)
+	if rr := query("10.0.0.1"); rr.Code != http.StatusOK {
+		t.Errorf("after refill: got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if rr := query("10.0.0.1"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("after refill budget spent: got status %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+}
+
+// TestRateLimitsBeforeAuth makes sure requests are limited by client
+// before they're authenticated, so bad credentials can't be used to
+// hammer the auth provider, and that clients can't get a fresh bucket
+// by rewriting X-Forwarded-For.
+func TestRateLimitsBeforeAuth(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	membershipCache.reset()
+	defer membershipCache.reset()
+	fhidConfig.Config.Authentication.AuthEnabled = true
+	fhidConfig.Config.Authentication.AuthNegativeCacheTTL = 0
+	fhidConfig.Config.RateLimits = &fhidConfig.RateLimits{
+		Enabled:           true,
+		Write:             &fhidConfig.RateLimit{Rate: 1, Burst: 2},
+		TrustForwardedFor: true,
+	}
+	defer func() {
+		fhidConfig.Config.RateLimits = nil
+		fhidConfig.Config.Authentication.AuthEnabled = false
+	}()
+	now := time.Unix(1500000000, 0)
+	rateLimitNow = func() time.Time { return now }
+	defer func() { rateLimitNow = time.Now }()
+	var calls int32
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "https://auth.me.com/v1.0/validmember",
+		func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			return httpmock.NewStringResponse(401, `{"Success":false}`), nil
+		})
+
+	post := func(key, forwarded string) int {
+		req, err := http.NewRequest("POST", "/images", bytes.NewBufferString(imageGood))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "10.0.0.100:40000"
+		req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, key)
+		req.Header.Set("X-Forwarded-For", forwarded)
+		rr := httptest.NewRecorder()
+		NewRouter().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	// the spoofed leftmost entry changes every time, the hop the proxy
+	// appended doesn't
+	for i := 0; i < 2; i++ {
+		forwarded := fmt.Sprintf("192.0.2.%d, 10.0.0.1", i)
+		if got := post(fmt.Sprintf("bad-key-%d", i), forwarded); got != http.StatusUnauthorized {
+			t.Errorf("request %d: got status %d, want %d", i, got, http.StatusUnauthorized)
+		}
+	}
+	before := atomic.LoadInt32(&calls)
+	if got := post("bad-key-2", "192.0.2.2, 10.0.0.1"); got != http.StatusTooManyRequests {
+		t.Errorf("over budget: got status %d, want %d", got, http.StatusTooManyRequests)
+	}
+	if got := atomic.LoadInt32(&calls); got != before {
+		t.Errorf("limited request reached the auth provider, got %d more calls", got-before)
+	}
+	// a different client behind the proxy has its own bucket
+	if got := post("bad-key-3", "10.0.0.2"); got != http.StatusUnauthorized {
+		t.Errorf("other client: got status %d, want %d", got, http.StatusUnauthorized)
+	}
+}
+
+// TestClientIP makes sure only X-Forwarded-For entries added by trusted
+// proxies are used.
+func TestClientIP(t *testing.T) {
+	fhidConfig.Config.RateLimits = &fhidConfig.RateLimits{TrustForwardedFor: true}
+	defer func() { fhidConfig.Config.RateLimits = nil }()
+	cases := []struct {
+		proxies   int
+		forwarded string
+		want      string
+	}{
+		{0, "", "10.0.0.100"},
+		{0, "192.0.2.1, 10.0.0.1", "10.0.0.1"},
+		{1, "192.0.2.1,10.0.0.1", "10.0.0.1"},
+		{2, "192.0.2.1, 10.0.0.1, 10.0.0.2", "10.0.0.1"},
+		{3, "10.0.0.1, 10.0.0.2", "10.0.0.1"},
+	}
+	for _, c := range cases {
+		fhidConfig.Config.RateLimits.TrustedProxies = c.proxies
+		req, _ := http.NewRequest("GET", "/images", nil)
+		req.RemoteAddr = "10.0.0.100:40000"
+		if c.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := clientIP(req); got != c.want {
+			t.Errorf("%d proxies, '%s': got %s, want %s", c.proxies, c.forwarded, got, c.want)
+		}
+	}
+	fhidConfig.Config.RateLimits.TrustForwardedFor = false
+	req, _ := http.NewRequest("GET", "/images", nil)
+	req.RemoteAddr = "10.0.0.100:40000"
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	if got := clientIP(req); got != "10.0.0.100" {
+		t.Errorf("untrusted header: got %s, want 10.0.0.100", got)
+	}
+}
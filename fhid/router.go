@@ -0,0 +1,154 @@
+package fhid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// route is a path pattern and the handlers for each method on it.
+// Segments wrapped in braces, such as {id}, match any single path
+// segment and are made available through pathParam.
+type route struct {
+	pattern  string
+	segments []string
+	handlers map[string]http.HandlerFunc
+}
+
+// Router dispatches requests to handlers by path and method. Paths
+// that match a route but not a method get a 405 with an Allow header
+// and OPTIONS requests are answered from the same information.
+type Router struct {
+	routes []*route
+}
+
+type pathParamsKey struct{}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// Handle registers h for method requests to pattern.
+func (rt *Router) Handle(method, pattern string, h http.HandlerFunc) {
+	segments := splitPath(pattern)
+	for _, existing := range rt.routes {
+		if strings.Join(existing.segments, "/") == strings.Join(segments, "/") {
+			existing.handlers[method] = h
+			return
+		}
+	}
+	rt.routes = append(rt.routes, &route{
+		pattern:  "/" + strings.Join(segments, "/"),
+		segments: segments,
+		handlers: map[string]http.HandlerFunc{method: h},
+	})
+}
+
+// match returns the path parameters if path matches the route.
+func (rt *route) match(path []string) (params map[string]string, ok bool) {
+	if len(path) != len(rt.segments) {
+		return nil, false
+	}
+	params = make(map[string]string)
+	for i, s := range rt.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if path[i] == "" {
+				return nil, false
+			}
+			params[s[1:len(s)-1]] = path[i]
+			continue
+		}
+		if s != path[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// allow lists the methods the route supports for the Allow header.
+func (rt *route) allow() string {
+	methods := []string{"OPTIONS"}
+	for m := range rt.handlers {
+		methods = append(methods, m)
+	}
+	if _, ok := rt.handlers["GET"]; ok {
+		methods = append(methods, "HEAD")
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(w, r)
+	path := splitPath(r.URL.Path)
+	for _, route := range rt.routes {
+		params, ok := route.match(path)
+		if !ok {
+			continue
+		}
+		method := r.Method
+		if method == "HEAD" {
+			method = "GET"
+		}
+		h, ok := route.handlers[method]
+		if !ok {
+			w.Header().Set("Allow", route.allow())
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed,
+				fmt.Sprintf("Method %s is not allowed on '%s'", r.Method, r.URL.Path))
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params)))
+		return
+	}
+	writeError(w, r, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("No resource at '%s'", r.URL.Path))
+}
+
+// operations lists every method and pattern the router handles, in
+// the form "GET /images/{id}", sorted.
+func (rt *Router) operations() []string {
+	var ops []string
+	for _, route := range rt.routes {
+		for method := range route.handlers {
+			ops = append(ops, method+" "+route.pattern)
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// pathParam returns the named path parameter of the matched route.
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+// NewRouter returns a Router serving all of the fhid resources.
+// Paths are relative so it's meant to be mounted under the API
+// version with http.StripPrefix.
+func NewRouter() *Router {
+	rt := &Router{}
+	// ?ImageID= on the collection is kept for older clients
+	rt.Handle("GET", "/images", handlerGetImage)
+	rt.Handle("POST", "/images", handlerCreateImage)
+	rt.Handle("PATCH", "/images", handlerReleaseImage)
+	rt.Handle("POST", "/images:batch", handlerCreateImages)
+	rt.Handle("PATCH", "/images:batch", handlerReleaseImages)
+	rt.Handle("GET", "/images/{id}", handlerGetImage)
+	rt.Handle("PATCH", "/images/{id}/release", handlerReleaseImage)
+	rt.Handle("POST", "/packer/manifests", handlerPackerManifest)
+	rt.Handle("POST", "/query", handlerQueryImages)
+	rt.Handle("GET", "/serviceaccounts", handlerListServiceAccounts)
+	rt.Handle("POST", "/serviceaccounts", handlerCreateServiceAccount)
+	rt.Handle("DELETE", "/serviceaccounts/{name}", handlerRevokeServiceAccount)
+	rt.Handle("POST", "/serviceaccounts/{name}/rotate", handlerRotateServiceAccount)
+	rt.Handle("GET", "/schemas/image", handlerImageSchema)
+	rt.Handle("GET", "/openapi.json", handlerOpenAPI)
+	rt.Handle("GET", "/healthcheck", HealthCheck)
+	return rt
+}
@@ -0,0 +1,74 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// TestRouter makes sure resource paths, the ImageID compatibility
+// form, 405s and OPTIONS are all handled by the router.
+func TestRouter(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	fhidConfig.Config.Authentication.AuthEnabled = false
+	router := http.StripPrefix("/v1.0", NewRouter())
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/v1.0/images", imageGood)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("create: got %d, want %d", rr.Code, http.StatusOK)
+	}
+	var j imagePostResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/v1.0/images/" + j.Data, "/v1.0/images?ImageID=" + j.Data} {
+		if rr := do("GET", path, ""); rr.Code != http.StatusOK {
+			t.Errorf("GET %s: got %d, want %d", path, rr.Code, http.StatusOK)
+		}
+	}
+	if rr := do("PATCH", "/v1.0/images/"+j.Data+"/release", imageGoodReleaseUpdate); rr.Code != http.StatusOK {
+		t.Errorf("release: got %d, want %d", rr.Code, http.StatusOK)
+	}
+	if rr := do("GET", "/v1.0/images/nope/extra/segments", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown path: got %d, want %d", rr.Code, http.StatusNotFound)
+	}
+
+	rr = do("DELETE", "/v1.0/images/"+j.Data, "")
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: got %d, want %d", rr.Code, http.StatusMethodNotAllowed)
+	}
+	if got := rr.Header().Get("Allow"); got != "GET, HEAD, OPTIONS" {
+		t.Errorf("DELETE: got Allow '%s'", got)
+	}
+	rr = do("OPTIONS", "/v1.0/images", "")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("OPTIONS: got %d, want %d", rr.Code, http.StatusNoContent)
+	}
+	if got := rr.Header().Get("Allow"); got != "GET, HEAD, OPTIONS, PATCH, POST" {
+		t.Errorf("OPTIONS: got Allow '%s'", got)
+	}
+}
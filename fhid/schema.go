@@ -0,0 +1,138 @@
+package fhid
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// currentSchemaVersion is the SchemaVersion stamped on every entry
+// written. Bump it and register a migration whenever the shape of
+// buildEntry changes.
+const currentSchemaVersion = 1
+
+// schemaMigration upgrades a raw entry from one schema version to the
+// next. It works on the generic JSON so that it can read shapes that no
+// longer fit buildEntry.
+type schemaMigration func(entry map[string]interface{}) error
+
+// schemaMigrations maps a schema version to the migration that takes an
+// entry from that version to the next one.
+var schemaMigrations = map[int]schemaMigration{
+	0: migrateSchemaV0,
+}
+
+// migrateSchemaV0 upgrades entries written before schema versions were
+// stamped. They have the same shape as version 1.
+func migrateSchemaV0(entry map[string]interface{}) error {
+	return nil
+}
+
+// schemaVersion returns the version stamped on a raw entry, entries with
+// no version are version 0.
+func schemaVersion(entry map[string]interface{}) (int, error) {
+	v, ok := entry["SchemaVersion"]
+	if !ok || v == nil {
+		return 0, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("Invalid SchemaVersion '%v'", v)
+	}
+	return int(f), nil
+}
+
+// decodeEntry unmarshals a stored entry, running any migrations needed
+// to bring it up to the current schema. Returns true if the entry was
+// migrated.
+func decodeEntry(data []byte, ie *buildEntry) (migrated bool, err error) {
+	var raw map[string]interface{}
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return migrated, err
+	}
+	version, err := schemaVersion(raw)
+	if err != nil {
+		return migrated, err
+	}
+	if version > currentSchemaVersion {
+		return migrated, fmt.Errorf("Entry schema version %d is newer than supported version %d", version, currentSchemaVersion)
+	}
+	for ; version < currentSchemaVersion; version++ {
+		migrate, ok := schemaMigrations[version]
+		if !ok {
+			return migrated, fmt.Errorf("No migration registered for schema version %d", version)
+		}
+		err = migrate(raw)
+		if err != nil {
+			return migrated, fmt.Errorf("Error migrating entry from schema version %d: %s", version, err)
+		}
+		raw["SchemaVersion"] = version + 1
+		migrated = true
+	}
+	if migrated {
+		data, err = json.Marshal(raw)
+		if err != nil {
+			return migrated, err
+		}
+	}
+	err = json.Unmarshal(data, ie)
+	return migrated, err
+}
+
+// maxMigrateAttempts is how many times MigrateSchema rereads an entry
+// that keeps changing while it's being migrated.
+const maxMigrateAttempts = 3
+
+// MigrateSchema rewrites every stored entry that's on an older schema
+// version so it no longer needs migrating on read. With dryRun set it
+// only counts the entries that need migrating.
+func MigrateSchema(dryRun bool) (migrated int, err error) {
+	keys, err := Rmembers(fhidConfig.Config.RedisImageIndexSet)
+	if err != nil {
+		return migrated, err
+	}
+	for _, key := range keys {
+		m, err := migrateEntry(key, dryRun)
+		if err != nil {
+			fhidLogger.Loggo.Error("Error migrating entry", "Key", key, "Error", err)
+			return migrated, err
+		}
+		if m {
+			migrated++
+		}
+	}
+	fhidLogger.Loggo.Info("Schema migration complete", "Migrated", migrated, "SchemaVersion", currentSchemaVersion, "DryRun", dryRun)
+	return migrated, err
+}
+
+// migrateEntry rewrites one entry if it's on an older schema version.
+// The entry is only replaced if it's unchanged since it was read, so a
+// release landing in between isn't lost. If it did change the new
+// value is migrated instead.
+func migrateEntry(key string, dryRun bool) (migrated bool, err error) {
+	for attempt := 0; attempt < maxMigrateAttempts; attempt++ {
+		val, err := Rget(key)
+		if err != nil {
+			fhidLogger.Loggo.Error("Error retrieving key for migration, skipping.", "Key", key, "Error", err)
+			return false, nil
+		}
+		var ie buildEntry
+		m, err := decodeEntry([]byte(val), &ie)
+		if err != nil || !m || dryRun {
+			return m, err
+		}
+		srep, err := json.MarshalIndent(&ie, "", "    ")
+		if err != nil {
+			return false, err
+		}
+		set, err := setIfUnchanged(nsKey(key), val, string(srep))
+		if err != nil || set {
+			return set, err
+		}
+		fhidLogger.Loggo.Info("Entry changed while migrating, rereading", "Key", key)
+	}
+	return false, fmt.Errorf("Entry '%s' kept changing while being migrated", key)
+}
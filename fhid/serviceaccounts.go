@@ -0,0 +1,365 @@
+package fhid
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// serviceKeyPrefix marks API keys issued by fhid so requiresAuth can
+// tell them apart from tokens meant for the auth provider.
+const serviceKeyPrefix = "fhid_"
+
+// serviceAccountSet is the set holding the names of all service accounts.
+const serviceAccountSet = "serviceaccounts"
+
+var serviceAccountName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+var (
+	errServiceAccountExists   = errors.New("Service account already exists")
+	errServiceAccountNotFound = errors.New("Service account not found")
+	errServiceAccountExpired  = errors.New("Service account key has expired")
+	// errServiceAccountChanged is returned when the account was
+	// rotated or revoked by someone else while it was being updated.
+	errServiceAccountChanged = errors.New("Service account was changed by another request, try again")
+	// errServiceAccountForbidden is returned when an admin tries to
+	// issue a key with access to tenants they don't administer.
+	errServiceAccountForbidden = errors.New("Not entitled to issue keys with access to these tenants")
+)
+
+// serviceAccount is a named API key managed by fhid. Entitlements and
+// Tenants work the same way as they do for an AuthGroup.
+type serviceAccount struct {
+	Name         string
+	KeyHash      string `json:",omitempty"`
+	Entitlements []string
+	Tenants      []string `json:",omitempty"`
+	// Admin accounts can act on every tenant, same as AuthGroup.Admin
+	Admin    bool   `json:",omitempty"`
+	Created  string `json:",omitempty"`
+	Rotated  string `json:",omitempty"`
+	Expires  string `json:",omitempty"`
+	LastUsed string `json:",omitempty"`
+}
+
+func serviceAccountKey(name string) string {
+	return nsKey("serviceaccount:" + name)
+}
+
+func serviceAccountUsedKey(name string) string {
+	return nsKey("serviceaccountused:" + name)
+}
+
+func serviceAccountHashKey(hash string) string {
+	return nsKey("serviceaccountkey:" + hash)
+}
+
+// newServiceKey generates a random API key and the hash it's stored under.
+func newServiceKey() (key, hash string, err error) {
+	b := make([]byte, 24)
+	_, err = rand.Read(b)
+	if err != nil {
+		return key, hash, err
+	}
+	key = serviceKeyPrefix + hex.EncodeToString(b)
+	return key, hashServiceKey(key), err
+}
+
+func hashServiceKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// validate checks the account settings supplied by an admin.
+func (sa *serviceAccount) validate() error {
+	if !serviceAccountName.MatchString(sa.Name) {
+		return fmt.Errorf("Invalid service account name '%s'", sa.Name)
+	}
+	if len(sa.Entitlements) == 0 {
+		return errors.New("Service account needs at least one entitlement")
+	}
+	for _, e := range sa.Entitlements {
+		if !fhidConfig.ValidEntitlement(e) {
+			return fmt.Errorf("Unknown entitlement '%s', must be one of %s",
+				e, strings.Join(fhidConfig.KnownEntitlements, ", "))
+		}
+	}
+	if sa.Expires != "" {
+		_, err := time.Parse(time.RFC3339, sa.Expires)
+		if err != nil {
+			return fmt.Errorf("Expires must be an RFC3339 timestamp: %s", err)
+		}
+	}
+	return nil
+}
+
+// expired returns true if the account has an expiry before now.
+func (sa *serviceAccount) expired(now time.Time) bool {
+	if sa.Expires == "" {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339, sa.Expires)
+	return err != nil || !now.Before(expires)
+}
+
+// group returns the account as an AuthGroup so it can be checked
+// and granted the same way as a configured group.
+func (sa *serviceAccount) group() *fhidConfig.AuthGroup {
+	group := &fhidConfig.AuthGroup{
+		GroupID:      "serviceaccount:" + sa.Name,
+		FriendlyName: sa.Name,
+		Tenants:      sa.Tenants,
+		Admin:        sa.Admin,
+	}
+	for _, e := range sa.Entitlements {
+		group.Entitlements = append(group.Entitlements, &fhidConfig.Entitlement{Type: e})
+	}
+	return group
+}
+
+// canManage returns true if the caller has access to every tenant the
+// account does, so admins of some tenants can't issue, see or take
+// over keys for the others.
+func (a *tenantAccess) canManage(sa *serviceAccount) bool {
+	granted := &tenantAccess{}
+	granted.grant(sa.group())
+	if granted.Admin {
+		return a.Admin
+	}
+	for _, t := range granted.Tenants {
+		if !a.allows(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// stored returns the account as it's stored, without its usage
+// timestamp.
+func (sa *serviceAccount) stored() (string, error) {
+	stored := *sa
+	stored.LastUsed = ""
+	data, err := json.Marshal(&stored)
+	return string(data), err
+}
+
+// save queues writing the account.
+func (sa *serviceAccount) save(txn *redisTxn) error {
+	data, err := sa.stored()
+	if err != nil {
+		return err
+	}
+	txn.add("SET", txnKey(serviceAccountKey(sa.Name)), data)
+	return nil
+}
+
+// CreateServiceAccount stores a new service account and returns the
+// API key issued for it. The key itself is never stored.
+func CreateServiceAccount(sa *serviceAccount) (key string, err error) {
+	err = sa.validate()
+	if err != nil {
+		return key, err
+	}
+	key, sa.KeyHash, err = newServiceKey()
+	if err != nil {
+		return key, err
+	}
+	sa.Created = time.Now().UTC().Format(time.RFC3339)
+	sa.Rotated = ""
+	sa.LastUsed = ""
+	data, err := sa.stored()
+	if err != nil {
+		return key, err
+	}
+	// the account is only written if the name is free, checked in
+	// the same step so concurrent creates can't both succeed
+	txn := &redisTxn{}
+	txn.add("SET", txnKey(serviceAccountHashKey(sa.KeyHash)), sa.Name)
+	txn.add("SADD", txnKey(nsKey(serviceAccountSet)), sa.Name)
+	existing, err := txn.execOnce(serviceAccountKey(sa.Name), data, 0)
+	if err != nil {
+		return "", err
+	}
+	if existing != "" {
+		return "", errServiceAccountExists
+	}
+	fhidLogger.Loggo.Info("Created service account", "Name", sa.Name, "Entitlements", sa.Entitlements, "Expires", sa.Expires)
+	return key, nil
+}
+
+// getServiceAccount loads a service account by name.
+func getServiceAccount(name string) (sa *serviceAccount, err error) {
+	sa, _, err = readServiceAccount(name)
+	return sa, err
+}
+
+// readServiceAccount loads a service account along with the record as
+// stored, so updates can check it hasn't changed since.
+func readServiceAccount(name string) (sa *serviceAccount, data string, err error) {
+	data, err = redis.String(Rconn.Do("GET", serviceAccountKey(name)))
+	if err == redis.ErrNil {
+		return sa, data, errServiceAccountNotFound
+	}
+	if err != nil {
+		return sa, data, err
+	}
+	sa = &serviceAccount{}
+	err = json.Unmarshal([]byte(data), sa)
+	if err != nil {
+		return sa, data, err
+	}
+	sa.LastUsed, err = redis.String(Rconn.Do("GET", serviceAccountUsedKey(name)))
+	if err == redis.ErrNil {
+		err = nil
+	}
+	return sa, data, err
+}
+
+// RotateServiceAccount issues a new key for the account, the old key
+// stops working straight away. Fails with errServiceAccountChanged if
+// the account was rotated or revoked since it was read.
+func RotateServiceAccount(name string) (key string, sa *serviceAccount, err error) {
+	sa, stored, err := readServiceAccount(name)
+	if err != nil {
+		return key, sa, err
+	}
+	oldHash := sa.KeyHash
+	key, sa.KeyHash, err = newServiceKey()
+	if err != nil {
+		return key, sa, err
+	}
+	sa.Rotated = time.Now().UTC().Format(time.RFC3339)
+	txn := &redisTxn{}
+	err = sa.save(txn)
+	if err != nil {
+		return key, sa, err
+	}
+	txn.add("DEL", txnKey(serviceAccountHashKey(oldHash)))
+	txn.add("SET", txnKey(serviceAccountHashKey(sa.KeyHash)), sa.Name)
+	applied, err := txn.execIfUnchanged(serviceAccountKey(sa.Name), stored)
+	if err != nil {
+		return "", sa, err
+	}
+	if !applied {
+		return "", sa, errServiceAccountChanged
+	}
+	fhidLogger.Loggo.Info("Rotated service account key", "Name", sa.Name)
+	return key, sa, nil
+}
+
+// RevokeServiceAccount deletes the account and its key. Fails with
+// errServiceAccountChanged if the key was rotated since it was read.
+func RevokeServiceAccount(name string) error {
+	sa, stored, err := readServiceAccount(name)
+	if err != nil {
+		return err
+	}
+	txn := &redisTxn{}
+	txn.add("DEL", txnKey(serviceAccountHashKey(sa.KeyHash)))
+	txn.add("DEL", txnKey(serviceAccountKey(sa.Name)))
+	txn.add("DEL", txnKey(serviceAccountUsedKey(sa.Name)))
+	txn.add("SREM", txnKey(nsKey(serviceAccountSet)), sa.Name)
+	applied, err := txn.execIfUnchanged(serviceAccountKey(sa.Name), stored)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return errServiceAccountChanged
+	}
+	fhidLogger.Loggo.Info("Revoked service account", "Name", sa.Name)
+	return nil
+}
+
+// ListServiceAccounts returns every service account, sorted by name,
+// without their key hashes.
+func ListServiceAccounts() (accounts []*serviceAccount, err error) {
+	names, err := redis.Strings(Rconn.Do("SMEMBERS", nsKey(serviceAccountSet)))
+	if err != nil {
+		return accounts, err
+	}
+	sort.Strings(names)
+	accounts = []*serviceAccount{}
+	for _, name := range names {
+		sa, err := getServiceAccount(name)
+		if err == errServiceAccountNotFound {
+			continue
+		}
+		if err != nil {
+			return accounts, err
+		}
+		sa.KeyHash = ""
+		accounts = append(accounts, sa)
+	}
+	return accounts, nil
+}
+
+// serviceAccountFor looks up the account that owns key and records
+// that it was used. Unknown and expired keys return an error.
+func serviceAccountFor(key string, now time.Time) (sa *serviceAccount, err error) {
+	name, err := redis.String(Rconn.Do("GET", serviceAccountHashKey(hashServiceKey(key))))
+	if err == redis.ErrNil {
+		return sa, errServiceAccountNotFound
+	}
+	if err != nil {
+		return sa, err
+	}
+	sa, err = getServiceAccount(name)
+	if err != nil {
+		return sa, err
+	}
+	// the hash key can outlive a rotation that raced with it, the
+	// account record is what says which key is current
+	if sa.KeyHash != hashServiceKey(key) {
+		return sa, errServiceAccountNotFound
+	}
+	if sa.expired(now) {
+		fhidLogger.Loggo.Info("Rejected expired service account key", "Name", sa.Name, "Expires", sa.Expires)
+		return sa, errServiceAccountExpired
+	}
+	_, err = Rconn.Do("SET", serviceAccountUsedKey(sa.Name), now.UTC().Format(time.RFC3339))
+	if err != nil {
+		fhidLogger.Loggo.Error("Error recording service account use", "Name", sa.Name, "Error", err)
+	}
+	return sa, nil
+}
+
+// serviceAccountAccess is the requiresAuth path for fhid issued keys.
+func serviceAccountAccess(r *http.Request, key, needs string) (access *tenantAccess, err error) {
+	access = &tenantAccess{}
+	sa, err := serviceAccountFor(key, time.Now())
+	if err == errServiceAccountNotFound || err == errServiceAccountExpired {
+		fhidLogger.Loggo.Info("Service account key rejected", "Key", redacter(key), "Error", err)
+		return access, errInvalidCredentials(needs)
+	}
+	if err != nil {
+		return access, errAuthUnavailable(err)
+	}
+	group := sa.group()
+	if !groupHasEntitlement(group, needs) {
+		fhidLogger.Loggo.Info("Service account lacks entitlement", "Name", sa.Name, "Entitlement", needs)
+		return access, errInsufficientEntitlement(needs)
+	}
+	fhidLogger.Loggo.Info("Match!", "ServiceAccount", sa.Name, "Entitlement", needs)
+	access.grant(group)
+	access.principal = &principal{
+		UserID:     sa.Name,
+		Group:      group.GroupID,
+		Method:     methodServiceAccount,
+		Token:      redacter(key),
+		Credential: credentialHash(r, key),
+	}
+	return access, nil
+}
@@ -0,0 +1,261 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+	"github.com/jarcoal/httpmock"
+)
+
+func serviceAccountRequest(t *testing.T, method, url, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func postImageWithKey(t *testing.T, key, body string) int {
+	req, err := http.NewRequest("POST", "/images", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, key)
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	return rr.Code
+}
+
+// TestServiceAccounts runs a service account through creation, use,
+// rotation and revocation.
+func TestServiceAccounts(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	fhidConfig.Config.Authentication.AuthEnabled = true
+	fhidConfig.Config.Authentication.AuthorizedGroups[0].Entitlements = []*fhidConfig.Entitlement{
+		{Type: fhidConfig.EntitlementAdmin},
+	}
+	membershipCache.reset()
+	defer membershipCache.reset()
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockMemberOf("g01236390")
+
+	rr := serviceAccountRequest(t, "POST", "/serviceaccounts", `{"Name":"ci-bot","Entitlements":["image:publish"]}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown entitlement: got %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	rr = serviceAccountRequest(t, "POST", "/serviceaccounts", `{"Name":"ci-bot","Entitlements":["image:create"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("create: got %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var createdResp struct{ Data serviceAccountKeyResponse }
+	err = json.Unmarshal(rr.Body.Bytes(), &createdResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := createdResp.Data
+	rr = serviceAccountRequest(t, "POST", "/serviceaccounts", `{"Name":"ci-bot","Entitlements":["image:create"]}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("duplicate create: got %d, want %d", rr.Code, http.StatusConflict)
+	}
+	if hashes, err := scanKeys(serviceAccountHashKey("*")); err != nil || len(hashes) != 1 {
+		t.Errorf("duplicate create left key mappings %v: %v", hashes, err)
+	}
+
+	if code := postImageWithKey(t, created.Key, imageGood); code != http.StatusOK {
+		t.Errorf("post with service key: got %d, want %d", code, http.StatusOK)
+	}
+	if code := postImageWithKey(t, created.Key, `{"Version":"1","BaseOS":"x","ReleaseNotes":{"ReleaseNote":"GA"}}`); code != http.StatusForbidden {
+		t.Errorf("release with service key lacking image:release: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	rr = serviceAccountRequest(t, "GET", "/serviceaccounts", "")
+	var accountsResp struct{ Data []*serviceAccount }
+	err = json.Unmarshal(rr.Body.Bytes(), &accountsResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts := accountsResp.Data
+	if len(accounts) != 1 || accounts[0].LastUsed == "" || accounts[0].KeyHash != "" {
+		t.Errorf("unexpected account listing: %s", rr.Body.String())
+	}
+
+	rr = serviceAccountRequest(t, "POST", "/serviceaccounts/ci-bot/rotate", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("rotate: got %d, want %d", rr.Code, http.StatusOK)
+	}
+	var rotatedResp struct{ Data serviceAccountKeyResponse }
+	err = json.Unmarshal(rr.Body.Bytes(), &rotatedResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := rotatedResp.Data
+	if code := postImageWithKey(t, created.Key, imageGood); code != http.StatusUnauthorized {
+		t.Errorf("post with rotated out key: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := postImageWithKey(t, rotated.Key, imageGood); code != http.StatusOK {
+		t.Errorf("post with rotated key: got %d, want %d", code, http.StatusOK)
+	}
+
+	rr = serviceAccountRequest(t, "DELETE", "/serviceaccounts/ci-bot", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("revoke: got %d, want %d", rr.Code, http.StatusOK)
+	}
+	if code := postImageWithKey(t, rotated.Key, imageGood); code != http.StatusUnauthorized {
+		t.Errorf("post with revoked key: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	rr = serviceAccountRequest(t, "DELETE", "/serviceaccounts/ci-bot", "")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("revoke twice: got %d, want %d", rr.Code, http.StatusNotFound)
+	}
+
+	// expired keys are refused
+	expired := &serviceAccount{
+		Name:         "old-bot",
+		Entitlements: []string{fhidConfig.EntitlementImageCreate},
+		Expires:      time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+	}
+	key, err := CreateServiceAccount(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := postImageWithKey(t, key, imageGood); code != http.StatusUnauthorized {
+		t.Errorf("post with expired key: got %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// managing service accounts needs admin
+	fhidConfig.Config.Authentication.AuthorizedGroups[0].Entitlements = []*fhidConfig.Entitlement{
+		{Type: fhidConfig.EntitlementWrite},
+	}
+	membershipCache.reset()
+	rr = serviceAccountRequest(t, "GET", "/serviceaccounts", "")
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("list without admin: got %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+// TestServiceAccountRotateTwice makes sure only the latest key works
+// after a run of rotations, even if a mapping for an old key was left
+// behind.
+func TestServiceAccountRotateTwice(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	first, err := CreateServiceAccount(&serviceAccount{
+		Name:         "twice-bot",
+		Entitlements: []string{fhidConfig.EntitlementImageCreate},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := RotateServiceAccount("twice-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, _, err := RotateServiceAccount("twice-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a rotation that raced with another could leave an old mapping
+	_, err = Rconn.Do("SET", serviceAccountHashKey(hashServiceKey(first)), "twice-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{first, second} {
+		if _, err := serviceAccountFor(key, time.Now()); err != errServiceAccountNotFound {
+			t.Errorf("rotated out key: got %v, want %v", err, errServiceAccountNotFound)
+		}
+	}
+	if _, err := serviceAccountFor(third, time.Now()); err != nil {
+		t.Errorf("latest key: %s", err)
+	}
+}
+
+// TestServiceAccountTenants makes sure admins of some tenants can only
+// issue, see and manage keys for those tenants.
+func TestServiceAccountTenants(t *testing.T) {
+	setupTenancy(t)
+	defer func() { fhidConfig.Config.Tenancy = nil }()
+	fhidConfig.Config.Authentication.AuthorizedGroups[0].Entitlements = []*fhidConfig.Entitlement{
+		{Type: fhidConfig.EntitlementAdmin},
+	}
+	membershipCache.reset()
+	defer membershipCache.reset()
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockMemberOf("g01236390")
+
+	cases := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"admin account", `{"Name":"root-bot","Entitlements":["image:create"],"Admin":true}`, "Admin"},
+		{"other tenant", `{"Name":"b-bot","Entitlements":["image:create"],"Tenants":["bu-a","bu-b"]}`, "Tenants"},
+		{"default tenant", `{"Name":"shared-bot","Entitlements":["image:create"]}`, "Tenants"},
+	}
+	for _, c := range cases {
+		rr := serviceAccountRequest(t, "POST", "/serviceaccounts", c.body)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s: got %d, want %d: %s", c.name, rr.Code, http.StatusForbidden, rr.Body.String())
+			continue
+		}
+		if fields := fieldsOf(t, rr); len(fields) != 1 || fields[0] != c.field {
+			t.Errorf("%s: got field errors for %v, want %s", c.name, fields, c.field)
+		}
+	}
+	rr := serviceAccountRequest(t, "POST", "/serviceaccounts", `{"Name":"a-bot","Entitlements":["image:create"],"Tenants":["bu-a"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("create in own tenant: got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	for _, sa := range []*serviceAccount{
+		{Name: "b-bot", Entitlements: []string{fhidConfig.EntitlementImageCreate}, Tenants: []string{"bu-b"}},
+		{Name: "root-bot", Entitlements: []string{fhidConfig.EntitlementImageCreate}, Admin: true},
+	} {
+		if _, err := CreateServiceAccount(sa); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rr = serviceAccountRequest(t, "GET", "/serviceaccounts", "")
+	var accountsResp struct{ Data []*serviceAccount }
+	json.Unmarshal(rr.Body.Bytes(), &accountsResp)
+	if len(accountsResp.Data) != 1 || accountsResp.Data[0].Name != "a-bot" {
+		t.Errorf("listing shows accounts outside the caller's tenants: %s", rr.Body.String())
+	}
+	for _, name := range []string{"b-bot", "root-bot"} {
+		if rr = serviceAccountRequest(t, "POST", "/serviceaccounts/"+name+"/rotate", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("rotate %s: got %d, want %d", name, rr.Code, http.StatusNotFound)
+		}
+		if rr = serviceAccountRequest(t, "DELETE", "/serviceaccounts/"+name, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("revoke %s: got %d, want %d", name, rr.Code, http.StatusNotFound)
+		}
+	}
+	if rr = serviceAccountRequest(t, "POST", "/serviceaccounts/a-bot/rotate", ""); rr.Code != http.StatusOK {
+		t.Errorf("rotate own account: got %d, want %d", rr.Code, http.StatusOK)
+	}
+}
@@ -1,26 +1,9 @@
 package fhid
 
-import (
-	"encoding/json"
-	"fmt"
-
-	"github.com/GESkunkworks/fhid/fhidConfig"
-)
-
 // status is an object to hold system status
 // to be returned by things like the healthcheck handler
 type status struct {
-	State   string `json:"State"`
-	Version string `json:"Version"`
-}
-
-// GetStatus returns the current string export of the
-// FhidStatus struct.
-func (f *status) getStatus() (msg string) {
-	b, err := json.Marshal(f)
-	if err != nil {
-		msg = fmt.Sprintf(`{"State":"Unhealthy","Version":"%s"}`, fhidConfig.Version)
-	}
-	msg = string(b)
-	return msg
+	State     string          `json:"State"`
+	Version   string          `json:"Version"`
+	AuthCache *authCacheStats `json:"AuthCache,omitempty"`
 }
@@ -0,0 +1,114 @@
+package fhid
+
+import (
+	"net/http"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+// tenantAccess describes which tenants a caller is allowed to act on
+// for a given entitlement.
+type tenantAccess struct {
+	Admin   bool
+	Tenants []string
+	// principal is the caller the access was worked out for.
+	principal *principal
+}
+
+// fullAccess returns a tenantAccess that can act on every tenant. It's
+// used whenever authentication or tenancy is disabled.
+func fullAccess() *tenantAccess {
+	return &tenantAccess{Admin: true, principal: anonymousPrincipal()}
+}
+
+// grant adds the tenants of an authorized group to the access list.
+func (a *tenantAccess) grant(group *fhidConfig.AuthGroup) {
+	if group.Admin {
+		a.Admin = true
+		return
+	}
+	if len(group.Tenants) == 0 {
+		a.Tenants = append(a.Tenants, fhidConfig.Config.DefaultTenant())
+		return
+	}
+	a.Tenants = append(a.Tenants, group.Tenants...)
+}
+
+// allows returns true if the caller may act on entries in tenant.
+func (a *tenantAccess) allows(tenant string) bool {
+	if a.Admin || !fhidConfig.Config.TenancyEnabled() {
+		return true
+	}
+	for _, t := range a.Tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultTenant picks the tenant a new entry should be written to when
+// the caller didn't specify one. Callers entitled in a single tenant
+// get that tenant, everyone else gets the configured default.
+func (a *tenantAccess) defaultTenant() string {
+	if !a.Admin && len(a.Tenants) == 1 {
+		return a.Tenants[0]
+	}
+	return fhidConfig.Config.DefaultTenant()
+}
+
+// tenant returns the tenant the entry belongs to. Entries written before
+// tenancy was enabled belong to the default tenant.
+func (i *buildEntry) tenant() string {
+	if i.Tenant == "" {
+		return fhidConfig.Config.DefaultTenant()
+	}
+	return i.Tenant
+}
+
+// readAccess works out which tenants a caller may read from on the
+// named endpoint. Anonymous reads can see every tenant, otherwise the
+// caller's read entitlements decide what they can see.
+func readAccess(r *http.Request, endpoint string) (*tenantAccess, error) {
+	if !fhidConfig.Config.Authentication.AuthEnabled {
+		return fullAccess(), nil
+	}
+	mode := fhidConfig.Config.ReadAccessFor(endpoint)
+	if mode == fhidConfig.ReadAnonymous {
+		return fullAccess(), nil
+	}
+	if mode != fhidConfig.ReadAuthenticated {
+		fhidLogger.Loggo.Error("Unknown read access mode, requiring authentication", "Endpoint", endpoint, "Mode", mode)
+	}
+	return requiresAuth(r, fhidConfig.EntitlementRead)
+}
+
+// writeAccess works out which tenants a caller may make the change
+// that needs the given entitlement in.
+func writeAccess(r *http.Request, needs string) (*tenantAccess, error) {
+	if !fhidConfig.Config.Authentication.AuthEnabled {
+		return fullAccess(), nil
+	}
+	return requiresAuth(r, needs)
+}
+
+// intersect returns the tenants both a and b can act on, for changes
+// that need more than one entitlement.
+func (a *tenantAccess) intersect(b *tenantAccess) *tenantAccess {
+	switch {
+	case a.Admin && b.Admin:
+		return &tenantAccess{Admin: true, principal: a.principal}
+	case a.Admin:
+		return b
+	case b.Admin:
+		return a
+	}
+	both := &tenantAccess{principal: a.principal}
+	for _, t := range a.Tenants {
+		if b.allows(t) {
+			both.Tenants = append(both.Tenants, t)
+		}
+	}
+	return both
+}
@@ -0,0 +1,140 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+	"github.com/jarcoal/httpmock"
+)
+
+const imageTenantA = `{"Version":"1.0.0","BaseOS":"Ubuntu16.04","Tenant":"bu-a"}`
+
+const imageTenantB = `{"Version":"1.0.0","BaseOS":"Ubuntu16.04","Tenant":"bu-b"}`
+
+const imageQueryAll = `{"BaseOS": {"StringMatch": ".*"}}`
+
+// setupTenancy enables tenancy and scopes the write group to bu-a and
+// the read group to bu-a and bu-b.
+func setupTenancy(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	fhidConfig.Config.Tenancy = &fhidConfig.Tenancy{Enabled: true, DefaultTenant: "shared"}
+	fhidConfig.Config.Authentication.AuthorizedGroups[0].Tenants = []string{"bu-a"}
+	fhidConfig.Config.Authentication.AuthorizedGroups[1].Tenants = []string{"bu-a", "bu-b"}
+}
+
+// mockMemberOf fakes a Gaudi that only reports membership of groupID.
+func mockMemberOf(groupID string) {
+	httpmock.RegisterResponder("GET", "https://auth.me.com/v1.0/validmember",
+		func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get(fhidConfig.Config.Authentication.AuthHeaderGroup) == groupID {
+				return httpmock.NewStringResponse(200, `{"Success":true}`), nil
+			}
+			return httpmock.NewStringResponse(401, `{"Success":false}`), nil
+		})
+}
+
+func postImage(t *testing.T, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/images", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+// TestTenantWrite makes sure writers can only post into their
+// own tenants and that entries default to the writer's tenant.
+func TestTenantWrite(t *testing.T) {
+	setupTenancy(t)
+	fhidConfig.Config.Authentication.AuthEnabled = true
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockMemberOf("g01236390")
+
+	rr := postImage(t, imageTenantB)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code. Got %d, Want %d", rr.Code, http.StatusForbidden)
+	}
+	rr = postImage(t, `{"Version":"1.0.0","BaseOS":"Ubuntu16.04"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code. Got %d, Want %d", rr.Code, http.StatusOK)
+	}
+	var j imagePostResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Rget(j.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ie buildEntry
+	err = json.Unmarshal([]byte(data), &ie)
+	if err != nil || ie.Tenant != "bu-a" {
+		t.Errorf("entry written to wrong tenant. Got '%s', Want 'bu-a'", ie.Tenant)
+	}
+}
+
+// TestTenantRead makes sure GETs and queries only return entries in
+// the caller's tenants.
+func TestTenantRead(t *testing.T) {
+	setupTenancy(t)
+	fhidConfig.Config.Authentication.AuthEnabled = false
+	postImage(t, imageTenantA)
+	rr := postImage(t, imageTenantB)
+	var j imagePostResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fhidConfig.Config.Authentication.AuthEnabled = true
+	fhidConfig.Config.Authentication.AuthorizedGroups[1].Tenants = []string{"bu-a"}
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockMemberOf("g00919618")
+
+	req, err := http.NewRequest("POST", "/query", bytes.NewBufferString(imageQueryAll))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
+	rr = httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	var resp imageQueryResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := resp.Data
+	if len(results.Results) != 1 || results.Results[0].Tenant != "bu-a" {
+		t.Errorf("query returned entries outside of caller's tenants: %+v", results.Results)
+	}
+
+	req, err = http.NewRequest("GET", fmt.Sprintf("/images?ImageID=%s", j.Data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(fhidConfig.Config.Authentication.AuthHeaderKey, "12345")
+	rr = httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code. Got %d, Want %d", rr.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,80 @@
+package fhid
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+)
+
+// TLSConfig builds the server TLS settings from the config, including
+// client certificate verification when a ClientCAFile is set.
+func TLSConfig() (*tls.Config, error) {
+	c := fhidConfig.Config.TLS
+	if c == nil || c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("TLS needs both a CertFile and a KeyFile")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile == "" {
+		return tc, nil
+	}
+	b, err := ioutil.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("No certificates found in ClientCAFile '%s'", c.ClientCAFile)
+	}
+	tc.ClientCAs = pool
+	switch c.ClientAuth {
+	case "", fhidConfig.ClientCertOptional:
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	case fhidConfig.ClientCertRequire:
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Unknown ClientAuth '%s'", c.ClientAuth)
+	}
+	return tc, nil
+}
+
+// clientCertAuthenticator maps a verified client certificate onto the
+// authorization groups. The certificate's subject common name is the
+// identity and its SANs are aliases, either can be listed in a group's
+// Members with the "cert:" prefix.
+type clientCertAuthenticator struct{}
+
+func (c *clientCertAuthenticator) Name() string {
+	return fhidConfig.ProviderClientCert
+}
+
+// hasCredentials returns true if the request came with a client
+// certificate that verified against the configured CAs.
+func (c *clientCertAuthenticator) hasCredentials(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0
+}
+
+func (c *clientCertAuthenticator) Memberships(r *http.Request, groups []*fhidConfig.AuthGroup) ([]bool, string, error) {
+	if !c.hasCredentials(r) {
+		return make([]bool, len(groups)), "", nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	id := &identity{Prefix: fhidConfig.MemberClientCert, Name: cert.Subject.CommonName}
+	id.Aliases = append(id.Aliases, cert.DNSNames...)
+	id.Aliases = append(id.Aliases, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		id.Aliases = append(id.Aliases, u.String())
+	}
+	return id.memberships(groups)
+}
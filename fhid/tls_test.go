@@ -0,0 +1,135 @@
+package fhid
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+)
+
+// testCert is a generated certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// makeCert generates a certificate from template signed by parent, or
+// self signed if parent is nil.
+func makeCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	b, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+}
+
+// TestClientCertAuth serves the handlers over TLS and makes sure a
+// verified client certificate is mapped to groups by its SAN.
+func TestClientCertAuth(t *testing.T) {
+	ca := makeCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fhid test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := makeCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "fhid"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	builder := makeCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "build-agent-01"},
+		DNSNames:     []string{"builders.me.com"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	stranger := makeCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "someone"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	caFile := writeTempFile(t, ca.certPEM())
+	certFile := writeTempFile(t, server.certPEM())
+	keyFile := writeTempFile(t, server.keyPEM(t))
+	defer os.Remove(caFile)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	setupProvider(t, fhidConfig.ProviderGaudi, func(a *fhidConfig.Authentication) {
+		fhidConfig.Config.TLS = &fhidConfig.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}
+		a.AuthorizedGroups[0].Members = []string{"cert:builders.me.com"}
+	})
+	tlsConfig, err := TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(NewRouter())
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	post := func(client *testCert) int {
+		tc := &tls.Config{RootCAs: roots}
+		if client != nil {
+			tc.Certificates = []tls.Certificate{{Certificate: [][]byte{client.der}, PrivateKey: client.key}}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+		resp, err := c.Post(srv.URL+"/images", "application/json", bytes.NewBufferString(imageGood))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Gaudi isn't mocked so these only pass if the certificate is used
+	if code := post(builder); code != http.StatusOK {
+		t.Errorf("builder certificate: got status %d want %d", code, http.StatusOK)
+	}
+	if code := post(stranger); code != http.StatusForbidden {
+		t.Errorf("unmapped certificate: got status %d want %d", code, http.StatusForbidden)
+	}
+}
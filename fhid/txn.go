@@ -0,0 +1,209 @@
+package fhid
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// errTxnFailed is matched, with errors.Is, by every error returned when
+// a batch of writes could not be applied to Redis.
+var errTxnFailed = errors.New("Write to database failed")
+
+// txnError is returned when a batch of writes fails. It matches
+// errTxnFailed and unwraps to the Redis error.
+type txnError struct {
+	err error
+}
+
+func (e *txnError) Error() string {
+	return fmt.Sprintf("%s: %s", errTxnFailed, e.err)
+}
+
+// Is reports whether target is errTxnFailed.
+func (e *txnError) Is(target error) bool {
+	return target == errTxnFailed
+}
+
+func (e *txnError) Unwrap() error {
+	return e.err
+}
+
+// txnKey marks an argument to redisTxn.add as a key, so it's passed to
+// the script in KEYS as Redis Cluster and script effects replication
+// need.
+type txnKey string
+
+// txnDispatch is the Lua that applies a flattened list of commands,
+// starting from KEYS[k] and ARGV[i], and returns how many it ran. Each
+// command in ARGV is prefixed with a spec with one letter per
+// argument, 'k' for the next of KEYS and 'v' for the next of ARGV.
+const txnDispatch = `
+local n = 0
+while i <= #ARGV do
+	local spec = ARGV[i]
+	i = i + 1
+	local call = {}
+	for j = 1, #spec do
+		if string.sub(spec, j, j) == 'k' then
+			call[j] = KEYS[k]
+			k = k + 1
+		else
+			call[j] = ARGV[i]
+			i = i + 1
+		end
+	end
+	redis.call(unpack(call))
+	n = n + 1
+end
+return n
+`
+
+// txnScript applies a flattened list of commands in a single script
+// call. Lua scripts run without interleaving other clients so it's
+// safe to use on the shared package connection where MULTI/EXEC would
+// not be. There's no rollback though, if a command fails partway the
+// ones before it stay applied.
+var txnScript = redis.NewScript(-1, `
+local k = 1
+local i = 1
+`+txnDispatch)
+
+// redisTxn holds a set of write commands that should be applied to
+// Redis in one step, without other clients' commands in between.
+type redisTxn struct {
+	keys []interface{}
+	args []interface{}
+	cmds int
+}
+
+// add queues a command and its arguments for the transaction. Keys
+// must be passed as txnKey.
+func (t *redisTxn) add(cmd string, args ...interface{}) {
+	spec := []string{"v"}
+	values := []interface{}{cmd}
+	for _, arg := range args {
+		if key, ok := arg.(txnKey); ok {
+			spec = append(spec, "k")
+			t.keys = append(t.keys, string(key))
+			continue
+		}
+		spec = append(spec, "v")
+		values = append(values, arg)
+	}
+	t.args = append(t.args, strings.Join(spec, ""))
+	t.args = append(t.args, values...)
+	t.cmds++
+}
+
+// exec runs all of the queued commands in one script call and returns
+// a *txnError if any of them fail. Commands before the one that failed
+// stay applied.
+func (t *redisTxn) exec() error {
+	if t.cmds == 0 {
+		return nil
+	}
+	args := append([]interface{}{len(t.keys)}, t.keys...)
+	n, err := redis.Int(txnScript.Do(Rconn.Conn, append(args, t.args...)...))
+	if err != nil {
+		return &txnError{err}
+	}
+	if n != t.cmds {
+		return &txnError{fmt.Errorf("applied %d of %d commands", n, t.cmds)}
+	}
+	return nil
+}
+
+// onceScript is txnScript guarded by KEYS[1]. If the key exists its
+// value is returned and nothing is written, otherwise it's set to
+// ARGV[1], expiring after ARGV[2] seconds unless that's 0, along with
+// the commands in the rest of KEYS and ARGV.
+var onceScript = redis.NewScript(-1, `
+local existing = redis.call('GET', KEYS[1])
+if existing then
+	return existing
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2])
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+local k = 2
+local i = 3
+`+txnDispatch)
+
+// execOnce runs the queued commands unless key exists, setting key to
+// value with an expiry of ttl seconds, or none if ttl is 0, in the
+// same step. If key already exists its value is returned and nothing
+// is written.
+func (t *redisTxn) execOnce(key, value string, ttl int) (existing string, err error) {
+	args := append([]interface{}{len(t.keys) + 1, key}, t.keys...)
+	args = append(args, value, ttl)
+	reply, err := onceScript.Do(Rconn.Conn, append(args, t.args...)...)
+	if err != nil {
+		return "", &txnError{err}
+	}
+	switch reply := reply.(type) {
+	case []byte:
+		return string(reply), nil
+	case int64:
+		if int(reply) != t.cmds {
+			return "", &txnError{fmt.Errorf("applied %d of %d commands", reply, t.cmds)}
+		}
+		return "", nil
+	}
+	return "", &txnError{fmt.Errorf("unexpected reply %v", reply)}
+}
+
+// casScript sets KEYS[1] to ARGV[2] only if it still holds ARGV[1].
+// Returns 1 if it was set.
+var casScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 1
+`)
+
+// setIfUnchanged replaces the value of key with value as long as it
+// still holds old, so a write that landed since old was read isn't
+// lost. Returns false if the key had changed.
+func setIfUnchanged(key, old, value string) (bool, error) {
+	set, err := redis.Bool(casScript.Do(Rconn.Conn, key, old, value))
+	if err != nil {
+		return false, &txnError{err}
+	}
+	return set, nil
+}
+
+// guardedScript is txnScript guarded by KEYS[1]. The commands in the
+// rest of KEYS and ARGV only run if KEYS[1] still holds ARGV[1],
+// otherwise nothing is written and -1 is returned.
+var guardedScript = redis.NewScript(-1, `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return -1
+end
+local k = 2
+local i = 2
+`+txnDispatch)
+
+// execIfUnchanged runs the queued commands only if key still holds
+// old, checked in the same step. Returns false, without writing
+// anything, if the key had changed.
+func (t *redisTxn) execIfUnchanged(key, old string) (bool, error) {
+	args := append([]interface{}{len(t.keys) + 1, key}, t.keys...)
+	args = append(args, old)
+	n, err := redis.Int(guardedScript.Do(Rconn.Conn, append(args, t.args...)...))
+	if err != nil {
+		return false, &txnError{err}
+	}
+	if n == -1 {
+		return false, nil
+	}
+	if n != t.cmds {
+		return false, &txnError{fmt.Errorf("applied %d of %d commands", n, t.cmds)}
+	}
+	return true, nil
+}
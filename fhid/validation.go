@@ -0,0 +1,464 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+)
+
+// Posted entries are checked against the validate tags on buildEntry
+// and the types it's made of. A tag is a comma separated list of:
+//
+//	required     the field must be set
+//	readonly     the field is set by fhid, anything posted is replaced
+//	ami          an AMI ID such as ami-0abc123
+//	region       one of Validation.Regions, or any region name if
+//	             it's empty
+//	releasedate  a time in Validation.ReleaseDateFormat
+//	provider     one of KnownArtifactProviders
+//	for=<p>      the field only applies when the struct's Provider is p,
+//	             required and the other rules are only checked then
+//
+// and the identifier formats uuid, azureid, galleryversion, selflink
+// and digest.
+//
+// The same tags generate the JSON Schema served at /schemas/image so
+// the two can't disagree.
+
+// amiPattern is the format of an AMI ID.
+var amiPattern = regexp.MustCompile(`^ami-[0-9a-f]+$`)
+
+// regionPattern is the format of a region name, used when
+// Validation.Regions is empty.
+var regionPattern = regexp.MustCompile(fhidConfig.DefaultRegionPattern)
+
+// fieldRule is a validate tag for string fields. check returns what's
+// wrong with a value or an empty string if it's fine, it's only called
+// for non-empty values. schema adds the rule to the field's JSON Schema.
+type fieldRule struct {
+	check  func(rules *fhidConfig.Validation, value string) string
+	schema func(rules *fhidConfig.Validation, prop map[string]interface{})
+}
+
+// patternRule returns a rule that values must match re.
+func patternRule(re *regexp.Regexp) *fieldRule {
+	return &fieldRule{
+		check: func(rules *fhidConfig.Validation, value string) string {
+			if !re.MatchString(value) {
+				return fmt.Sprintf("must match %s", re)
+			}
+			return ""
+		},
+		schema: func(rules *fhidConfig.Validation, prop map[string]interface{}) {
+			prop["pattern"] = re.String()
+		},
+	}
+}
+
+var fieldRules = map[string]*fieldRule{
+	"ami":            patternRule(amiPattern),
+	"uuid":           patternRule(uuidPattern),
+	"azureid":        patternRule(azureIDPattern),
+	"galleryversion": patternRule(galleryVersionPattern),
+	"selflink":       patternRule(selfLinkPattern),
+	"digest":         patternRule(digestPattern),
+	"provider": {
+		check: func(rules *fhidConfig.Validation, value string) string {
+			for _, p := range KnownArtifactProviders {
+				if value == p {
+					return ""
+				}
+			}
+			return fmt.Sprintf("must be one of %s", strings.Join(KnownArtifactProviders, ", "))
+		},
+		schema: func(rules *fhidConfig.Validation, prop map[string]interface{}) {
+			prop["enum"] = KnownArtifactProviders
+		},
+	},
+	"region": {
+		check: func(rules *fhidConfig.Validation, value string) string {
+			if len(rules.Regions) == 0 {
+				return patternRule(regionPattern).check(rules, value)
+			}
+			for _, region := range rules.Regions {
+				if value == region {
+					return ""
+				}
+			}
+			return fmt.Sprintf("must be one of %s", strings.Join(rules.Regions, ", "))
+		},
+		schema: func(rules *fhidConfig.Validation, prop map[string]interface{}) {
+			if len(rules.Regions) == 0 {
+				patternRule(regionPattern).schema(rules, prop)
+				return
+			}
+			prop["enum"] = rules.Regions
+		},
+	},
+	"releasedate": {
+		check: func(rules *fhidConfig.Validation, value string) string {
+			if _, err := time.Parse(rules.ReleaseDateFormat, value); err != nil {
+				return fmt.Sprintf("must be formatted as '%s'", rules.ReleaseDateFormat)
+			}
+			return ""
+		},
+		schema: func(rules *fhidConfig.Validation, prop map[string]interface{}) {
+			prop["description"] = fmt.Sprintf("Formatted as '%s'", rules.ReleaseDateFormat)
+			if pattern := layoutPattern(rules.ReleaseDateFormat); pattern != "" {
+				prop["pattern"] = pattern
+			}
+		},
+	},
+}
+
+// validationError lists every field of a body that broke a rule.
+type validationError struct {
+	fields []*fieldError
+}
+
+func (e *validationError) Error() string {
+	msgs := make([]string, 0, len(e.fields))
+	for _, f := range e.fields {
+		msgs = append(msgs, f.Field+" "+f.Message)
+	}
+	return "Invalid entry: " + strings.Join(msgs, "; ")
+}
+
+// bodyError is returned when a body can't be decoded at all.
+type bodyError struct {
+	err error
+}
+
+func (e *bodyError) Error() string {
+	return e.err.Error()
+}
+
+// decodeBody unmarshals a request body into v. In strict mode fields
+// that v doesn't have are rejected rather than dropped.
+func decodeBody(body []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if fhidConfig.Config.ValidationRules().Strict {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(v)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("unexpected end of JSON input")
+	}
+	if err != nil {
+		return &bodyError{err}
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		return &bodyError{fmt.Errorf("unexpected data after the end of the body")}
+	}
+	return nil
+}
+
+// validateEntry checks v, a buildEntry or one of its parts, against the
+// validate tags of its type. path is prefixed to the field names in the
+// returned validationError.
+func validateEntry(v interface{}, path string) error {
+	fields := validateValue(fhidConfig.Config.ValidationRules(), reflect.ValueOf(v), path)
+	if len(fields) > 0 {
+		return &validationError{fields}
+	}
+	return nil
+}
+
+func validateValue(rules *fhidConfig.Validation, v reflect.Value, path string) (fields []*fieldError) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			fields = validateValue(rules, v.Elem(), path)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			fields = append(fields, validateValue(rules, v.Index(i), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := jsonName(f)
+			if name == "" {
+				continue
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			fv := v.Field(i)
+			tags := validateTags(f)
+			if tags["readonly"] {
+				continue
+			}
+			if p := forProvider(tags); p != "" {
+				provider := v.FieldByName("Provider").String()
+				if provider != p {
+					if provider != "" && !isEmpty(fv) {
+						fields = append(fields, &fieldError{Field: name, Message: fmt.Sprintf("is only used for %s artifacts", p)})
+					}
+					continue
+				}
+			}
+			if isEmpty(fv) {
+				if tags["required"] {
+					fields = append(fields, &fieldError{Field: name, Message: "is required"})
+				}
+				continue
+			}
+			if fv.Kind() == reflect.String {
+				for tag := range tags {
+					if rule, ok := fieldRules[tag]; ok {
+						if msg := rule.check(rules, fv.String()); msg != "" {
+							fields = append(fields, &fieldError{Field: name, Message: msg})
+						}
+					}
+				}
+				continue
+			}
+			fields = append(fields, validateValue(rules, fv, name)...)
+		}
+	}
+	return fields
+}
+
+// jsonName returns the name a field has in JSON or an empty string if
+// it isn't serialized.
+func jsonName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		name = f.Name
+	}
+	return name
+}
+
+func validateTags(f reflect.StructField) map[string]bool {
+	tags := make(map[string]bool)
+	for _, tag := range strings.Split(f.Tag.Get("validate"), ",") {
+		if tag != "" {
+			tags[tag] = true
+		}
+	}
+	return tags
+}
+
+// forProvider returns p from a for=<p> tag, or an empty string.
+func forProvider(tags map[string]bool) string {
+	for tag := range tags {
+		if strings.HasPrefix(tag, "for=") {
+			return strings.TrimPrefix(tag, "for=")
+		}
+	}
+	return ""
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// entrySchema returns the JSON Schema for posted entries.
+func entrySchema() map[string]interface{} {
+	rules := fhidConfig.Config.ValidationRules()
+	schema := typeSchema(rules, reflect.TypeOf(buildEntry{}), nil)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "Image entry"
+	return schema
+}
+
+// typeSchema returns the JSON Schema for values of type t. Types named
+// in refs are referenced as OpenAPI components rather than inlined.
+func typeSchema(rules *fhidConfig.Validation, t reflect.Type, refs map[reflect.Type]string) map[string]interface{} {
+	if name, ok := refs[t]; ok {
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return inlineSchema(rules, t, refs)
+}
+
+// inlineSchema is typeSchema without the lookup in refs for t itself,
+// used to build the components that are referenced.
+func inlineSchema(rules *fhidConfig.Validation, t reflect.Type, refs map[reflect.Type]string) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := typeSchema(rules, t.Elem(), refs)
+		if _, ok := schema["$ref"]; ok {
+			return map[string]interface{}{
+				"anyOf": []interface{}{schema, map[string]interface{}{"type": "null"}},
+			}
+		}
+		schema["type"] = []string{schema["type"].(string), "null"}
+		return schema
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  []string{"array", "null"},
+			"items": typeSchema(rules, t.Elem(), refs),
+		}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		required := []string{}
+		// fields only required for a provider, by provider
+		requiredFor := make(map[string][]string)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := jsonName(f)
+			if name == "" {
+				continue
+			}
+			prop := typeSchema(rules, f.Type, refs)
+			tags := validateTags(f)
+			provider := forProvider(tags)
+			if provider != "" {
+				prop["description"] = fmt.Sprintf("Only for %s artifacts", provider)
+				if tags["required"] {
+					requiredFor[provider] = append(requiredFor[provider], name)
+					delete(tags, "required")
+				}
+			}
+			for tag := range tags {
+				switch tag {
+				case "readonly":
+					prop["readOnly"] = true
+				case "required":
+					required = append(required, name)
+					if f.Type.Kind() == reflect.String {
+						prop["minLength"] = 1
+					}
+				default:
+					if rule, ok := fieldRules[tag]; ok {
+						rule.schema(rules, prop)
+					}
+				}
+			}
+			// rules only apply to values that are set
+			if !tags["required"] {
+				if pattern, ok := prop["pattern"].(string); ok {
+					prop["pattern"] = "^$|" + pattern
+				}
+				if enum, ok := prop["enum"].([]string); ok {
+					prop["enum"] = append([]string{""}, enum...)
+				}
+			}
+			props[name] = prop
+		}
+		schema := map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		var conditions []interface{}
+		for _, provider := range KnownArtifactProviders {
+			if names, ok := requiredFor[provider]; ok {
+				conditions = append(conditions, map[string]interface{}{
+					"if": map[string]interface{}{
+						"properties": map[string]interface{}{"Provider": map[string]interface{}{"const": provider}},
+						"required":   []string{"Provider"},
+					},
+					"then": map[string]interface{}{"required": names},
+				})
+			}
+		}
+		if len(conditions) > 0 {
+			schema["allOf"] = conditions
+		}
+		if rules.Strict {
+			schema["additionalProperties"] = false
+		}
+		return schema
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+// layoutPattern turns a numeric Go time layout into a regular
+// expression. Layouts with month or day names, zones and the like
+// can't be expressed simply so an empty string is returned for them.
+func layoutPattern(layout string) string {
+	tokens := []struct{ layout, pattern string }{
+		{"2006", "[0-9]{4}"},
+		{"01", "[0-9]{2}"},
+		{"02", "[0-9]{2}"},
+		{"15", "[0-9]{2}"},
+		{"04", "[0-9]{2}"},
+		{"05", "[0-9]{2}"},
+	}
+	pattern := "^"
+	for len(layout) > 0 {
+		matched := false
+		for _, tok := range tokens {
+			if strings.HasPrefix(layout, tok.layout) {
+				pattern += tok.pattern
+				layout = layout[len(tok.layout):]
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		c := layout[0]
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z' && c != 'T') {
+			return ""
+		}
+		pattern += regexp.QuoteMeta(string(c))
+		layout = layout[1:]
+	}
+	return pattern + "$"
+}
+
+// readBody reads the request body, up to Validation.MaxBodyBytes of
+// it. If it returns false a response has already been sent.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	return readBodyLimit(w, r, fhidConfig.Config.ValidationRules().MaxBodyBytes)
+}
+
+// readBodyLimit reads up to limit bytes of the request body, see
+// readBody.
+func readBodyLimit(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Error reading body: %s", err))
+		return nil, false
+	}
+	if int64(len(body)) > limit {
+		writeError(w, r, http.StatusRequestEntityTooLarge, errCodeTooLarge,
+			fmt.Sprintf("Request body is larger than %d bytes", limit))
+		return nil, false
+	}
+	return body, true
+}
+
+// handlerImageSchema serves the JSON Schema for posted entries.
+func handlerImageSchema(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, rateClassRead) {
+		return
+	}
+	writeDocument(w, r, "application/schema+json", entrySchema())
+}
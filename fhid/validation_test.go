@@ -0,0 +1,215 @@
+package fhid
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidLogger"
+)
+
+func setupValidation(t *testing.T) {
+	initLog()
+	addr, err := runFakeRedis()
+	fhidLogger.Loggo.Info("Done starting fake Redis.")
+	if err != nil {
+		t.Errorf("Unable to start fake Redis for testing: %s", err)
+	}
+	err = setup(true, addr)
+	if err != nil {
+		t.Fatalf("Unable to connect to fake Redis for testing: %s", err)
+	}
+	fhidConfig.Config.Authentication.AuthEnabled = false
+}
+
+// fieldsOf returns the names of the fields reported in an error
+// envelope.
+func fieldsOf(t *testing.T, rr *httptest.ResponseRecorder) []string {
+	var env envelope
+	err := json.Unmarshal(rr.Body.Bytes(), &env)
+	if err != nil || env.Error == nil {
+		t.Fatalf("body isn't an error envelope: %s", rr.Body.String())
+	}
+	var names []string
+	for _, f := range env.Error.Fields {
+		names = append(names, f.Field)
+	}
+	return names
+}
+
+// TestValidation makes sure posted entries are checked against the
+// validate tags and every broken rule is reported.
+func TestValidation(t *testing.T) {
+	setupValidation(t)
+	cases := []struct {
+		name   string
+		body   string
+		status int
+		fields []string
+	}{
+		{"empty", `{}`, http.StatusBadRequest, []string{"Version", "BaseOS"}},
+		{"good", imageGood, http.StatusOK, nil},
+		{"unknown fields outside strict mode", imageGood2, http.StatusOK, nil},
+		{"bad amis", `{"Version":"1","BaseOS":"x","BuildNotes":{"SourceAmi":"ami-ABC","OutputAmis":[
+			{"AmiID":"ami-12345","AmiRegion":"us-east-1"},
+			{"AmiID":"i-12345","AmiRegion":"mars-north-1"},
+			{"AmiRegion":"us-east-1"}]}}`,
+			http.StatusBadRequest, []string{
+				"BuildNotes.OutputAmis[1].AmiID",
+				"BuildNotes.OutputAmis[1].AmiRegion",
+				"BuildNotes.OutputAmis[2].AmiID",
+				"BuildNotes.SourceAmi",
+			}},
+		{"newer regions", `{"Version":"1","BaseOS":"x","BuildNotes":{"OutputAmis":[
+			{"AmiID":"ami-12345","AmiRegion":"ap-southeast-5"},
+			{"AmiID":"ami-12345","AmiRegion":"il-central-1"},
+			{"AmiID":"ami-12345","AmiRegion":"us-gov-east-1"}]}}`,
+			http.StatusOK, nil},
+		{"bad release date", `{"Version":"1","BaseOS":"x","ReleaseNotes":{"ReleaseDate":"30/01/2018"}}`,
+			http.StatusBadRequest, []string{"ReleaseNotes.ReleaseDate"}},
+		{"trailing data", `{"Version":"1","BaseOS":"x"}{}`, http.StatusBadRequest, nil},
+	}
+	for _, c := range cases {
+		rr := postImage(t, c.body)
+		if rr.Code != c.status {
+			t.Errorf("%s: got status %d, want %d: %s", c.name, rr.Code, c.status, rr.Body.String())
+			continue
+		}
+		if c.fields == nil {
+			continue
+		}
+		if got := strings.Join(fieldsOf(t, rr), ","); got != strings.Join(c.fields, ",") {
+			t.Errorf("%s: got field errors for %s, want %s", c.name, got, strings.Join(c.fields, ","))
+		}
+	}
+
+	rr := postImage(t, imageGood)
+	var j imagePostResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("PATCH", "/images/"+j.Data+"/release",
+		bytes.NewBufferString(`{"ReleaseNotes":{"ReleaseNote":"GA","ReleaseDate":"yesterday"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("patch with bad release date: got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+// TestValidationSettings makes sure strict mode, the body size limit
+// and the configured regions are honoured.
+func TestValidationSettings(t *testing.T) {
+	setupValidation(t)
+	fhidConfig.Config.Validation = &fhidConfig.Validation{Strict: true}
+	defer func() { fhidConfig.Config.Validation = nil }()
+
+	rr := postImage(t, imageGood2)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("unknown field in strict mode: got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	if got := fieldsOf(t, rr); len(got) != 1 || got[0] != "Tags" {
+		t.Errorf("unknown field in strict mode: got field errors for %v, want Tags", got)
+	}
+	if rr := postImage(t, imageGood); rr.Code != http.StatusOK {
+		t.Errorf("known fields in strict mode: got status %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	fhidConfig.Config.Validation.MaxBodyBytes = 64
+	if rr := postImage(t, imageGood); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body: got status %d, want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	fhidConfig.Config.Validation = &fhidConfig.Validation{Regions: []string{"eu-west-1"}}
+	if rr := postImage(t, imageGood); rr.Code != http.StatusBadRequest {
+		t.Errorf("region not in configured list: got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+// TestImageSchema makes sure the published JSON Schema carries the
+// same rules the server enforces.
+func TestImageSchema(t *testing.T) {
+	setupValidation(t)
+	fhidConfig.Config.Validation = &fhidConfig.Validation{Strict: true}
+	defer func() { fhidConfig.Config.Validation = nil }()
+
+	req, err := http.NewRequest("GET", "/schemas/image", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/schema+json" {
+		t.Errorf("got content type '%s'", ct)
+	}
+	var schema struct {
+		Required             []string
+		AdditionalProperties *bool `json:"additionalProperties"`
+		Properties           struct {
+			ImageID struct {
+				ReadOnly bool `json:"readOnly"`
+			}
+			BuildNotes struct {
+				Properties struct {
+					OutputAmis struct {
+						Items struct {
+							Required   []string
+							Properties struct {
+								AmiID struct {
+									Pattern string `json:"pattern"`
+								}
+								AmiRegion struct {
+									Pattern string   `json:"pattern"`
+									Enum    []string `json:"enum"`
+								}
+							} `json:"properties"`
+						} `json:"items"`
+					}
+				} `json:"properties"`
+			}
+			ReleaseNotes struct {
+				Properties struct {
+					ReleaseDate struct {
+						Pattern string `json:"pattern"`
+					}
+				} `json:"properties"`
+			}
+		} `json:"properties"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(schema.Required, ",") != "Version,BaseOS" {
+		t.Errorf("got required %v, want Version and BaseOS", schema.Required)
+	}
+	if schema.AdditionalProperties == nil || *schema.AdditionalProperties {
+		t.Error("strict mode schema should not allow additional properties")
+	}
+	if !schema.Properties.ImageID.ReadOnly {
+		t.Error("ImageID should be read only")
+	}
+	ami := schema.Properties.BuildNotes.Properties.OutputAmis.Items
+	if ami.Properties.AmiID.Pattern != amiPattern.String() {
+		t.Errorf("got AmiID pattern '%s'", ami.Properties.AmiID.Pattern)
+	}
+	if ami.Properties.AmiRegion.Pattern != regionPattern.String() || len(ami.Properties.AmiRegion.Enum) != 0 {
+		t.Errorf("got AmiRegion pattern '%s' and enum %v", ami.Properties.AmiRegion.Pattern, ami.Properties.AmiRegion.Enum)
+	}
+	date := regexp.MustCompile(schema.Properties.ReleaseNotes.Properties.ReleaseDate.Pattern)
+	if !date.MatchString("2018-01-30 04:36:25") || date.MatchString("30/01/2018") {
+		t.Errorf("ReleaseDate pattern '%s' doesn't match the default format", date)
+	}
+}
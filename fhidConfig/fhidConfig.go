@@ -2,7 +2,10 @@ package fhidConfig
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 )
 
 // Config is the exported configuration
@@ -13,12 +16,54 @@ var Config *Configuration
 // Version is globally accessible version.
 var Version string
 
+// Entitlement types that can be granted to a group
+const (
+	EntitlementRead         = "read"
+	EntitlementImageCreate  = "image:create"
+	EntitlementImageRelease = "image:release"
+	// EntitlementImageDeprecate, EntitlementImageDelete and
+	// EntitlementChannelPromote can be granted so configs can be
+	// written ahead of time, but fhid has no deprecate, delete or
+	// promote operations yet so nothing checks them.
+	EntitlementImageDeprecate = "image:deprecate"
+	EntitlementImageDelete    = "image:delete"
+	EntitlementChannelPromote = "channel:promote"
+	EntitlementAdmin          = "admin"
+	// EntitlementWrite is the legacy write entitlement, it
+	// grants image:create and image:release.
+	EntitlementWrite = "write"
+)
+
+// KnownEntitlements lists every valid Entitlement.Type
+var KnownEntitlements = []string{
+	EntitlementRead,
+	EntitlementImageCreate,
+	EntitlementImageRelease,
+	EntitlementImageDeprecate,
+	EntitlementImageDelete,
+	EntitlementChannelPromote,
+	EntitlementAdmin,
+	EntitlementWrite,
+}
+
 // Entitlement holds info about a certain
-// type of access such as read/write
+// type of access such as image:create
 type Entitlement struct {
 	Type string
 }
 
+// Grants returns true if the entitlement grants
+// the needed entitlement.
+func (e *Entitlement) Grants(needs string) bool {
+	switch e.Type {
+	case needs, EntitlementAdmin:
+		return true
+	case EntitlementWrite:
+		return needs == EntitlementImageCreate || needs == EntitlementImageRelease
+	}
+	return false
+}
+
 // AuthGroup stores a basic struct for
 // holding group names and gids that are
 // authorized to access services.
@@ -26,17 +71,255 @@ type AuthGroup struct {
 	GroupID      string
 	FriendlyName string
 	Entitlements []*Entitlement
+	// Tenants the group's entitlements apply to. If empty
+	// the group belongs to the default tenant.
+	Tenants []string
+	// Admin groups can act on entries in any tenant.
+	Admin bool
+	// Members lists identities that belong to the group when
+	// using a provider other than Gaudi. Each is qualified with
+	// the provider that authenticates it, e.g. "apikey:ci-bot",
+	// see KnownMemberPrefixes.
+	Members []string
+}
+
+// Tenancy holds settings for isolating entries
+// between tenants.
+type Tenancy struct {
+	Enabled       bool
+	DefaultTenant string
+}
+
+// Read access modes for Authentication.ReadAccess
+const (
+	ReadAnonymous     = "anonymous"
+	ReadAuthenticated = "authenticated"
+)
+
+// Names of the read endpoints as used in
+// Authentication.EndpointReadAccess
+const (
+	ReadEndpointImages = "images"
+	ReadEndpointQuery  = "query"
+)
+
+// KnownReadEndpoints lists every valid Authentication.EndpointReadAccess
+// key.
+var KnownReadEndpoints = []string{ReadEndpointImages, ReadEndpointQuery}
+
+// Authentication providers for Authentication.Provider
+const (
+	ProviderGaudi      = "gaudi"
+	ProviderAPIKeys    = "apikeys"
+	ProviderHtpasswd   = "htpasswd"
+	ProviderJWT        = "jwt"
+	ProviderClientCert = "clientcert"
+)
+
+// Prefixes of AuthGroup.Members naming the provider that authenticates
+// the identity, so the same name from two providers can't be mixed up.
+const (
+	MemberAPIKey     = "apikey:"
+	MemberHtpasswd   = "htpasswd:"
+	MemberJWT        = "jwt:"
+	MemberClientCert = "cert:"
+)
+
+// KnownMemberPrefixes lists every valid AuthGroup.Members prefix.
+var KnownMemberPrefixes = []string{MemberAPIKey, MemberHtpasswd, MemberJWT, MemberClientCert}
+
+// APIKeysProvider holds settings for authenticating
+// with static API keys.
+type APIKeysProvider struct {
+	// File is a JSON list of keys, see README.
+	File string
+}
+
+// HtpasswdProvider holds settings for authenticating
+// with HTTP Basic auth against an htpasswd file.
+type HtpasswdProvider struct {
+	File string
+}
+
+// JWTProvider holds settings for authenticating with
+// OIDC/JWT bearer tokens. If set while Provider is something
+// else bearer tokens are still validated locally and other
+// requests fall through to the Provider.
+type JWTProvider struct {
+	JWKSFile string
+	// JWKSURL is fetched at startup and every JWKSRefresh
+	// seconds, never per request.
+	JWKSURL     string
+	JWKSRefresh int
+	// JWKSTimeout is how many seconds to wait for JWKSURL.
+	// Defaults to 10.
+	JWKSTimeout int
+	// PublicKeyFiles are PEM encoded RSA or ECDSA keys.
+	PublicKeyFiles []string
+	Issuer         string
+	Audience       string
+	// ClockSkew is how many seconds of leeway to allow
+	// when checking exp and nbf.
+	ClockSkew int
+	// GroupsClaim is the claim holding the caller's groups.
+	// Defaults to groups.
+	GroupsClaim string
+	// GroupMap maps claim values to AuthGroup GroupIDs,
+	// values without a mapping are used as is.
+	GroupMap map[string]string
 }
 
 // Authentication holds info about
 // the authentication mechanisms.
 type Authentication struct {
-	AuthEnabled           bool
+	AuthEnabled bool
+	// Provider is one of gaudi, apikeys, htpasswd or jwt.
+	// Defaults to gaudi.
+	Provider              string
+	APIKeys               *APIKeysProvider
+	Htpasswd              *HtpasswdProvider
+	JWT                   *JWTProvider
 	AuthURL               string
 	AuthHeaderKey         string
 	AuthHeaderGroup       string
 	AuthMemberCheckMethod string
 	AuthorizedGroups      []*AuthGroup
+	// ReadAccess is either "anonymous" or "authenticated" and
+	// applies to every read endpoint. If empty reads are anonymous
+	// unless tenancy is enabled.
+	ReadAccess string
+	// EndpointReadAccess overrides ReadAccess for individual read
+	// endpoints, e.g. {"query": "anonymous"}.
+	EndpointReadAccess map[string]string
+	// AuthCacheTTL is how many seconds a group membership is
+	// cached for, zero disables caching.
+	AuthCacheTTL int
+	// AuthNegativeCacheTTL is how many seconds a failed group
+	// membership check is cached for, zero disables caching.
+	AuthNegativeCacheTTL int
+	// AuthCacheSize is the most membership decisions cached, the
+	// least recently used are evicted beyond it. Defaults to 10000.
+	AuthCacheSize int
+	// AuthTimeout is how many seconds to wait for all group
+	// membership checks on a request. Defaults to 10.
+	AuthTimeout int
+}
+
+// Client certificate modes for TLS.ClientAuth
+const (
+	ClientCertOptional = "optional"
+	ClientCertRequire  = "require"
+)
+
+// TLS holds settings for serving HTTPS and verifying
+// client certificates.
+type TLS struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM bundle of CAs that client
+	// certificates are verified against.
+	ClientCAFile string
+	// ClientAuth is optional or require, defaults to
+	// optional when ClientCAFile is set.
+	ClientAuth string
+}
+
+// RateLimit is a token bucket budget. Rate tokens are added
+// every second up to Burst and each request takes one.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits holds the budgets for each class of request. Every
+// API key, principal and client IP gets its own bucket per class.
+type RateLimits struct {
+	Enabled bool
+	Read    *RateLimit
+	Query   *RateLimit
+	Write   *RateLimit
+	// TrustForwardedFor takes the client IP from X-Forwarded-For,
+	// only enable it behind a proxy that sets the header.
+	TrustForwardedFor bool
+	// TrustedProxies is how many proxies in front of fhid append to
+	// X-Forwarded-For, the client IP is the entry the outermost of
+	// them added. Defaults to 1.
+	TrustedProxies int
+}
+
+// Default validation settings used when the Validation section
+// or one of its settings is missing.
+const (
+	DefaultMaxBodyBytes      = 1 << 20
+	DefaultMaxBatchItems     = 1000
+	DefaultReleaseDateFormat = "2006-01-02 15:04:05"
+)
+
+// DefaultRegionPattern is the format AWS region names must match
+// unless Validation.Regions lists the regions allowed.
+const DefaultRegionPattern = `^[a-z]{2}(-gov)?-[a-z]+-\d$`
+
+// Validation holds the rules posted entries are checked
+// against.
+type Validation struct {
+	// Strict rejects bodies with fields fhid doesn't know about.
+	Strict bool
+	// MaxBodyBytes caps the size of request bodies. Defaults
+	// to DefaultMaxBodyBytes.
+	MaxBodyBytes int64
+	// MaxBatchItems caps the number of entries in a batch request.
+	// Defaults to DefaultMaxBatchItems.
+	MaxBatchItems int
+	// Regions lists the regions AMIs may be in. If it's empty any
+	// region matching DefaultRegionPattern is allowed.
+	Regions []string
+	// ReleaseDateFormat is the Go time layout ReleaseDate must
+	// match. Defaults to DefaultReleaseDateFormat.
+	ReleaseDateFormat string
+}
+
+// DefaultPackerMapping is where entry fields are taken from in a
+// Packer manifest build unless Packer.Mapping says otherwise.
+var DefaultPackerMapping = map[string]string{
+	"Version":   "custom_data.version",
+	"BaseOS":    "custom_data.base_os",
+	"SourceAmi": "custom_data.source_ami",
+	"Tenant":    "custom_data.tenant",
+}
+
+// PackerFields are the entry fields that can be mapped from a Packer
+// manifest.
+var PackerFields = []string{"Version", "BaseOS", "SourceAmi", "Tenant"}
+
+// Packer holds how Packer manifests are turned into entries.
+type Packer struct {
+	// Mapping maps entry fields to dotted paths within a build
+	// in the manifest, e.g. "Version": "custom_data.version".
+	// Fields left out use DefaultPackerMapping, map a field to ""
+	// to leave it unset.
+	Mapping map[string]string
+	// MaxBodyBytes caps the size of posted manifests along with
+	// their build logs. Defaults to DefaultPackerMaxBodyBytes.
+	MaxBodyBytes int64
+}
+
+// DefaultPackerMaxBodyBytes is the default cap on posted manifests,
+// larger than Validation.MaxBodyBytes since it includes the build log.
+const DefaultPackerMaxBodyBytes = 32 << 20
+
+// DefaultIdempotencyWindow is how many seconds an idempotency key is
+// remembered for unless Idempotency.WindowSeconds says otherwise.
+const DefaultIdempotencyWindow = 24 * 60 * 60
+
+// Idempotency holds how retried image posts are recognised.
+type Idempotency struct {
+	// WindowSeconds is how long a post is remembered for after it's
+	// written. Defaults to DefaultIdempotencyWindow.
+	WindowSeconds int
+	// NaturalKey treats posts without an Idempotency-Key header as
+	// retries of an earlier post with the same Tenant, BaseOS,
+	// Version and SourceAmi.
+	NaturalKey bool
 }
 
 // Configuration is a struct used
@@ -44,9 +327,216 @@ type Authentication struct {
 type Configuration struct {
 	RedisEndpoint      string
 	RedisImageIndexSet string
-	ListenPort         string
-	ListenHost         string
-	Authentication     *Authentication
+	// RedisNamespace is prepended to every key fhid writes so
+	// the Redis instance can be shared with other applications.
+	RedisNamespace string
+	ListenPort     string
+	ListenHost     string
+	Authentication *Authentication
+	Tenancy        *Tenancy
+	TLS            *TLS
+	RateLimits     *RateLimits
+	Validation     *Validation
+	Packer         *Packer
+	Idempotency    *Idempotency
+}
+
+// TenancyEnabled returns true if entries should be
+// isolated by tenant.
+func (c *Configuration) TenancyEnabled() bool {
+	return c.Tenancy != nil && c.Tenancy.Enabled
+}
+
+// DefaultTenant returns the tenant that entries and groups
+// without an explicit tenant belong to.
+func (c *Configuration) DefaultTenant() string {
+	if c.Tenancy == nil {
+		return ""
+	}
+	return c.Tenancy.DefaultTenant
+}
+
+// ValidationRules returns the Validation settings with
+// defaults filled in for anything left unset.
+func (c *Configuration) ValidationRules() *Validation {
+	v := Validation{}
+	if c.Validation != nil {
+		v = *c.Validation
+	}
+	if v.MaxBodyBytes == 0 {
+		v.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if v.MaxBatchItems == 0 {
+		v.MaxBatchItems = DefaultMaxBatchItems
+	}
+	if v.ReleaseDateFormat == "" {
+		v.ReleaseDateFormat = DefaultReleaseDateFormat
+	}
+	return &v
+}
+
+// IdempotencyRules returns the Idempotency settings with defaults
+// filled in for anything left unset.
+func (c *Configuration) IdempotencyRules() *Idempotency {
+	i := Idempotency{}
+	if c.Idempotency != nil {
+		i = *c.Idempotency
+	}
+	if i.WindowSeconds == 0 {
+		i.WindowSeconds = DefaultIdempotencyWindow
+	}
+	return &i
+}
+
+// PackerMapping returns Packer.Mapping with DefaultPackerMapping
+// filled in for fields it leaves out.
+func (c *Configuration) PackerMapping() map[string]string {
+	mapping := make(map[string]string)
+	for field, path := range DefaultPackerMapping {
+		mapping[field] = path
+	}
+	if c.Packer != nil {
+		for field, path := range c.Packer.Mapping {
+			mapping[field] = path
+		}
+	}
+	return mapping
+}
+
+// PackerMaxBodyBytes returns Packer.MaxBodyBytes or its default.
+func (c *Configuration) PackerMaxBodyBytes() int64 {
+	if c.Packer != nil && c.Packer.MaxBodyBytes > 0 {
+		return c.Packer.MaxBodyBytes
+	}
+	return DefaultPackerMaxBodyBytes
+}
+
+// ClientCertsEnabled returns true if client certificates
+// are verified.
+func (c *Configuration) ClientCertsEnabled() bool {
+	return c.TLS != nil && c.TLS.ClientCAFile != ""
+}
+
+// ReadAccessFor returns the read access mode for the named
+// endpoint.
+func (c *Configuration) ReadAccessFor(endpoint string) string {
+	if mode, ok := c.Authentication.EndpointReadAccess[endpoint]; ok {
+		return mode
+	}
+	if c.Authentication.ReadAccess != "" {
+		return c.Authentication.ReadAccess
+	}
+	if c.TenancyEnabled() {
+		return ReadAuthenticated
+	}
+	return ReadAnonymous
+}
+
+// Validate checks the configuration for settings
+// that would otherwise only fail at request time.
+func (c *Configuration) Validate() error {
+	if c.Authentication == nil {
+		return errors.New("Missing Authentication section")
+	}
+	if c.RateLimits != nil {
+		for class, limit := range map[string]*RateLimit{"Read": c.RateLimits.Read, "Query": c.RateLimits.Query, "Write": c.RateLimits.Write} {
+			if limit != nil && (limit.Rate <= 0 || limit.Burst < 1) {
+				return fmt.Errorf("RateLimits.%s needs a positive Rate and Burst", class)
+			}
+		}
+	}
+	if c.Authentication.AuthCacheSize < 0 {
+		return errors.New("Authentication.AuthCacheSize can't be negative")
+	}
+	if c.RateLimits != nil && c.RateLimits.TrustedProxies < 0 {
+		return errors.New("RateLimits.TrustedProxies can't be negative")
+	}
+	if c.Packer != nil && c.Packer.MaxBodyBytes < 0 {
+		return errors.New("Packer.MaxBodyBytes can't be negative")
+	}
+	if c.Validation != nil && c.Validation.MaxBodyBytes < 0 {
+		return errors.New("Validation.MaxBodyBytes can't be negative")
+	}
+	if c.Idempotency != nil && c.Idempotency.WindowSeconds < 0 {
+		return errors.New("Idempotency.WindowSeconds can't be negative")
+	}
+	if c.Packer != nil {
+		for field := range c.Packer.Mapping {
+			if !validPackerField(field) {
+				return fmt.Errorf("Unknown field '%s' in Packer.Mapping, must be one of %s",
+					field, strings.Join(PackerFields, ", "))
+			}
+		}
+	}
+	if mode := c.Authentication.ReadAccess; mode != "" && !validReadAccess(mode) {
+		return fmt.Errorf("Unknown ReadAccess '%s', must be '%s' or '%s'", mode, ReadAnonymous, ReadAuthenticated)
+	}
+	for endpoint, mode := range c.Authentication.EndpointReadAccess {
+		if !validReadEndpoint(endpoint) {
+			return fmt.Errorf("Unknown endpoint '%s' in EndpointReadAccess, must be one of %s",
+				endpoint, strings.Join(KnownReadEndpoints, ", "))
+		}
+		if !validReadAccess(mode) {
+			return fmt.Errorf("Unknown EndpointReadAccess '%s' for '%s', must be '%s' or '%s'",
+				mode, endpoint, ReadAnonymous, ReadAuthenticated)
+		}
+	}
+	for _, group := range c.Authentication.AuthorizedGroups {
+		for _, e := range group.Entitlements {
+			if !ValidEntitlement(e.Type) {
+				return fmt.Errorf("Unknown entitlement '%s' for group '%s', must be one of %s",
+					e.Type, group.GroupID, strings.Join(KnownEntitlements, ", "))
+			}
+		}
+		for _, m := range group.Members {
+			if !validMember(m) {
+				return fmt.Errorf("Member '%s' of group '%s' must start with the provider that authenticates it, one of %s",
+					m, group.GroupID, strings.Join(KnownMemberPrefixes, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// ValidEntitlement returns true if t is one of KnownEntitlements.
+func ValidEntitlement(t string) bool {
+	for _, k := range KnownEntitlements {
+		if t == k {
+			return true
+		}
+	}
+	return false
+}
+
+func validReadAccess(mode string) bool {
+	return mode == ReadAnonymous || mode == ReadAuthenticated
+}
+
+func validMember(m string) bool {
+	for _, prefix := range KnownMemberPrefixes {
+		if strings.HasPrefix(m, prefix) && len(m) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func validReadEndpoint(endpoint string) bool {
+	for _, e := range KnownReadEndpoints {
+		if endpoint == e {
+			return true
+		}
+	}
+	return false
+}
+
+func validPackerField(field string) bool {
+	for _, f := range PackerFields {
+		if field == f {
+			return true
+		}
+	}
+	return false
 }
 
 // ShowConfig returns a string of log formatted
@@ -68,7 +558,12 @@ func SetConfig(filename string) error {
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+	// decode into a fresh configuration so nothing carries
+	// over from a previously loaded file
+	c := &Configuration{}
 	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&Config)
+	err = decoder.Decode(c)
+	Config = c
 	return err
 }
@@ -1,6 +1,7 @@
 package fhidLogger
 
 import (
+	"io"
 	"os"
 
 	"github.com/inconshreveable/log15"
@@ -9,6 +10,11 @@ import (
 // Loggo is the global logger
 var Loggo log15.Logger
 
+// Console is where log lines that aren't going to the log file are
+// written. Set it before SetLogger, e.g. to os.Stderr when stdout
+// carries a command's output.
+var Console io.Writer = os.Stdout
+
 // SetLogger sets up logging globally for the packages involved
 // in the fhid runtime.
 func SetLogger(daemonFlag, noLogFile bool, logFileS, loglevel string) {
@@ -17,12 +23,12 @@ func SetLogger(daemonFlag, noLogFile bool, logFileS, loglevel string) {
 		Loggo.SetHandler(
 			log15.LvlFilterHandler(
 				log15.LvlDebug,
-				log15.StreamHandler(os.Stdout, log15.LogfmtFormat())))
+				log15.StreamHandler(Console, log15.LogfmtFormat())))
 	} else if noLogFile {
 		Loggo.SetHandler(
 			log15.LvlFilterHandler(
 				log15.LvlInfo,
-				log15.StreamHandler(os.Stdout, log15.LogfmtFormat())))
+				log15.StreamHandler(Console, log15.LogfmtFormat())))
 	} else if daemonFlag && loglevel == "debug" {
 		Loggo.SetHandler(
 			log15.LvlFilterHandler(
@@ -36,7 +42,7 @@ func SetLogger(daemonFlag, noLogFile bool, logFileS, loglevel string) {
 	} else if loglevel == "debug" {
 		// log to stdout and file
 		Loggo.SetHandler(log15.MultiHandler(
-			log15.StreamHandler(os.Stdout, log15.LogfmtFormat()),
+			log15.StreamHandler(Console, log15.LogfmtFormat()),
 			log15.LvlFilterHandler(
 				log15.LvlDebug,
 				log15.Must.FileHandler(logFileS, log15.JsonFormat()))))
@@ -45,7 +51,7 @@ func SetLogger(daemonFlag, noLogFile bool, logFileS, loglevel string) {
 		Loggo.SetHandler(log15.MultiHandler(
 			log15.LvlFilterHandler(
 				log15.LvlInfo,
-				log15.StreamHandler(os.Stdout, log15.LogfmtFormat())),
+				log15.StreamHandler(Console, log15.LogfmtFormat())),
 			log15.LvlFilterHandler(
 				log15.LvlInfo,
 				log15.Must.FileHandler(logFileS, log15.JsonFormat()))))
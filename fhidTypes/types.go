@@ -0,0 +1,121 @@
+// Package fhidTypes holds the entries and queries the fhid API sends
+// and receives. It's shared by the server and its clients so it only
+// uses the standard library.
+//
+// The validate tags are the rules the server checks posted entries
+// against, see fhid/validation.go.
+package fhidTypes
+
+// Artifact providers
+const (
+	ArtifactAWS       = "aws"
+	ArtifactOpenStack = "openstack"
+	ArtifactAzure     = "azure"
+	ArtifactGCE       = "gce"
+	ArtifactDocker    = "docker"
+	ArtifactVMware    = "vmware"
+)
+
+// KnownArtifactProviders lists every valid Artifact Provider.
+var KnownArtifactProviders = []string{
+	ArtifactAWS, ArtifactOpenStack, ArtifactAzure, ArtifactGCE, ArtifactDocker, ArtifactVMware,
+}
+
+// Artifact is an image built for, or released to, any of the supported
+// providers. Provider says which of the other fields apply, the ones
+// for other providers must be left out. AMIs can be given either as an
+// aws Artifact or in the older OutputAmis and Amis lists.
+type Artifact struct {
+	Provider string `validate:"required,provider"`
+	// aws
+	AmiID       string   `json:",omitempty" validate:"required,ami,for=aws"`
+	AmiRegion   string   `json:",omitempty" validate:"required,region,for=aws"`
+	AmiSharedTo []string `json:",omitempty" validate:"for=aws"`
+	// openstack, the Glance image and the project it's in
+	GlanceImageID string `json:",omitempty" validate:"required,uuid,for=openstack"`
+	Project       string `json:",omitempty" validate:"required,for=openstack"`
+	// azure, a managed image or gallery image resource ID
+	ResourceID     string `json:",omitempty" validate:"required,azureid,for=azure"`
+	GalleryVersion string `json:",omitempty" validate:"galleryversion,for=azure"`
+	// gce
+	SelfLink string `json:",omitempty" validate:"required,selflink,for=gce"`
+	// docker
+	Repository string `json:",omitempty" validate:"required,for=docker"`
+	Digest     string `json:",omitempty" validate:"required,digest,for=docker"`
+	// vmware, the vSphere inventory path of the template
+	TemplatePath string  `json:",omitempty" validate:"required,for=vmware"`
+	Tags         []*Tags `json:",omitempty"`
+}
+
+// AmiEntry just holds basic structure of an AMI ID
+// and an AMI region.
+type AmiEntry struct {
+	AmiID       string `validate:"required,ami"`
+	AmiRegion   string `validate:"required,region"`
+	AmiSharedTo []string
+	AmiTags     []*Tags
+}
+
+// Tags is a struct for holding AMI tags
+type Tags struct {
+	Key   string
+	Value string
+}
+
+// BuildNotes holds specific structure for packer
+// aws builds
+type BuildNotes struct {
+	BuildLog   []string
+	OutputAmis []*AmiEntry
+	SourceAmi  string `validate:"ami"`
+	// Artifacts holds images built for any provider, see Artifact.
+	Artifacts []*Artifact `json:",omitempty"`
+}
+
+// ReleaseNotes holds specific structure for packer
+// aws builds
+type ReleaseNotes struct {
+	ReleaseNote string
+	Amis        []*AmiEntry
+	ReleaseDate string `validate:"releasedate"`
+	// Artifacts holds images released to any provider, see Artifact.
+	Artifacts []*Artifact `json:",omitempty"`
+}
+
+// ImageEntry is an image entry as posted to and returned by fhid.
+type ImageEntry struct {
+	SchemaVersion int    `validate:"readonly"`
+	ImageID       string `validate:"readonly"`
+	Version       string `validate:"required"`
+	BaseOS        string `validate:"required"`
+	Tenant        string
+	ReleaseNotes  *ReleaseNotes
+	BuildNotes    *BuildNotes
+	CreateDate    string `validate:"readonly"`
+	CreatedBy     string `json:",omitempty" validate:"readonly"`
+	UpdatedBy     string `json:",omitempty" validate:"readonly"`
+}
+
+// ImageQueryResults holds the entries returned by a query or lookup.
+type ImageQueryResults struct {
+	Results []ImageEntry
+}
+
+// ImageQuerySub is a search on one field of an entry.
+type ImageQuerySub struct {
+	StringMatch string
+	Function    string
+	Value       string // e.g., 'latest' or '.*'
+}
+
+// ImageQuery is the body of a query. Only the first field that's set
+// is searched on.
+type ImageQuery struct {
+	Version      *ImageQuerySub
+	BaseOS       *ImageQuerySub
+	BuildNotes   *ImageQuerySub
+	ReleaseNotes *ImageQuerySub
+	// Artifact matches the identifiers of any built or released
+	// artifact, AMIs included.
+	Artifact *ImageQuerySub
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/GESkunkworks/fhid/fhidConfig"
+	"github.com/GESkunkworks/fhid/fhidTypes"
+)
+
+// parse parses a command's flags and positional args then loads the
+// config. want is the number of positional args the command takes and
+// synopsis is shown in its usage.
+func (o *options) parse(fs *flag.FlagSet, args []string, synopsis string, want int) ([]string, *config, error) {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fhidctl %s\n\nFlags:\n", synopsis)
+		fs.PrintDefaults()
+	}
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(positional) != want {
+		fs.Usage()
+		return nil, nil, errUsage
+	}
+	conf, err := o.loadConfig()
+	return positional, conf, err
+}
+
+// readInput reads a file, or stdin if path is '-'.
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// decodeFile decodes a JSON file into v, rejecting fields fhid doesn't
+// know about so typos aren't silently dropped.
+func decodeFile(path string, v interface{}) error {
+	data, err := readInput(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(v)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %s", path, err)
+	}
+	return nil
+}
+
+// runImagesCreate posts the entry in a file and prints its ImageID.
+func runImagesCreate(opts *options, args []string, out, errOut io.Writer) error {
+	var file string
+	fs := opts.flagSet("images create", errOut)
+	fs.StringVar(&file, "f", "", "JSON file holding the entry, '-' for stdin.")
+	_, conf, err := opts.parse(fs, args, "images create -f <file>", 0)
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		fs.Usage()
+		return errUsage
+	}
+	var entry fhidTypes.ImageEntry
+	err = decodeFile(file, &entry)
+	if err != nil {
+		return err
+	}
+	id, err := opts.client(conf).CreateImage(context.Background(), &entry)
+	if err != nil {
+		return err
+	}
+	return render(out, conf.Output, imageID{id})
+}
+
+// runImagesGet prints an entry.
+func runImagesGet(opts *options, args []string, out, errOut io.Writer) error {
+	fs := opts.flagSet("images get", errOut)
+	ids, conf, err := opts.parse(fs, args, "images get <id>", 1)
+	if err != nil {
+		return err
+	}
+	entry, err := opts.client(conf).GetImage(context.Background(), ids[0])
+	if err != nil {
+		return err
+	}
+	return render(out, conf.Output, entry)
+}
+
+// amiList collects AMIs given as ami-id:region, comma separated or by
+// repeating the flag.
+type amiList []*fhidTypes.AmiEntry
+
+func (l *amiList) String() string {
+	var amis []string
+	for _, ami := range *l {
+		amis = append(amis, ami.AmiID+":"+ami.AmiRegion)
+	}
+	return strings.Join(amis, ",")
+}
+
+func (l *amiList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		parts := strings.SplitN(v, ":", 2)
+		ami := &fhidTypes.AmiEntry{AmiID: parts[0]}
+		if len(parts) == 2 {
+			ami.AmiRegion = parts[1]
+		}
+		*l = append(*l, ami)
+	}
+	return nil
+}
+
+// runImagesRelease replaces the release notes of an entry. The notes
+// come from -f, with any flags applied over the top.
+func runImagesRelease(opts *options, args []string, out, errOut io.Writer) error {
+	var file, note, date, region string
+	var amis amiList
+	fs := opts.flagSet("images release", errOut)
+	fs.StringVar(&file, "f", "", "JSON file holding the ReleaseNotes, '-' for stdin.")
+	fs.Var(&amis, "amis", "Released AMIs as ami-id:region, comma separated or repeated.")
+	fs.StringVar(&region, "region", "", "Region for -amis given without one.")
+	fs.StringVar(&note, "note", "", "The release note.")
+	fs.StringVar(&date, "date", "", "Release date, defaults to now in the format '"+fhidConfig.DefaultReleaseDateFormat+"'.")
+	ids, conf, err := opts.parse(fs, args, "images release <id> [-amis ami-id:region,...] [-note text] [-f file]", 1)
+	if err != nil {
+		return err
+	}
+	notes := &fhidTypes.ReleaseNotes{}
+	if file != "" {
+		err = decodeFile(file, notes)
+		if err != nil {
+			return err
+		}
+	}
+	if file == "" && len(amis) == 0 && note == "" {
+		return errors.New("Nothing to release, give -amis, -note or -f")
+	}
+	for _, ami := range amis {
+		if ami.AmiRegion == "" {
+			ami.AmiRegion = region
+		}
+		if ami.AmiRegion == "" {
+			return fmt.Errorf("No region for %s, use ami-id:region or -region", ami.AmiID)
+		}
+	}
+	notes.Amis = append(notes.Amis, amis...)
+	if note != "" {
+		notes.ReleaseNote = note
+	}
+	if date != "" {
+		notes.ReleaseDate = date
+	}
+	if notes.ReleaseDate == "" {
+		notes.ReleaseDate = time.Now().UTC().Format(fhidConfig.DefaultReleaseDateFormat)
+	}
+	err = opts.client(conf).PatchRelease(context.Background(), ids[0], notes)
+	if err != nil {
+		return err
+	}
+	return render(out, conf.Output, imageID{ids[0]})
+}
+
+// queryField is a field that can be searched on, in the order fhid
+// picks between them.
+type queryField struct {
+	flag    string
+	pattern string
+	value   func(*fhidTypes.ImageEntry) string
+	set     func(*fhidTypes.ImageQuery, *fhidTypes.ImageQuerySub)
+}
+
+func notesJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// runQuery searches entries. fhid only searches on one field per query
+// so the first one given is sent to fhid and the results are filtered
+// on the others here, the same way fhid matches them.
+func runQuery(opts *options, args []string, out, errOut io.Writer) error {
+	fields := []*queryField{
+		{flag: "version",
+			value: func(e *fhidTypes.ImageEntry) string { return e.Version },
+			set:   func(q *fhidTypes.ImageQuery, s *fhidTypes.ImageQuerySub) { q.Version = s }},
+		{flag: "baseos",
+			value: func(e *fhidTypes.ImageEntry) string { return e.BaseOS },
+			set:   func(q *fhidTypes.ImageQuery, s *fhidTypes.ImageQuerySub) { q.BaseOS = s }},
+		{flag: "releasenotes",
+			value: func(e *fhidTypes.ImageEntry) string { return notesJSON(e.ReleaseNotes) },
+			set:   func(q *fhidTypes.ImageQuery, s *fhidTypes.ImageQuerySub) { q.ReleaseNotes = s }},
+		{flag: "buildnotes",
+			value: func(e *fhidTypes.ImageEntry) string { return notesJSON(e.BuildNotes) },
+			set:   func(q *fhidTypes.ImageQuery, s *fhidTypes.ImageQuerySub) { q.BuildNotes = s }},
+		{flag: "artifact",
+			set: func(q *fhidTypes.ImageQuery, s *fhidTypes.ImageQuerySub) { q.Artifact = s }},
+	}
+	fs := opts.flagSet("query", errOut)
+	for _, f := range fields {
+		fs.StringVar(&f.pattern, f.flag, "", "Regular expression to match the "+f.flag+" of entries against.")
+	}
+	_, conf, err := opts.parse(fs, args, "query [-version regex] [-baseos regex] [-releasenotes regex] [-buildnotes regex] [-artifact regex]", 0)
+	if err != nil {
+		return err
+	}
+	var q *fhidTypes.ImageQuery
+	var filters []*queryField
+	var patterns []*regexp.Regexp
+	for _, f := range fields {
+		if f.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(f.pattern)
+		if err != nil {
+			return fmt.Errorf("Bad -%s pattern: %s", f.flag, err)
+		}
+		if q != nil && f.value == nil {
+			return fmt.Errorf("-%s can't be combined with other fields", f.flag)
+		}
+		if q == nil {
+			q = &fhidTypes.ImageQuery{}
+			f.set(q, &fhidTypes.ImageQuerySub{StringMatch: f.pattern})
+			continue
+		}
+		filters, patterns = append(filters, f), append(patterns, re)
+	}
+	if q == nil {
+		fs.Usage()
+		return errUsage
+	}
+	results, err := opts.client(conf).Query(context.Background(), q)
+	if err != nil {
+		return err
+	}
+	entries := imageList{}
+	for i := range results {
+		match := true
+		for j, f := range filters {
+			match = match && patterns[j].MatchString(f.value(&results[i]))
+		}
+		if match {
+			entries = append(entries, results[i])
+		}
+	}
+	return render(out, conf.Output, entries)
+}
+
+// runArtifactLookup prints the entries that built or released an
+// artifact of any provider.
+func runArtifactLookup(opts *options, args []string, out, errOut io.Writer) error {
+	fs := opts.flagSet("artifact lookup", errOut)
+	ids, conf, err := opts.parse(fs, args, "artifact lookup <id>", 1)
+	if err != nil {
+		return err
+	}
+	results, err := opts.client(conf).FindByArtifact(context.Background(), ids[0])
+	if err != nil {
+		return err
+	}
+	return render(out, conf.Output, imageList(results))
+}
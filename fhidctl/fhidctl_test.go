@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/GESkunkworks/fhid/fhidTypes"
+)
+
+const testID = "e9373eb2-b17f-4344-a933-4db2d358c020"
+
+var testEntries = []fhidTypes.ImageEntry{
+	{ImageID: testID, Version: "3.4.1", BaseOS: "Ubuntu16.04", CreateDate: "2018-01-30 04:36:25",
+		BuildNotes: &fhidTypes.BuildNotes{OutputAmis: []*fhidTypes.AmiEntry{{AmiID: "ami-54321", AmiRegion: "us-west-1"}}}},
+	{ImageID: "30095350-dd02-4200-bf12-894f409a653f", Version: "3.5.0", BaseOS: "Ubuntu16.04"},
+	{ImageID: "d07d13d9-b666-46d6-986f-a57c4ee8e971", Version: "3.4.2", BaseOS: "Arch"},
+}
+
+// fakeServer answers like fhid would and records the last request.
+type fakeServer struct {
+	*httptest.Server
+	method, path, token string
+	body                []byte
+}
+
+func runFakeServer(t *testing.T) *fakeServer {
+	f := &fakeServer{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.method, f.path, f.token = r.Method, r.URL.Path, r.Header.Get("x-api-key")
+		f.body, _ = ioutil.ReadAll(r.Body)
+		var data interface{}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v1.0/images":
+			data = testID
+		case r.Method == "GET" && r.URL.Path == "/v1.0/images/"+testID:
+			data = fhidTypes.ImageQueryResults{Results: testEntries[:1]}
+		case r.Method == "PATCH" && r.URL.Path == "/v1.0/images/"+testID+"/release":
+			data = "Updated"
+		case r.Method == "POST" && r.URL.Path == "/v1.0/query":
+			// like fhid, only search on Version if it's given
+			var q fhidTypes.ImageQuery
+			json.Unmarshal(f.body, &q)
+			results := fhidTypes.ImageQueryResults{}
+			for _, e := range testEntries {
+				if q.Version == nil || regexp.MustCompile(q.Version.StringMatch).MatchString(e.Version) {
+					results.Results = append(results.Results, e)
+				}
+			}
+			data = results
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"Success": "False", "Error": {"Code": "NotFound", "Message": "Not found"}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Success": "True", "Data": data})
+	}))
+	return f
+}
+
+// fhidctl runs the command line against the fake server with an empty
+// environment.
+func (f *fakeServer) fhidctl(t *testing.T, args ...string) (string, error) {
+	for _, env := range []string{envConfig, envEndpoint, envToken} {
+		os.Unsetenv(env)
+	}
+	os.Setenv("HOME", os.TempDir())
+	var out, errOut bytes.Buffer
+	args = append([]string{"-endpoint", f.URL + "/v1.0"}, args...)
+	err := run(args, &out, &errOut)
+	return out.String(), err
+}
+
+// TestImages runs the images commands and checks what they send.
+func TestImages(t *testing.T) {
+	f := runFakeServer(t)
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "fhidctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	build := filepath.Join(dir, "build.json")
+	ioutil.WriteFile(build, []byte(`{"Version": "1.2.4", "BaseOS": "Arch"}`), 0600)
+
+	out, err := f.fhidctl(t, "images", "create", "-f", build)
+	if err != nil || f.method != "POST" || !strings.Contains(string(f.body), `"BaseOS":"Arch"`) {
+		t.Errorf("create sent %s %s %s: %v", f.method, f.path, f.body, err)
+	}
+	if out != "IMAGE ID\n"+testID+"\n" {
+		t.Errorf("create printed %q", out)
+	}
+	ioutil.WriteFile(build, []byte(`{"Verison": "1.2.4", "BaseOS": "Arch"}`), 0600)
+	f.method = ""
+	if _, err = f.fhidctl(t, "images", "create", "-f", build); err == nil || f.method != "" {
+		t.Errorf("create with a misspelled field: got %v", err)
+	}
+
+	out, err = f.fhidctl(t, "images", "get", testID, "-o", "yaml")
+	if err != nil || !strings.HasPrefix(out, "SchemaVersion: 0\nImageID: "+testID+"\nVersion: 3.4.1\n") {
+		t.Errorf("get printed %q: %v", out, err)
+	}
+	out, err = f.fhidctl(t, "images", "get", testID)
+	if err != nil || !strings.Contains(out, "ami-54321:us-west-1") {
+		t.Errorf("get printed %q: %v", out, err)
+	}
+	_, err = f.fhidctl(t, "images", "get", "nope")
+	if err == nil || !strings.Contains(err.Error(), "NotFound") {
+		t.Errorf("get of a missing entry: got %v", err)
+	}
+
+	// the id comes before the flags, which the flag package stops at
+	_, err = f.fhidctl(t, "images", "release", testID, "-amis", "ami-0abc1:us-east-1,ami-0abc2", "-region", "us-west-2", "-note", "GA")
+	if err != nil || f.method != "PATCH" {
+		t.Fatalf("release sent %s %s: %v", f.method, f.path, err)
+	}
+	var body struct{ ReleaseNotes fhidTypes.ReleaseNotes }
+	json.Unmarshal(f.body, &body)
+	notes := body.ReleaseNotes
+	if notes.ReleaseNote != "GA" || len(notes.Amis) != 2 || notes.Amis[1].AmiRegion != "us-west-2" || notes.ReleaseDate == "" {
+		t.Errorf("release sent %s", f.body)
+	}
+	f.method = ""
+	if _, err = f.fhidctl(t, "images", "release", testID, "-amis", "ami-0abc1"); err == nil || f.method != "" {
+		t.Errorf("release of an AMI without a region: got %v", err)
+	}
+}
+
+// TestQuery makes sure fields fhid won't search on together are
+// filtered locally.
+func TestQuery(t *testing.T) {
+	f := runFakeServer(t)
+	defer f.Close()
+	out, err := f.fhidctl(t, "query", "-baseos", "Ubuntu.*", "-version", `3\.4\..*`, "-o", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent map[string]interface{}
+	json.Unmarshal(f.body, &sent)
+	if sent["Version"] == nil || sent["BaseOS"] != nil {
+		t.Errorf("query sent %s, want only Version", f.body)
+	}
+	var results []fhidTypes.ImageEntry
+	err = json.Unmarshal([]byte(out), &results)
+	if err != nil || len(results) != 1 || results[0].ImageID != testID {
+		t.Errorf("query printed %s: %v", out, err)
+	}
+	if _, err = f.fhidctl(t, "query"); err != errUsage {
+		t.Errorf("query without a field: got %v", err)
+	}
+	if _, err = f.fhidctl(t, "query", "-baseos", "("); err == nil {
+		t.Error("query with a bad pattern should fail")
+	}
+}
+
+// TestConfig checks the config file, environment and flags are applied
+// in that order.
+func TestConfig(t *testing.T) {
+	f := runFakeServer(t)
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "fhidctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "fhidctl.json")
+	ioutil.WriteFile(conf, []byte(`{"Endpoint": "http://127.0.0.1:1/v1.0", "Token": "from-file", "Output": "json"}`), 0600)
+
+	var out, errOut bytes.Buffer
+	os.Setenv(envConfig, conf)
+	os.Setenv(envEndpoint, f.URL+"/v1.0")
+	defer os.Unsetenv(envConfig)
+	defer os.Unsetenv(envEndpoint)
+	err = run([]string{"images", "get", testID}, &out, &errOut)
+	if err != nil || f.token != "from-file" || !strings.HasPrefix(out.String(), "{") {
+		t.Errorf("got token %q output %q: %v", f.token, out.String(), err)
+	}
+	os.Setenv(envToken, "from-env")
+	defer os.Unsetenv(envToken)
+	out.Reset()
+	err = run([]string{"-o", "table", "images", "get", testID}, &out, &errOut)
+	if err != nil || f.token != "from-env" || !strings.HasPrefix(out.String(), "IMAGE ID") {
+		t.Errorf("got token %q output %q: %v", f.token, out.String(), err)
+	}
+
+	if err = run([]string{"images", "get", testID, "-o", "xml"}, &out, &errOut); err == nil {
+		t.Error("unknown output format should fail")
+	}
+	if err = run([]string{"-config", filepath.Join(dir, "missing.json"), "images", "get", testID}, &out, &errOut); err == nil {
+		t.Error("missing config file should fail")
+	}
+	os.Unsetenv(envConfig)
+	os.Unsetenv(envEndpoint)
+	os.Setenv("HOME", dir)
+	if err = run([]string{"images", "get", testID}, &out, &errOut); err == nil || !strings.Contains(err.Error(), "No endpoint") {
+		t.Errorf("no endpoint: got %v", err)
+	}
+	if err = run([]string{"images", "delete", testID}, &out, &errOut); err != errUsage {
+		t.Errorf("unknown command: got %v", err)
+	}
+}
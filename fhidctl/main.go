@@ -0,0 +1,241 @@
+// fhidctl is a command line client for fhid.
+//
+//	fhidctl images create -f build.json
+//	fhidctl images get <id>
+//	fhidctl images release <id> -amis ami-0abc123:us-east-1 -note "GA"
+//	fhidctl query -baseos 'Ubuntu.*' -version '3.4.*'
+//	fhidctl artifact lookup ami-0abc123
+//
+// The endpoint and token are read from FHID_ENDPOINT and FHID_TOKEN or
+// from ~/.fhidctl.json, see loadConfig.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/GESkunkworks/fhid/client"
+)
+
+var version string
+
+// Environment variables read by fhidctl
+const (
+	envConfig   = "FHIDCTL_CONFIG"
+	envEndpoint = "FHID_ENDPOINT"
+	envToken    = "FHID_TOKEN"
+)
+
+// config is the fhidctl config file. Values set in the environment or
+// on the command line take precedence over the file.
+type config struct {
+	// Endpoint is the versioned API root, e.g.
+	// https://images.company.com/v1.0
+	Endpoint   string
+	Token      string
+	AuthHeader string
+	Bearer     bool
+	// Output is the default output format.
+	Output string
+}
+
+// options holds the flags every command accepts.
+type options struct {
+	configFile string
+	endpoint   string
+	output     string
+	timeout    time.Duration
+}
+
+// errUsage is returned for bad command lines, the usage has already
+// been printed.
+var errUsage = errors.New("usage")
+
+const usage = `Usage: fhidctl [flags] <command> [args]
+
+Commands:
+  images create -f <file>           Post an image entry, '-' reads stdin
+  images get <id>                   Show an image entry
+  images release <id> [flags]       Replace the release notes of an entry
+  query [flags]                     Search image entries
+  artifact lookup <id>              Find the entries that built or released an artifact
+  ami lookup <ami-id>               The same for an AMI
+  version                           Print the fhidctl version
+
+Flags can also follow the command. Run 'fhidctl <command> -h' for its flags.
+`
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+	switch {
+	case err == errUsage:
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "fhidctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command line args, writing results to out and usage to
+// errOut.
+func run(args []string, out, errOut io.Writer) error {
+	opts := &options{}
+	fs := opts.flagSet("fhidctl", errOut)
+	fs.Usage = func() {
+		fmt.Fprint(errOut, usage)
+		fmt.Fprintln(errOut, "\nFlags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	name, args := args[0], args[1:]
+	var cmd func(*options, []string, io.Writer, io.Writer) error
+	switch name {
+	case "images":
+		if len(args) == 0 {
+			fs.Usage()
+			return errUsage
+		}
+		switch args[0] {
+		case "create":
+			cmd = runImagesCreate
+		case "get":
+			cmd = runImagesGet
+		case "release":
+			cmd = runImagesRelease
+		}
+		name, args = name+" "+args[0], args[1:]
+	case "query":
+		cmd = runQuery
+	case "ami", "artifact":
+		if len(args) == 0 || args[0] != "lookup" {
+			fs.Usage()
+			return errUsage
+		}
+		cmd, name, args = runArtifactLookup, name+" lookup", args[1:]
+	case "version":
+		fmt.Fprintf(out, "fhidctl %s\n", versionString())
+		return nil
+	}
+	if cmd == nil {
+		fmt.Fprintf(errOut, "fhidctl: unknown command '%s'\n\n", name)
+		fs.Usage()
+		return errUsage
+	}
+	return cmd(opts, args, out, errOut)
+}
+
+// flagSet returns a flag set with the flags every command accepts.
+func (o *options) flagSet(name string, errOut io.Writer) *flag.FlagSet {
+	if o.timeout == 0 {
+		o.timeout = client.DefaultTimeout
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	fs.StringVar(&o.configFile, "config", o.configFile, "Config file, defaults to $"+envConfig+" or ~/.fhidctl.json.")
+	fs.StringVar(&o.endpoint, "endpoint", o.endpoint, "API endpoint, e.g. https://images.company.com/v1.0. Overrides $"+envEndpoint+".")
+	fs.StringVar(&o.output, "o", o.output, "Output format: table, json or yaml.")
+	fs.DurationVar(&o.timeout, "timeout", o.timeout, "Timeout for each request.")
+	return fs
+}
+
+// parseArgs parses fs allowing flags to come before, after or between
+// positional args, and returns the positional args.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional, args = append(positional, args[0]), args[1:]
+	}
+}
+
+// loadConfig reads the config file if there is one then applies the
+// environment and flags over the top of it.
+func (o *options) loadConfig() (*config, error) {
+	conf := &config{}
+	path, explicit := o.configFile, true
+	if path == "" {
+		path = os.Getenv(envConfig)
+	}
+	if path == "" {
+		explicit = false
+		home, err := os.UserHomeDir()
+		if err == nil {
+			path = filepath.Join(home, ".fhidctl.json")
+		}
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		switch {
+		case err == nil:
+			defer f.Close()
+			err = json.NewDecoder(f).Decode(conf)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading config file %s: %s", path, err)
+			}
+		case explicit || !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+	if v := os.Getenv(envEndpoint); v != "" {
+		conf.Endpoint = v
+	}
+	if v := os.Getenv(envToken); v != "" {
+		conf.Token = v
+	}
+	if o.endpoint != "" {
+		conf.Endpoint = o.endpoint
+	}
+	if o.output != "" {
+		conf.Output = o.output
+	}
+	if conf.Output == "" {
+		conf.Output = formatTable
+	}
+	if conf.Endpoint == "" {
+		return nil, fmt.Errorf("No endpoint set, use -endpoint, $%s or the config file", envEndpoint)
+	}
+	if !validFormat(conf.Output) {
+		return nil, fmt.Errorf("Unknown output format '%s', use table, json or yaml", conf.Output)
+	}
+	return conf, nil
+}
+
+// client returns an API client for the config.
+func (o *options) client(conf *config) *client.Client {
+	c := client.New(conf.Endpoint)
+	c.Token = conf.Token
+	if conf.AuthHeader != "" {
+		c.AuthHeader = conf.AuthHeader
+	}
+	c.Bearer = conf.Bearer
+	c.HTTPClient.Timeout = o.timeout
+	c.UserAgent = "fhidctl/" + versionString()
+	return c
+}
+
+func versionString() string {
+	if version == "" {
+		return "dev"
+	}
+	return strings.TrimSpace(version)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/GESkunkworks/fhid/fhidTypes"
+)
+
+// Output formats
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+)
+
+func validFormat(format string) bool {
+	return format == formatTable || format == formatJSON || format == formatYAML
+}
+
+// tabular is implemented by results that can be shown as a table.
+type tabular interface {
+	header() []string
+	rows() [][]string
+}
+
+// imageID is the result of commands that write an entry.
+type imageID struct {
+	ImageID string
+}
+
+func (i imageID) header() []string { return []string{"IMAGE ID"} }
+func (i imageID) rows() [][]string { return [][]string{{i.ImageID}} }
+
+// imageList is a list of entries, shown one per row. The full entries
+// are in the JSON and YAML output.
+type imageList []fhidTypes.ImageEntry
+
+func (l imageList) header() []string {
+	return []string{"IMAGE ID", "VERSION", "BASE OS", "TENANT", "CREATED", "RELEASED", "ARTIFACTS"}
+}
+
+func (l imageList) rows() [][]string {
+	var rows [][]string
+	for i := range l {
+		e := &l[i]
+		released := "-"
+		var names []string
+		if e.BuildNotes != nil {
+			names = artifactNames(e.BuildNotes.OutputAmis, e.BuildNotes.Artifacts)
+		}
+		if e.ReleaseNotes != nil && e.ReleaseNotes.ReleaseDate != "" {
+			released = e.ReleaseNotes.ReleaseDate
+			names = artifactNames(e.ReleaseNotes.Amis, e.ReleaseNotes.Artifacts)
+		}
+		rows = append(rows, []string{
+			e.ImageID, e.Version, e.BaseOS, dash(e.Tenant), dash(e.CreateDate), released, dash(strings.Join(names, ",")),
+		})
+	}
+	return rows
+}
+
+// artifactNames returns short names for AMIs and other artifacts.
+func artifactNames(amis []*fhidTypes.AmiEntry, artifacts []*fhidTypes.Artifact) []string {
+	var names []string
+	for _, ami := range amis {
+		if ami != nil {
+			names = append(names, ami.AmiID+":"+ami.AmiRegion)
+		}
+	}
+	for _, a := range artifacts {
+		if a == nil {
+			continue
+		}
+		switch a.Provider {
+		case fhidTypes.ArtifactAWS:
+			names = append(names, a.AmiID+":"+a.AmiRegion)
+		case fhidTypes.ArtifactOpenStack:
+			names = append(names, a.Project+"/"+a.GlanceImageID)
+		case fhidTypes.ArtifactAzure:
+			name := path.Base(a.ResourceID)
+			if a.GalleryVersion != "" {
+				name += ":" + a.GalleryVersion
+			}
+			names = append(names, name)
+		case fhidTypes.ArtifactGCE:
+			names = append(names, path.Base(a.SelfLink))
+		case fhidTypes.ArtifactDocker:
+			names = append(names, a.Repository+"@"+a.Digest)
+		case fhidTypes.ArtifactVMware:
+			names = append(names, a.TemplatePath)
+		}
+	}
+	return names
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// render writes v to w in the given format.
+func render(w io.Writer, format string, v interface{}) error {
+	switch v := v.(type) {
+	case *fhidTypes.ImageEntry:
+		if format == formatTable {
+			return render(w, format, imageList{*v})
+		}
+	case imageList:
+		if v == nil {
+			v = imageList{}
+		}
+		if format != formatTable {
+			return render(w, format, []fhidTypes.ImageEntry(v))
+		}
+	}
+	switch format {
+	case formatJSON:
+		data, err := json.MarshalIndent(v, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case formatYAML:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		// go through JSON so the YAML has the same field names and
+		// order as the API
+		ordered, err := orderedValue(json.NewDecoder(bytes.NewReader(data)))
+		if err != nil {
+			return err
+		}
+		data, err = yaml.Marshal(ordered)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	t, ok := v.(tabular)
+	if !ok {
+		return fmt.Errorf("%T can't be shown as a table", v)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(t.header(), "\t"))
+	for _, row := range t.rows() {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// orderedValue decodes the next JSON value from dec, keeping the order
+// of object keys.
+func orderedValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := yaml.MapSlice{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := orderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, yaml.MapItem{Key: key, Value: value})
+		}
+		_, err = dec.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			value, err := orderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		_, err = dec.Token()
+		return arr, err
+	}
+	return tok, nil
+}
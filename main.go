@@ -1,12 +1,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"strings"
 
 	"github.build.ge.com/212601587/fhid/fhid"
 	"github.build.ge.com/212601587/fhid/fhidConfig"
@@ -26,6 +28,9 @@ func main() {
 	var versionFlag bool
 	var daemonFlag bool
 	var noLogFile bool
+	var checkDB bool
+	var fixDB bool
+	var migrateNS bool
 	versionDefault = "v1.0"
 	flag.StringVar(&configFile, "c", "./config.json", "Path to config file.")
 	flag.StringVar(&logFile, "logfile", "fhid.log.json", "JSON logfile location")
@@ -34,8 +39,24 @@ func main() {
 	flag.BoolVar(&versionFlag, "version", false, "print version and exit")
 	flag.BoolVar(&daemonFlag, "daemon", false, "run as daemon with no stdout")
 	flag.BoolVar(&noLogFile, "nologfile", false, "Indicates whether or not to skip writing of a filesystem log file.")
+	flag.BoolVar(&checkDB, "checkdb", false, "Deprecated, use the checkdb command.")
+	flag.BoolVar(&fixDB, "fixdb", false, "Deprecated, use the checkdb command with -fix.")
+	flag.BoolVar(&migrateNS, "migratens", false, "Deprecated, use the migrate namespace command.")
 	flag.Parse()
 
+	// the flags that ran maintenance before there were commands
+	args := flag.Args()
+	var deprecated string
+	switch {
+	case migrateNS:
+		deprecated, args = "-migratens", []string{"migrate", "namespace"}
+	case checkDB:
+		deprecated, args = "-checkdb", []string{"checkdb"}
+		if fixDB {
+			args = append(args, "-fix")
+		}
+	}
+
 	if version == "" {
 		version = versionDefault
 	}
@@ -51,8 +72,15 @@ func main() {
 		log.Printf("major/minor handler version = %s\n", versionMajMin)
 		os.Exit(0)
 	}
+	// maintenance commands like export can write data to stdout
+	if len(args) > 0 {
+		fhidLogger.Console = os.Stderr
+	}
 	// if daemon just log to file
 	fhidLogger.SetLogger(daemonFlag, noLogFile, logFile, logLevel)
+	if deprecated != "" {
+		fhidLogger.Loggo.Warn("Flag is deprecated, use the command instead", "Flag", deprecated, "Command", strings.Join(args, " "))
+	}
 
 	if versionFlag {
 		fmt.Printf("fhid %s\n", version)
@@ -71,6 +99,16 @@ func main() {
 		os.Exit(1)
 	}
 	fhidLogger.Loggo.Info("Loaded config", "Config", fhidConfig.Config.ShowConfig())
+	err = fhidConfig.Config.Validate()
+	if err != nil {
+		fhidLogger.Loggo.Error("Invalid config", "filename", configFile, "Error", err)
+		os.Exit(1)
+	}
+	err = fhid.SetupAuth()
+	if err != nil {
+		fhidLogger.Loggo.Error("Error setting up authentication", "Error", err)
+		os.Exit(1)
+	}
 	err = fhid.SetupConnection()
 	if err != nil {
 		fhidLogger.Loggo.Error("Error in Redis test connection", "Error", err)
@@ -79,19 +117,197 @@ func main() {
 	} else {
 		fhidLogger.Loggo.Info("Successfully connected to Redis")
 	}
-	http.HandleFunc(fmt.Sprintf("/%s/images", versionMajMin), fhid.HandlerImages)
-	http.HandleFunc(fmt.Sprintf("/%s/query", versionMajMin), fhid.HandlerImagesQuery)
-
-	routeHealthcheckVersioned := fmt.Sprintf("/%s/healthcheck", versionMajMin)
-	http.HandleFunc(routeHealthcheckVersioned, fhid.HealthCheck)
-	fhidLogger.Loggo.Info("Listening on versioned healthcheck endpoint", "Endpoint", routeHealthcheckVersioned)
+	if len(args) > 0 {
+		err = runSubcommand(args[0], args[1:])
+		fhid.TeardownConnection()
+		if err != nil {
+			fhidLogger.Loggo.Error("Error running command", "Command", args[0], "Error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	routePrefix := fmt.Sprintf("/%s", versionMajMin)
+	http.Handle(routePrefix+"/", http.StripPrefix(routePrefix, fhid.NewRouter()))
+	fhidLogger.Loggo.Info("Serving versioned API", "Prefix", routePrefix)
 
 	http.HandleFunc("/healthcheck", fhid.HealthCheck)
 	listenString := fhidConfig.Config.ListenHost + ":" + fhidConfig.Config.ListenPort
 
-	http.ListenAndServe(listenString, nil)
+	if fhidConfig.Config.TLS != nil {
+		tlsConfig, err := fhid.TLSConfig()
+		if err != nil {
+			fhidLogger.Loggo.Error("Error loading TLS config", "Error", err)
+			os.Exit(1)
+		}
+		server := &http.Server{Addr: listenString, TLSConfig: tlsConfig}
+		fhidLogger.Loggo.Info("Listening on host with TLS", "Host", listenString, "ClientCerts", fhidConfig.Config.ClientCertsEnabled())
+		err = server.ListenAndServeTLS("", "")
+		fhidLogger.Loggo.Error("Server stopped", "Error", err)
+		os.Exit(1)
+	}
 	fhidLogger.Loggo.Info("Listening on host", "Host", listenString)
+	err = http.ListenAndServe(listenString, nil)
+	fhidLogger.Loggo.Error("Server stopped", "Error", err)
+
+}
+
+// runSubcommand runs one of the one-shot maintenance commands that
+// can follow the global flags, e.g. 'fhid -c config.json export'.
+func runSubcommand(name string, args []string) error {
+	switch name {
+	case "checkdb":
+		return runCheckDB(args)
+	case "export":
+		return runExport(args)
+	case "import":
+		return runImport(args)
+	case "migrate":
+		return runMigrate(args)
+	case "purge":
+		return runPurge(args)
+	}
+	return fmt.Errorf("unknown command '%s', must be one of checkdb, export, import, migrate or purge", name)
+}
+
+// runCheckDB reports, and with -fix repairs, entries missing from the
+// index and index members with no entry.
+func runCheckDB(args []string) error {
+	var fix bool
+	fs := flag.NewFlagSet("checkdb", flag.ExitOnError)
+	fs.BoolVar(&fix, "fix", false, "Repair any inconsistencies found.")
+	fs.Parse(args)
+	report, err := fhid.CheckConsistency(fix)
+	if err != nil {
+		return err
+	}
+	fhidLogger.Loggo.Info("Consistency report",
+		"OrphanedKeys", report.OrphanedKeys,
+		"DanglingMembers", report.DanglingMembers,
+		"Fixed", report.Fixed)
+	if !report.Consistent() && !report.Fixed {
+		return errors.New("datastore is inconsistent, run checkdb -fix to repair it")
+	}
+	return nil
+}
+
+// runExport writes the full image catalog as newline delimited JSON.
+func runExport(args []string) error {
+	var outFile string
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.StringVar(&outFile, "f", "-", "File to write exported entries to, '-' for stdout.")
+	fs.Parse(args)
+	out := os.Stdout
+	if outFile != "-" {
+		f, err := os.Create(outFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	n, err := fhid.ExportEntries(out)
+	fhidLogger.Loggo.Info("Exported entries", "Count", n, "File", outFile)
+	return err
+}
+
+// runImport loads a newline delimited JSON catalog written by export.
+func runImport(args []string) error {
+	var inFile string
+	var opts fhid.ImportOptions
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.StringVar(&inFile, "f", "-", "File to read entries from, '-' for stdin.")
+	fs.BoolVar(&opts.DryRun, "dryrun", false, "Check entries and report every problem and conflict without writing anything.")
+	fs.BoolVar(&opts.Validate, "validate", false, "Also check entries the same way as a POST.")
+	fs.StringVar(&opts.Conflict, "conflict", fhid.ConflictFail, "What to do when an entry already exists: skip, overwrite or fail.")
+	fs.Parse(args)
+	in := os.Stdin
+	if inFile != "-" {
+		f, err := os.Open(inFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	opts.Progress = func(stats *fhid.ImportStats) {
+		fhidLogger.Loggo.Info("Import progress",
+			"Read", stats.Read, "Written", stats.Written,
+			"Skipped", stats.Skipped, "Overwritten", stats.Overwritten,
+			"DryRun", opts.DryRun)
+	}
+	stats, err := fhid.ImportEntries(in, opts)
+	for _, problem := range stats.Problems {
+		fhidLogger.Loggo.Error("Import problem", "Problem", problem)
+	}
+	return err
+}
 
+// runMigrate runs one of the migrations, 'schema' or 'namespace'.
+// A bare 'migrate' is the schema migration, as it was before there
+// were others.
+func runMigrate(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fhidLogger.Loggo.Warn("migrate without a migration is deprecated, use migrate schema")
+		return runMigrateSchema(args)
+	}
+	switch args[0] {
+	case "schema":
+		return runMigrateSchema(args[1:])
+	case "namespace":
+		return runMigrateNamespace(args[1:])
+	}
+	return fmt.Errorf("unknown migration '%s', must be schema or namespace", args[0])
+}
+
+// runMigrateSchema rewrites stored entries that are on an older schema
+// version.
+func runMigrateSchema(args []string) error {
+	var dryRun bool
+	fs := flag.NewFlagSet("migrate schema", flag.ExitOnError)
+	fs.BoolVar(&dryRun, "dryrun", false, "Count the entries that need migrating without rewriting them.")
+	fs.Parse(args)
+	n, err := fhid.MigrateSchema(dryRun)
+	fhidLogger.Loggo.Info("Migrated entries to current schema", "Count", n, "DryRun", dryRun)
+	return err
+}
+
+// runMigrateNamespace moves entries stored under bare keys into the
+// configured RedisNamespace.
+func runMigrateNamespace(args []string) error {
+	fs := flag.NewFlagSet("migrate namespace", flag.ExitOnError)
+	fs.Parse(args)
+	moved, skipped, err := fhid.MigrateNamespace()
+	if err != nil {
+		return err
+	}
+	fhidLogger.Loggo.Info("Migrated entries into namespace", "Moved", moved, "Skipped", skipped)
+	return nil
+}
+
+// runPurge deletes every entry after asking for confirmation.
+func runPurge(args []string) error {
+	var dryRun, yes bool
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	fs.BoolVar(&dryRun, "dryrun", false, "Count the entries that would be deleted without deleting them.")
+	fs.BoolVar(&yes, "yes", false, "Don't ask for confirmation.")
+	fs.Parse(args)
+	n, err := fhid.PurgeEntries(true)
+	if err != nil || dryRun {
+		fhidLogger.Loggo.Info("Entries that would be purged", "Count", n)
+		return err
+	}
+	if !yes {
+		fmt.Printf("Are you sure you want to delete all %d entries in %s (y/n)? ", n, fhidConfig.Config.RedisEndpoint)
+		var answer string
+		fmt.Scanln(&answer)
+		if strings.ToLower(answer) != "y" {
+			fmt.Println("exiting without purge")
+			return nil
+		}
+	}
+	n, err = fhid.PurgeEntries(false)
+	fhidLogger.Loggo.Info("Purged entries", "Count", n)
+	return err
 }
 
 func versionSplitter(fullver string, override string) (verMinMaj string) {